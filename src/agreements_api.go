@@ -322,7 +322,20 @@ func (e mainEnv) agreementUserReport(w http.ResponseWriter, r *http.Request, ps
 		return
 	}
 
-	resultJSON, numRecords, err := e.db.listAgreementRecords(userTOKEN)
+	var resultJSON []byte
+	var numRecords int
+	var err error
+	if len(userTOKEN) > 0 {
+		resultJSON, numRecords, err = e.db.listAgreementRecords(userTOKEN)
+	} else {
+		switch mode {
+		case "email":
+			address = normalizeEmail(address)
+		case "phone":
+			address = normalizePhone(address, e.conf.Sms.DefaultCountry)
+		}
+		resultJSON, numRecords, err = e.db.listAgreementRecordsByWho(address)
+	}
 	if err != nil {
 		returnError(w, r, "internal error", 405, err, event)
 		return
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	//"errors"
 	"fmt"
+	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/paranoidguy/databunker/src/storage"
@@ -25,7 +27,69 @@ type agreement struct {
 	Agreementmethod string `json:"agreementmethod,omitempty" structs:"agreementmethod"`
 }
 
+// Address of the consent-giver is stored encrypted in who column. Records
+// are found by blind index of the address in whoidx column. Agreements saved
+// before who was encrypted are found by plaintext who until they are migrated.
+
+// agreementLegacyRows is set to 0 when who of all agreements is encrypted
+var agreementLegacyRows int32 = 1
+
+// agreementWhoKeys returns column and value pairs to find agreements of the
+// address: current and, during key rotation, old blind index and plaintext
+// address of not migrated records
+func (dbobj dbcon) agreementWhoKeys(usercode string) [][2]string {
+	keys := [][2]string{{"whoidx", hashIndex(dbobj.indexKey, "who", usercode)}}
+	if dbobj.rotationEnabled() {
+		keys = append(keys, [2]string{"whoidx", hashIndex(dbobj.oldIndexKey, "who", usercode)})
+	}
+	if atomic.LoadInt32(&agreementLegacyRows) == 1 {
+		keys = append(keys, [2]string{"who", usercode})
+	}
+	return keys
+}
+
+// setAgreementWho saves encrypted address and its blind index in bdoc
+func (dbobj dbcon) setAgreementWho(bdoc bson.M, usercode string) error {
+	encoded, err := basicStringEncrypt(usercode, dbobj.masterKey, dbobj.GetCode())
+	if err != nil {
+		return err
+	}
+	bdoc["who"] = encoded
+	bdoc["whoidx"] = hashIndex(dbobj.indexKey, "who", usercode)
+	return nil
+}
+
+// decryptAgreementWho replaces encrypted address with plaintext one and
+// removes blind index, it is used before agreements are returned
+func (dbobj dbcon) decryptAgreementWho(record bson.M) {
+	whoidx, _ := record["whoidx"].(string)
+	delete(record, "whoidx")
+	if len(whoidx) == 0 {
+		return
+	}
+	if who, ok := record["who"].(string); ok {
+		plain, err := dbobj.decryptString(who)
+		if err == nil {
+			record["who"] = plain
+		}
+	}
+}
+
 func (dbobj dbcon) acceptAgreement(userTOKEN string, mode string, usercode string, brief string,
+	status string, agreementmethod string, referencecode string, lastmodifiedby string,
+	starttime int32, endtime int32) (bool, error) {
+	changed := false
+	// lookup and insert are done in one transaction to avoid duplicate records
+	err := dbobj.withTx(func(dbTx dbcon) error {
+		var err error
+		changed, err = dbTx.acceptAgreementDo(userTOKEN, mode, usercode, brief, status,
+			agreementmethod, referencecode, lastmodifiedby, starttime, endtime)
+		return err
+	})
+	return changed, err
+}
+
+func (dbobj dbcon) acceptAgreementDo(userTOKEN string, mode string, usercode string, brief string,
 	status string, agreementmethod string, referencecode string, lastmodifiedby string,
 	starttime int32, endtime int32) (bool, error) {
 	now := int32(time.Now().Unix())
@@ -46,7 +110,10 @@ func (dbobj dbcon) acceptAgreement(userTOKEN string, mode string, usercode strin
 			return false, err
 		}
 		if raw != nil {
-			dbobj.store.UpdateRecord2(storage.TblName.Agreements, "token", userTOKEN, "brief", brief, &bdoc, nil)
+			_, err = dbobj.store.UpdateRecord2(storage.TblName.Agreements, "token", userTOKEN, "brief", brief, &bdoc, nil)
+			if err != nil {
+				return false, err
+			}
 			if status != raw["status"].(string) {
 				// status changed
 				return true, nil
@@ -54,13 +121,23 @@ func (dbobj dbcon) acceptAgreement(userTOKEN string, mode string, usercode strin
 			return false, nil
 		}
 	} else {
-		raw, err := dbobj.store.GetRecord2(storage.TblName.Agreements, "who", usercode, "brief", brief)
-		if err != nil {
-			fmt.Printf("error to find:%s", err)
-			return false, err
-		}
-		if raw != nil {
-			dbobj.store.UpdateRecord2(storage.TblName.Agreements, "who", usercode, "brief", brief, &bdoc, nil)
+		for _, key := range dbobj.agreementWhoKeys(usercode) {
+			raw, err := dbobj.store.GetRecord2(storage.TblName.Agreements, key[0], key[1], "brief", brief)
+			if err != nil {
+				fmt.Printf("error to find:%s", err)
+				return false, err
+			}
+			if raw == nil {
+				continue
+			}
+			err = dbobj.setAgreementWho(bdoc, usercode)
+			if err != nil {
+				return false, err
+			}
+			_, err = dbobj.store.UpdateRecord2(storage.TblName.Agreements, key[0], key[1], "brief", brief, &bdoc, nil)
+			if err != nil {
+				return false, err
+			}
 			if status != raw["status"].(string) {
 				// status changed
 				return true, nil
@@ -70,7 +147,10 @@ func (dbobj dbcon) acceptAgreement(userTOKEN string, mode string, usercode strin
 	}
 	bdoc["brief"] = brief
 	bdoc["mode"] = mode
-	bdoc["who"] = usercode
+	err := dbobj.setAgreementWho(bdoc, usercode)
+	if err != nil {
+		return false, err
+	}
 	bdoc["token"] = userTOKEN
 	bdoc["creationtime"] = now
 	if len(agreementmethod) > 0 {
@@ -79,7 +159,7 @@ func (dbobj dbcon) acceptAgreement(userTOKEN string, mode string, usercode strin
 		bdoc["agreementmethod"] = "api"
 	}
 	// in any case - insert record
-	_, err := dbobj.store.CreateRecord(storage.TblName.Agreements, &bdoc)
+	_, err = dbobj.store.CreateRecord(storage.TblName.Agreements, &bdoc)
 	if err != nil {
 		fmt.Printf("error to insert record: %s\n", err)
 		return false, err
@@ -91,8 +171,48 @@ func (dbobj dbcon) acceptAgreement(userTOKEN string, mode string, usercode strin
 func (dbobj dbcon) linkAgreementRecords(userTOKEN string, mode string, usercode string) error {
 	bdoc := bson.M{}
 	bdoc["token"] = userTOKEN
-	_, err := dbobj.store.UpdateRecord2(storage.TblName.Agreements, "token", "", "who", usercode, &bdoc, nil)
-	return err
+	for _, key := range dbobj.agreementWhoKeys(usercode) {
+		_, err := dbobj.store.UpdateRecord2(storage.TblName.Agreements, "token", "", key[0], key[1], &bdoc, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkNewUserAgreements links agreements accepted before user record was created
+func (dbobj dbcon) linkNewUserAgreements(userTOKEN string, parsedData userJSON) {
+	if len(parsedData.emailIdx) > 0 {
+		dbobj.linkAgreementRecords(userTOKEN, "email", parsedData.emailIdx)
+	}
+	if len(parsedData.phoneIdx) > 0 {
+		dbobj.linkAgreementRecords(userTOKEN, "phone", parsedData.phoneIdx)
+	}
+	for field, value := range parsedData.searchIdx {
+		if len(value) > 0 {
+			dbobj.linkAgreementRecords(userTOKEN, field, value)
+		}
+	}
+	if len(parsedData.emailIdx) > 0 && len(parsedData.phoneIdx) > 0 {
+		// delete duplicate consent records for user
+		var briefCodes []string
+		for _, key := range dbobj.agreementWhoKeys(parsedData.emailIdx) {
+			records, _ := dbobj.store.GetList(storage.TblName.Agreements, key[0], key[1], 0, 0, "")
+			for _, val := range records {
+				//fmt.Printf("adding brief code: %s\n", val["brief"].(string))
+				briefCodes = append(briefCodes, val["brief"].(string))
+			}
+		}
+		for _, key := range dbobj.agreementWhoKeys(parsedData.phoneIdx) {
+			records, _ := dbobj.store.GetList(storage.TblName.Agreements, key[0], key[1], 0, 0, "")
+			for _, val := range records {
+				//fmt.Printf("XXX checking brief code for duplicates: %s\n", val["brief"].(string))
+				if contains(briefCodes, val["brief"].(string)) == true {
+					dbobj.store.DeleteRecord2(storage.TblName.Agreements, "token", userTOKEN, key[0], key[1])
+				}
+			}
+		}
+	}
 }
 
 func (dbobj dbcon) withdrawAgreement(userTOKEN string, brief string, mode string, usercode string, lastmodifiedby string) error {
@@ -101,15 +221,20 @@ func (dbobj dbcon) withdrawAgreement(userTOKEN string, brief string, mode string
 	bdoc := bson.M{}
 	bdoc["when"] = now
 	bdoc["mode"] = mode
-	bdoc["who"] = usercode
 	bdoc["endtime"] = 0
 	bdoc["status"] = "no"
 	bdoc["lastmodifiedby"] = lastmodifiedby
+	err := dbobj.setAgreementWho(bdoc, usercode)
+	if err != nil {
+		return err
+	}
 	if len(userTOKEN) > 0 {
 		fmt.Printf("%s %s\n", userTOKEN, brief)
 		dbobj.store.UpdateRecord2(storage.TblName.Agreements, "token", userTOKEN, "brief", brief, &bdoc, nil)
 	} else {
-		dbobj.store.UpdateRecord2(storage.TblName.Agreements, "who", usercode, "brief", brief, &bdoc, nil)
+		for _, key := range dbobj.agreementWhoKeys(usercode) {
+			dbobj.store.UpdateRecord2(storage.TblName.Agreements, key[0], key[1], "brief", brief, &bdoc, nil)
+		}
 	}
 	return nil
 }
@@ -120,9 +245,33 @@ func (dbobj dbcon) listAgreementRecords(userTOKEN string) ([]byte, int, error) {
 	if err != nil {
 		return nil, 0, err
 	}
+	return dbobj.agreementRecordsJSON(records)
+}
+
+// listAgreementRecordsByWho returns agreements of the address that are not linked to a user
+func (dbobj dbcon) listAgreementRecordsByWho(usercode string) ([]byte, int, error) {
+	var records []bson.M
+	for _, key := range dbobj.agreementWhoKeys(usercode) {
+		found, err := dbobj.store.GetList(storage.TblName.Agreements, key[0], key[1], 0, 0, "")
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, record := range found {
+			if token, _ := record["token"].(string); len(token) == 0 {
+				records = append(records, record)
+			}
+		}
+	}
+	return dbobj.agreementRecordsJSON(records)
+}
+
+func (dbobj dbcon) agreementRecordsJSON(records []bson.M) ([]byte, int, error) {
+	for _, record := range records {
+		dbobj.decryptAgreementWho(record)
+	}
 	count := len(records)
 	if count == 0 {
-		return []byte("[]"), 0, err
+		return []byte("[]"), 0, nil
 	}
 	resultJSON, err := json.Marshal(records)
 	if err != nil {
@@ -137,6 +286,7 @@ func (dbobj dbcon) viewAgreementRecord(userTOKEN string, brief string) ([]byte,
 	if record == nil || err != nil {
 		return nil, err
 	}
+	dbobj.decryptAgreementWho(record)
 	resultJSON, err := json.Marshal(record)
 	if err != nil {
 		return nil, err
@@ -164,11 +314,40 @@ func (dbobj dbcon) expireAgreementRecords(notifyURL string) error {
 			dbobj.store.UpdateRecord2(storage.TblName.Agreements, "token", userTOKEN, "brief", brief, &bdoc, nil)
 			notifyConsentChange(notifyURL, brief, "expired", "token", userTOKEN)
 		} else {
-			usercode := rec["who"].(string)
-			dbobj.store.UpdateRecord2(storage.TblName.Agreements, "who", usercode, "brief", brief, &bdoc, nil)
-			notifyConsentChange(notifyURL, brief, "expired", rec["mode"].(string), usercode)
+			// record is updated by stored who, it can be encrypted or not migrated yet
+			who := rec["who"].(string)
+			dbobj.store.UpdateRecord2(storage.TblName.Agreements, "who", who, "brief", brief, &bdoc, nil)
+			dbobj.decryptAgreementWho(rec)
+			notifyConsentChange(notifyURL, brief, "expired", rec["mode"].(string), rec["who"].(string))
 		}
 
 	}
 	return nil
 }
+
+// migrateAgreementWho encrypts who of agreements saved before it was
+// encrypted. All records with the same who are updated at once, so records
+// are walked by who. It returns when done or when stop channel is closed.
+func (dbobj dbcon) migrateAgreementWho(stop chan struct{}) error {
+	phases := []batchPhase{
+		{"agreements", storage.TblName.Agreements, "who", func(record bson.M) error {
+			if whoidx, _ := record["whoidx"].(string); len(whoidx) > 0 {
+				return nil
+			}
+			usercode := record["who"].(string)
+			bdoc := bson.M{}
+			err := dbobj.setAgreementWho(bdoc, usercode)
+			if err != nil {
+				return err
+			}
+			_, err = dbobj.store.UpdateRecord(storage.TblName.Agreements, "who", usercode, &bdoc)
+			return err
+		}},
+	}
+	done, err := dbobj.runBatchJob("agreement who encryption", phases, stop)
+	if done {
+		atomic.StoreInt32(&agreementLegacyRows, 0)
+		log.Printf("all agreements have encrypted who\n")
+	}
+	return err
+}
@@ -74,7 +74,7 @@ func (e mainEnv) getAuditEvent(w http.ResponseWriter, r *http.Request, ps httpro
 	if enforceUUID(w, atoken, event) == false {
 		return
 	}
-	userTOKEN, resultJSON, err := e.db.getAuditEvent(atoken)
+	userTOKEN, appName, resultJSON, err := e.db.getAuditEvent(atoken)
 	log.Printf("extracted user token: %s", userTOKEN)
 	if err != nil {
 		returnError(w, r, "internal error", 405, err, event)
@@ -84,6 +84,18 @@ func (e mainEnv) getAuditEvent(w http.ResponseWriter, r *http.Request, ps httpro
 	if e.enforceAuth(w, r, event) == "" {
 		return
 	}
+	scope := requestScope(r)
+	if len(appName) > 0 && scope.allowsApp(appName) == false {
+		returnError(w, r, "app is not allowed by token scope", 403, nil, event)
+		return
+	}
+	if len(appName) == 0 {
+		resultJSON, err = scope.filterEventFields(resultJSON)
+		if err != nil {
+			returnError(w, r, "internal error", 405, err, event)
+			return
+		}
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(200)
 	str := fmt.Sprintf(`{"status":"ok","event":%s}`, resultJSON)
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	uuid "github.com/hashicorp/go-uuid"
@@ -77,21 +79,77 @@ func (event auditEvent) submit(db *dbcon) {
 	db.store.CreateRecord(storage.TblName.Audit, &bdoc)
 }
 
+// auditLegacyRows is set to 0 when all audit records are moved from the fixed nonce encryption
+var auditLegacyRows int32 = 1
+
+// auditRecordValues returns all encrypted forms of user token that can be stored in audit.
+// During master key rotation or audit migration some events are encrypted differently.
+func (dbobj dbcon) auditRecordValues(userTOKEN string) []string {
+	keys := [][]byte{dbobj.masterKey}
+	codes := [][]byte{dbobj.GetCode()}
+	if dbobj.rotationEnabled() {
+		keys = append(keys, dbobj.oldMasterKey)
+		codes = append(codes, dbobj.oldHash[4:12])
+	}
+	var values []string
+	for i := range keys {
+		value, _ := basicStringEncrypt(userTOKEN, keys[i], codes[i])
+		values = append(values, value)
+		if atomic.LoadInt32(&auditLegacyRows) == 1 {
+			value, _ = legacyStringEncrypt(userTOKEN, keys[i], codes[i])
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 func (dbobj dbcon) getAuditEvents(userTOKEN string, offset int32, limit int32) ([]byte, int64, error) {
-	userTOKENEnc, _ := basicStringEncrypt(userTOKEN, dbobj.masterKey, dbobj.GetCode())
-	count, err := dbobj.store.CountRecords(storage.TblName.Audit, "record", userTOKENEnc)
-	if err != nil {
-		return nil, 0, err
+	values := dbobj.auditRecordValues(userTOKEN)
+	var records []bson.M
+	count := int64(0)
+	for _, userTOKENEnc := range values {
+		valueCount, err := dbobj.store.CountRecords(storage.TblName.Audit, "record", userTOKENEnc)
+		if err != nil {
+			return nil, 0, err
+		}
+		count = count + valueCount
+	}
+	if len(values) == 1 {
+		valueRecords, err := dbobj.store.GetList(storage.TblName.Audit, "record", values[0], offset, limit, "when")
+		if err != nil {
+			return nil, 0, err
+		}
+		records = valueRecords
+	} else {
+		// events with different encrypted record values are merged and sorted,
+		// so pages are the same as with a single value
+		fetch := int32(0)
+		if limit > 0 && offset+limit <= 100 {
+			fetch = offset + limit
+		}
+		for _, userTOKENEnc := range values {
+			valueRecords, err := dbobj.store.GetList(storage.TblName.Audit, "record", userTOKENEnc, 0, fetch, "when")
+			if err != nil {
+				return nil, 0, err
+			}
+			records = append(records, valueRecords...)
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			return getInt64Value(records[i], "when") > getInt64Value(records[j], "when")
+		})
+		if int(offset) >= len(records) {
+			records = nil
+		} else {
+			records = records[offset:]
+		}
+		if limit > 0 && len(records) > int(limit) {
+			records = records[:limit]
+		}
 	}
 	if count == 0 {
-		return []byte("[]"), 0, err
+		return []byte("[]"), 0, nil
 	}
 	var results []bson.M
-	records, err := dbobj.store.GetList(storage.TblName.Audit, "record", userTOKENEnc, offset, limit, "when")
-	if err != nil {
-		return nil, 0, err
-	}
-	code := dbobj.GetCode()
 	for _, element := range records {
 		element["more"] = false
 		if _, ok := element["before"]; ok {
@@ -107,7 +165,7 @@ func (dbobj dbcon) getAuditEvents(userTOKEN string, offset int32, limit int32) (
 			element["debug"] = ""
 		}
 		if _, ok := element["who"]; ok {
-			element["who"], _ = basicStringDecrypt(element["who"].(string), dbobj.masterKey, code)
+			element["who"], _ = dbobj.decryptString(element["who"].(string))
 		}
 		element["record"] = userTOKEN
 		results = append(results, element)
@@ -132,7 +190,6 @@ func (dbobj dbcon) getAdminAuditEvents(offset int32, limit int32) ([]byte, int64
         if err != nil {
                 return nil, 0, err
         }
-	code := dbobj.GetCode()
         for _, element := range records {
                 element["more"] = false
                 if _, ok := element["before"]; ok {
@@ -148,10 +205,10 @@ func (dbobj dbcon) getAdminAuditEvents(offset int32, limit int32) ([]byte, int64
                         element["debug"] = ""
                 }
                 if _, ok := element["record"]; ok {
-                        element["record"], _ = basicStringDecrypt(element["record"].(string), dbobj.masterKey, code)
+                        element["record"], _ = dbobj.decryptString(element["record"].(string))
                 }
                 if _, ok := element["who"]; ok {
-                        element["who"], _ = basicStringDecrypt(element["who"].(string), dbobj.masterKey, code)
+                        element["who"], _ = dbobj.decryptString(element["who"].(string))
                 }
                 results = append(results, element)
         }
@@ -163,14 +220,14 @@ func (dbobj dbcon) getAdminAuditEvents(offset int32, limit int32) ([]byte, int64
 }
 
 
-func (dbobj dbcon) getAuditEvent(atoken string) (string, []byte, error) {
+func (dbobj dbcon) getAuditEvent(atoken string) (string, string, []byte, error) {
 	//var results []*auditEvent
 	record, err := dbobj.store.GetRecord(storage.TblName.Audit, "atoken", atoken)
 	if err != nil {
-		return "", nil, err
+		return "", "", nil, err
 	}
 	if len(record) == 0 {
-		return "", nil, errors.New("not found")
+		return "", "", nil, errors.New("not found")
 	}
 	//fmt.Printf("audit record: %s\n", record)
 	before := ""
@@ -188,13 +245,14 @@ func (dbobj dbcon) getAuditEvent(atoken string) (string, []byte, error) {
 	//recBson := bson.M{}
 	userTOKEN := ""
 	if _, ok := record["record"]; !ok {
-		return userTOKEN, nil, errors.New("not found")
+		return userTOKEN, "", nil, errors.New("not found")
 	}
 	userTOKENEnc := record["record"].(string)
 	if len(userTOKENEnc) == 0 {
-		return userTOKEN, nil, errors.New("empty token")
+		return userTOKEN, "", nil, errors.New("empty token")
 	}
-	userTOKEN, _ = basicStringDecrypt(userTOKENEnc, dbobj.masterKey, dbobj.GetCode())
+	userTOKEN, _ = dbobj.decryptString(userTOKENEnc)
+	appName, _ := record["app"].(string)
 	if len(before) > 0 {
 		before2, after2, _ := dbobj.userDecrypt2(userTOKEN, before, after)
 		log.Printf("before: %s", before2)
@@ -203,21 +261,67 @@ func (dbobj dbcon) getAuditEvent(atoken string) (string, []byte, error) {
 		record["after"] = after2
 		if len(debug) == 0 {
 			result := fmt.Sprintf(`{"before":%s,"after":%s}`, before2, after2)
-			return userTOKEN, []byte(result), nil
+			return userTOKEN, appName, []byte(result), nil
 		}
 		result := fmt.Sprintf(`{"before":%s,"after":%s,"debug":"%s"}`, before2, after2, debug)
-		return userTOKEN, []byte(result), nil
+		return userTOKEN, appName, []byte(result), nil
 	}
 	if len(after) > 0 {
 		after2, _ := dbobj.userDecrypt(userTOKEN, after)
 		log.Printf("after: %s", after2)
 		record["after"] = after2
 		result := fmt.Sprintf(`{"after":%s,"debug":"%s"}`, after2, debug)
-		return userTOKEN, []byte(result), nil
+		return userTOKEN, appName, []byte(result), nil
 	}
 	if len(debug) > 0 {
 		result := fmt.Sprintf(`{"debug":"%s"}`, debug)
-		return userTOKEN, []byte(result), nil
+		return userTOKEN, appName, []byte(result), nil
+	}
+	return userTOKEN, appName, []byte("{}"), nil
+}
+
+// upgradeAuditFields adds who and record fields encrypted with the current
+// key and algorithm to bdoc, if stored values are different. It returns user token.
+func (dbobj dbcon) upgradeAuditFields(record bson.M, bdoc bson.M) string {
+	userTOKEN := ""
+	for _, field := range []string{"who", "record"} {
+		value, _ := record[field].(string)
+		if len(value) == 0 {
+			continue
+		}
+		plain, err := dbobj.decryptString(value)
+		if err != nil {
+			continue
+		}
+		encoded, err := basicStringEncrypt(plain, dbobj.masterKey, dbobj.GetCode())
+		if err == nil && encoded != value {
+			bdoc[field] = encoded
+		}
+		if field == "record" {
+			userTOKEN = plain
+		}
+	}
+	return userTOKEN
+}
+
+// migrateAuditEncryption re-encrypts audit fields stored with the fixed nonce
+// AES-GCM. Progress is saved in keyrotation table, so the job continues
+// after restart. It returns when done or when stop channel is closed.
+func (dbobj dbcon) migrateAuditEncryption(stop chan struct{}) error {
+	phases := []batchPhase{
+		{"audit", storage.TblName.Audit, "atoken", func(record bson.M) error {
+			bdoc := bson.M{}
+			dbobj.upgradeAuditFields(record, bdoc)
+			if len(bdoc) == 0 {
+				return nil
+			}
+			_, err := dbobj.store.UpdateRecord(storage.TblName.Audit, "atoken", record["atoken"].(string), &bdoc)
+			return err
+		}},
+	}
+	done, err := dbobj.runBatchJob("audit field encryption", phases, stop)
+	if done {
+		atomic.StoreInt32(&auditLegacyRows, 0)
 	}
-	return userTOKEN, []byte("{}"), nil
+	return err
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// backupDB API call. Backup is encrypted and signed when backup key is configured.
+func (e mainEnv) backupDB(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if e.enforceAuth(w, r, nil) == "" {
+		return
+	}
+	backupKey, err := backupKeyGet(e.conf)
+	if err != nil {
+		returnError(w, r, "bad backup key", 500, err, nil)
+		return
+	}
+	if err = checkBackupKeys(); err != nil {
+		returnError(w, r, err.Error(), 405, err, nil)
+		return
+	}
+	if len(backupKey) > 0 {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.WriteHeader(200)
+	err = e.db.writeBackup(w, backupKey)
+	if err != nil {
+		fmt.Printf("error in backup: %s\n", err)
+	}
+}
+
+// backupStatus returns result of the last scheduled backup with file name
+func (e mainEnv) backupStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if e.enforceAdmin(w, r) == "" {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","backup":%s}`, lastBackup.toJSON(true))
+}
+
+// restoreDB API call. Request body is a backup produced by /v1/sys/backup.
+func (e mainEnv) restoreDB(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	event := audit("restore database", "", "", "")
+	defer func() { event.submit(e.db) }()
+	if e.enforceAdmin(w, r) == "" {
+		event.Status = "error"
+		event.Msg = "access denied"
+		return
+	}
+	backupKey, err := backupKeyGet(e.conf)
+	if err != nil {
+		returnError(w, r, "bad backup key", 500, err, event)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, backupMaxSize))
+	if err != nil {
+		returnError(w, r, "failed to read request body", 405, err, event)
+		return
+	}
+	err = e.db.restoreBackup(data, backupKey, e.conf.Backup.AllowPlaintextRestore)
+	if err != nil {
+		returnError(w, r, "failed to restore: "+err.Error(), 405, err, event)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","result":"restored"}`)
+}
+
+// backupKeys API call returns user keys export. It is a separate artifact
+// from database backup, keys are wrapped with the key-encryption key.
+func (e mainEnv) backupKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	event := audit("export user keys", "", "", "")
+	defer func() { event.submit(e.db) }()
+	if e.enforceAdmin(w, r) == "" {
+		event.Status = "error"
+		event.Msg = "access denied"
+		return
+	}
+	export, err := e.db.exportUserKeys()
+	if err != nil {
+		returnError(w, r, err.Error(), 405, err, event)
+		return
+	}
+	resultJSON, err := json.Marshal(export)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	event.Msg = fmt.Sprintf("exported %d keys", len(export.Keys))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	w.Write(resultJSON)
+}
+
+// restoreKeys API call imports user keys export produced by /v1/sys/backup/keys.
+// On a new instance keys are imported before database backup is restored.
+func (e mainEnv) restoreKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	event := audit("import user keys", "", "", "")
+	defer func() { event.submit(e.db) }()
+	if e.enforceAdmin(w, r) == "" {
+		event.Status = "error"
+		event.Msg = "access denied"
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, backupMaxSize))
+	if err != nil {
+		returnError(w, r, "failed to read request body", 405, err, event)
+		return
+	}
+	imported, err := e.db.importUserKeys(data)
+	if err != nil {
+		returnError(w, r, "failed to import user keys: "+err.Error(), 405, err, event)
+		return
+	}
+	event.Msg = fmt.Sprintf("imported %d keys", imported)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","imported":%d}`, imported)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const backupFilePrefix = "databunker-backup-"
+
+// backupState keeps the result of the last scheduled backup
+type backupState struct {
+	sync.Mutex
+	when   int32
+	status string
+	file   string
+}
+
+var lastBackup backupState
+
+var (
+	backupLastTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "databunker_backup_last_time",
+		Help: "Unix time of the last scheduled backup.",
+	})
+	backupLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "databunker_backup_last_success",
+		Help: "1 if the last scheduled backup succeeded, 0 otherwise.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(backupLastTime, backupLastSuccess)
+}
+
+func (s *backupState) set(status string, file string) {
+	s.Lock()
+	defer s.Unlock()
+	s.when = int32(time.Now().Unix())
+	s.status = status
+	s.file = file
+	backupLastTime.Set(float64(s.when))
+	if status == "ok" {
+		backupLastSuccess.Set(1)
+	} else {
+		backupLastSuccess.Set(0)
+	}
+}
+
+// toJSON returns state of the last backup. File path is returned for
+// admin only, status endpoint is open to everyone.
+func (s *backupState) toJSON(withFile bool) string {
+	s.Lock()
+	defer s.Unlock()
+	if s.when == 0 {
+		return "null"
+	}
+	if withFile == false {
+		return fmt.Sprintf(`{"status":%q,"when":%d}`, s.status, s.when)
+	}
+	return fmt.Sprintf(`{"status":%q,"when":%d,"file":%q}`, s.status, s.when, s.file)
+}
+
+// validateBackup loads backup into temporary database and checks that
+// current master key can decrypt a sample user record. User keys are not in
+// backup, so keys of the current key table are used. Backup is rejected when
+// it has user records, but none of their keys are found: key export must be
+// imported first.
+func (dbobj dbcon) validateBackup(dump []byte) error {
+	tmp, err := storage.OpenDump(dump)
+	if err != nil {
+		return err
+	}
+	defer tmp.CloseDB()
+	root, err := tmp.GetRecord2(storage.TblName.Xtokens, "token", "", "type", "root")
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return errors.New("root token is missing in backup")
+	}
+	records, err := tmp.GetList0(storage.TblName.Users, 0, 100, "")
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, record := range records {
+		if isForgottenUser(record) {
+			continue
+		}
+		encData0, _ := record["data"].(string)
+		recordKey, err := dbobj.userRecordKey(record)
+		if err != nil {
+			return err
+		}
+		if recordKey == nil {
+			missing++
+			continue
+		}
+		encData, err := base64.StdEncoding.DecodeString(encData0)
+		if err != nil {
+			return err
+		}
+		_, err = dbobj.decryptRecord(recordKey, encData)
+		if err != nil {
+			return errors.New("master key can not decrypt backup records")
+		}
+		return nil
+	}
+	if missing > 0 {
+		return errors.New("user keys of backup records are not found, import user keys export first")
+	}
+	fmt.Println("backup has no user records to verify master key")
+	return nil
+}
+
+// checkBackupKeys returns error when user keys can not be exported. User
+// keys are never saved in backups, so without key export backup can not be
+// restored on a new instance.
+func checkBackupKeys() error {
+	if userKEK == nil {
+		return errors.New("encryption.kek is required for backups, user keys are exported with /v1/sys/backup/keys")
+	}
+	return nil
+}
+
+// writeBackup writes database backup, encrypted when backup key is set
+func (dbobj dbcon) writeBackup(w io.Writer, backupKey []byte) error {
+	if err := checkBackupKeys(); err != nil {
+		return err
+	}
+	if len(backupKey) == 0 {
+		return dbobj.store.BackupDB(w)
+	}
+	bw, err := newBackupWriter(w, backupKey)
+	if err != nil {
+		return err
+	}
+	err = dbobj.store.BackupDB(bw)
+	if err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+// restoreBackup validates backup and replaces all database tables with it.
+// When backup key is set, plain SQL dump is accepted only with allowPlaintext,
+// otherwise manifest and signature checks can be skipped by the input.
+func (dbobj dbcon) restoreBackup(data []byte, backupKey []byte, allowPlaintext bool) error {
+	dump := data
+	if len(backupKey) > 0 && isEncryptedBackup(data) == false && allowPlaintext == false {
+		return errors.New("backup is not encrypted, plaintext restore is disabled")
+	}
+	if isEncryptedBackup(data) {
+		var manifest *backupManifest
+		var err error
+		dump, manifest, err = readBackup(data, backupKey)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("backup manifest verified, created: %d, tables: %v\n", manifest.Created, manifest.Tables)
+	}
+	err := dbobj.validateBackup(dump)
+	if err != nil {
+		return err
+	}
+	err = dbobj.store.RestoreDB(dump)
+	if err != nil {
+		return err
+	}
+	// root token can be different in restored database
+	rootXTOKEN = ""
+	return nil
+}
+
+func (dbobj dbcon) restoreBackupFile(filename string, backupKey []byte, allowPlaintext bool) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return dbobj.restoreBackup(data, backupKey, allowPlaintext)
+}
+
+// backupToDir writes a new backup file into dir and returns its name
+func (dbobj dbcon) backupToDir(dir string, backupKey []byte) (string, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	ext := ".sql"
+	if len(backupKey) > 0 {
+		ext = ".dbk"
+	}
+	name := backupFilePrefix + time.Now().UTC().Format("20060102-150405") + ext
+	filename := filepath.Join(dir, name)
+	// write to temporary file first, so partial backups are never rotated in
+	f, err := os.OpenFile(filename+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = dbobj.writeBackup(f, backupKey)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(filename + ".tmp")
+		return "", err
+	}
+	return filename, os.Rename(filename+".tmp", filename)
+}
+
+// rotateBackups removes old backup files, keeping the newest ones
+func rotateBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, f := range files {
+		name := f.Name()
+		if f.Mode().IsRegular() && strings.HasPrefix(name, backupFilePrefix) &&
+			(strings.HasSuffix(name, ".sql") || strings.HasSuffix(name, ".dbk")) {
+			names = append(names, name)
+		}
+	}
+	// file names contain timestamp, so sorting puts older files first
+	sort.Strings(names)
+	for len(names) > keep {
+		err = os.Remove(filepath.Join(dir, names[0]))
+		if err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// scheduledBackup is called by backup scheduler
+func (dbobj dbcon) scheduledBackup(dir string, backupKey []byte, keep int) {
+	filename, err := dbobj.backupToDir(dir, backupKey)
+	if err != nil {
+		log.Printf("scheduled backup failed: %s\n", err)
+		lastBackup.set("error", "")
+		return
+	}
+	log.Printf("scheduled backup saved to %s\n", filename)
+	err = rotateBackups(dir, keep)
+	if err != nil {
+		log.Printf("failed to rotate backups: %s\n", err)
+	}
+	lastBackup.set("ok", filename)
+}
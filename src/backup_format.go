@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Encrypted backup file layout:
+//   backupMagic
+//   8 bytes random nonce prefix
+//   chunks: 4 bytes length + AES-GCM sealed chunk
+// Plaintext chunk starts with chunk type: 'D' for gzip data, 'M' for the
+// signed manifest. Manifest chunk is always the last one. Nonce is the
+// random prefix followed by the chunk counter, so chunks can not be
+// reordered, dropped or appended without failing authentication.
+
+const (
+	backupMagic       = "DATABUNKER-BACKUP-1\n"
+	backupChunkSize   = 64 * 1024
+	backupChunkData   = 'D'
+	backupChunkFinal  = 'M'
+	backupMaxChunkLen = backupChunkSize + 1024
+)
+
+// backupMaxSize limits size of uploaded backup and of decompressed dump, so
+// a large request or a gzip bomb can not exhaust memory during restore
+var backupMaxSize int64 = 1024 * 1024 * 1024
+
+// setBackupMaxSize sets restore size limit in megabytes, default value is
+// used for 0
+func setBackupMaxSize(megabytes int64) error {
+	if megabytes < 0 {
+		return errors.New("max restore size can not be negative")
+	}
+	if megabytes > 0 {
+		backupMaxSize = megabytes * 1024 * 1024
+	}
+	return nil
+}
+
+type backupManifest struct {
+	Version   int              `json:"version"`
+	Created   int32            `json:"created"`
+	Tables    map[string]int64 `json:"tables"`
+	Checksum  string           `json:"checksum"`
+	Signature string           `json:"signature,omitempty"`
+}
+
+// backupKeyGet returns backup encryption key, nil if backups are not encrypted
+func backupKeyGet(cfg Config) ([]byte, error) {
+	keyStr := cfg.Backup.Key
+	if len(keyStr) == 0 {
+		return nil, nil
+	}
+	if len(keyStr) != 64 || isValidHex(keyStr) == false {
+		return nil, errors.New("backup key must be 64 hex characters")
+	}
+	return hex.DecodeString(keyStr)
+}
+
+// deriveBackupKey makes separate keys for encryption and manifest signature
+func deriveBackupKey(backupKey []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, backupKey)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (m backupManifest) sign(backupKey []byte) string {
+	m.Signature = ""
+	data, _ := json.Marshal(m)
+	mac := hmac.New(sha256.New, deriveBackupKey(backupKey, "databunker backup signature"))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func backupNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+func backupCipher(backupKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveBackupKey(backupKey, "databunker backup encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// rowCounter counts INSERT statements per table in SQL dump stream
+type rowCounter struct {
+	tables  map[string]int64
+	partial []byte
+}
+
+func newRowCounter() *rowCounter {
+	return &rowCounter{tables: make(map[string]int64)}
+}
+
+func (c *rowCounter) Write(p []byte) (int, error) {
+	data := append(c.partial, p...)
+	for {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			break
+		}
+		c.countLine(data[:idx])
+		data = data[idx+1:]
+	}
+	c.partial = append([]byte{}, data...)
+	return len(p), nil
+}
+
+func (c *rowCounter) countLine(line []byte) {
+	prefix := []byte(`INSERT INTO "`)
+	if !bytes.HasPrefix(line, prefix) {
+		return
+	}
+	name := line[len(prefix):]
+	end := bytes.IndexByte(name, '"')
+	if end > 0 {
+		c.tables[string(name[:end])]++
+	}
+}
+
+// chunkWriter encrypts data written to it in fixed size chunks
+type chunkWriter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func (c *chunkWriter) writeChunk(chunkType byte, data []byte) error {
+	plain := append([]byte{chunkType}, data...)
+	sealed := c.aead.Seal(nil, backupNonce(c.prefix, c.counter), plain, nil)
+	c.counter++
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(sealed)))
+	if _, err := c.out.Write(size); err != nil {
+		return err
+	}
+	_, err := c.out.Write(sealed)
+	return err
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for len(c.buf) >= backupChunkSize {
+		if err := c.writeChunk(backupChunkData, c.buf[:backupChunkSize]); err != nil {
+			return 0, err
+		}
+		c.buf = c.buf[backupChunkSize:]
+	}
+	return len(p), nil
+}
+
+// backupWriter produces encrypted, compressed and signed backup stream
+type backupWriter struct {
+	backupKey []byte
+	chunks    *chunkWriter
+	zip       *gzip.Writer
+	checksum  hash.Hash
+	rows      *rowCounter
+	plain     io.Writer
+}
+
+func newBackupWriter(out io.Writer, backupKey []byte) (*backupWriter, error) {
+	aead, err := backupCipher(backupKey)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if _, err := out.Write([]byte(backupMagic)); err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(prefix); err != nil {
+		return nil, err
+	}
+	bw := &backupWriter{backupKey: backupKey}
+	bw.chunks = &chunkWriter{out: out, aead: aead, prefix: prefix}
+	bw.zip = gzip.NewWriter(bw.chunks)
+	bw.checksum = sha256.New()
+	bw.rows = newRowCounter()
+	bw.plain = io.MultiWriter(bw.checksum, bw.rows, bw.zip)
+	return bw, nil
+}
+
+func (bw *backupWriter) Write(p []byte) (int, error) {
+	return bw.plain.Write(p)
+}
+
+// Close flushes compressed data and writes signed manifest as the last chunk
+func (bw *backupWriter) Close() error {
+	if err := bw.zip.Close(); err != nil {
+		return err
+	}
+	if len(bw.chunks.buf) > 0 {
+		if err := bw.chunks.writeChunk(backupChunkData, bw.chunks.buf); err != nil {
+			return err
+		}
+		bw.chunks.buf = nil
+	}
+	manifest := backupManifest{
+		Version:  1,
+		Created:  int32(time.Now().Unix()),
+		Tables:   bw.rows.tables,
+		Checksum: hex.EncodeToString(bw.checksum.Sum(nil)),
+	}
+	manifest.Signature = manifest.sign(bw.backupKey)
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return bw.chunks.writeChunk(backupChunkFinal, data)
+}
+
+func isEncryptedBackup(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(backupMagic))
+}
+
+// readBackup decrypts backup, verifies manifest and returns SQL dump
+func readBackup(data []byte, backupKey []byte) ([]byte, *backupManifest, error) {
+	if len(backupKey) == 0 {
+		return nil, nil, errors.New("backup key is required to restore encrypted backup")
+	}
+	aead, err := backupCipher(backupKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	data = data[len(backupMagic):]
+	if len(data) < 8 {
+		return nil, nil, errors.New("backup is truncated")
+	}
+	prefix := data[:8]
+	data = data[8:]
+	var zipped bytes.Buffer
+	var manifest *backupManifest
+	counter := uint32(0)
+	for len(data) > 0 {
+		if manifest != nil {
+			return nil, nil, errors.New("unexpected data after backup manifest")
+		}
+		if len(data) < 4 {
+			return nil, nil, errors.New("backup is truncated")
+		}
+		size := binary.BigEndian.Uint32(data[:4])
+		data = data[4:]
+		if size > backupMaxChunkLen || int(size) > len(data) {
+			return nil, nil, errors.New("backup is truncated")
+		}
+		plain, err := aead.Open(nil, backupNonce(prefix, counter), data[:size], nil)
+		if err != nil {
+			return nil, nil, errors.New("failed to decrypt backup, wrong backup key?")
+		}
+		counter++
+		data = data[size:]
+		if len(plain) == 0 {
+			return nil, nil, errors.New("bad backup chunk")
+		}
+		switch plain[0] {
+		case backupChunkData:
+			zipped.Write(plain[1:])
+		case backupChunkFinal:
+			manifest = &backupManifest{}
+			if err := json.Unmarshal(plain[1:], manifest); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, errors.New("bad backup chunk")
+		}
+	}
+	if manifest == nil {
+		return nil, nil, errors.New("backup manifest is missing")
+	}
+	if hmac.Equal([]byte(manifest.sign(backupKey)), []byte(manifest.Signature)) == false {
+		return nil, nil, errors.New("backup manifest signature is wrong")
+	}
+	zr, err := gzip.NewReader(&zipped)
+	if err != nil {
+		return nil, nil, err
+	}
+	dump, err := ioutil.ReadAll(io.LimitReader(zr, backupMaxSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(dump)) > backupMaxSize {
+		return nil, nil, errors.New("backup is too large, see backup max_restore_size")
+	}
+	checksum := sha256.Sum256(dump)
+	if hex.EncodeToString(checksum[:]) != manifest.Checksum {
+		return nil, nil, errors.New("backup checksum mismatch")
+	}
+	rows := newRowCounter()
+	rows.Write(dump)
+	for table, count := range manifest.Tables {
+		if rows.tables[table] != count {
+			return nil, nil, fmt.Errorf("backup row count mismatch in %s table", table)
+		}
+	}
+	if len(rows.tables) != len(manifest.Tables) {
+		return nil, nil, errors.New("backup table list mismatch")
+	}
+	return dump, manifest, nil
+}
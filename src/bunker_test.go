@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	uuid "github.com/hashicorp/go-uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 var (
@@ -85,7 +91,7 @@ func helpConfigurationDump(token string) ([]byte, error) {
 func init() {
 	fmt.Printf("**INIT*TEST*CODE***\n")
 	testDBFile := storage.CreateTestDB()
-	db, myRootToken, err := setupDB(&testDBFile)
+	db, myRootToken, err := setupDB(&testDBFile, &envKeyProvider{}, "", 0, 0)
 	if err != nil {
 		//log.Panic("error %s", err.Error())
 		fmt.Printf("error %s", err.Error())
@@ -94,19 +100,20 @@ func init() {
 	db.store.InitUserApps()
 	var cfg2 Config
 	cfile := "../databunker.yaml"
-	readFile(&cfg2, &cfile)
+	readConfFile(&cfg2, &cfile)
 	var cfg Config
-	cfg.Sms.TwilioToken = "ttoken"
+	cfg.Sms.Token = "ttoken"
 	cfg.SelfService.AppRecordChange = []string{"testapp", "super"}
 	cfg.Generic.CreateUserWithoutAccessToken = true
 	cfg.Policy.MaxAuditRetentionPeriod = "1m"
-	e := mainEnv{db, cfg, make(chan struct{})}
+	e = mainEnv{db, cfg, make(chan struct{})}
 	rootToken2, err := e.db.getRootXtoken()
 	if err != nil {
 		fmt.Printf("Failed to retrieve root token: %s\n", err)
 	}
 	fmt.Printf("Hashed root token: %s\n", rootToken2)
 	router = e.setupRouter()
+	router = e.setupConfRouter(router)
 	//test1 := &testEnv{e, rootToken, router}
 	e.dbCleanupDo()
 	fmt.Printf("**INIT*DONE***\n")
@@ -114,6 +121,11 @@ func init() {
 
 func TestBackupOK(t *testing.T) {
 	fmt.Printf("root token: %s\n", rootToken)
+	if _, err := helpBackupRequest(rootToken); err == nil {
+		t.Fatalf("backup should fail without kek\n")
+	}
+	setUserKEK(strings.Repeat("ab", 32))
+	defer setUserKEK("")
 	raw, err := helpBackupRequest(rootToken)
 	if err != nil {
 		//log.Panic("error %s", err.Error())
@@ -178,3 +190,198 @@ func TestBackupError(t *testing.T) {
 		log.Fatalf("This test should faile")
 	}
 }
+
+func TestMigrateDryRun(t *testing.T) {
+	testDBFile := "/tmp/test-sqlite.db"
+	migrations, err := storage.MigrateDB(&testDBFile, true)
+	if err != nil {
+		t.Fatalf("failed to check migrations: %s", err)
+	}
+	if len(migrations) != 0 {
+		t.Fatalf("test database should have no pending migrations: %s", migrations)
+	}
+}
+
+func helpRestoreRequest(token string, dump []byte) (map[string]interface{}, error) {
+	url := "http://localhost:3000/v1/sys/restore"
+	request := httptest.NewRequest("POST", url, bytes.NewReader(dump))
+	request.Header.Set("X-Bunker-Token", token)
+	return helpServe(request)
+}
+
+func TestRestoreOK(t *testing.T) {
+	setUserKEK(strings.Repeat("ab", 32))
+	defer setUserKEK("")
+	dump, err := helpBackupRequest(rootToken)
+	if err != nil {
+		t.Fatalf("failed to backup db %s", err.Error())
+	}
+	raw, err := helpRestoreRequest(rootToken, dump)
+	if err != nil {
+		t.Fatalf("failed to restore db: %s", err)
+	}
+	if raw["status"].(string) != "ok" {
+		t.Fatalf("failed to restore db\n")
+	}
+	_, err = helpBackupRequest(rootToken)
+	if err != nil {
+		t.Fatalf("failed to backup restored db %s", err.Error())
+	}
+}
+
+func TestRestorePlaintextWithBackupKey(t *testing.T) {
+	setUserKEK(strings.Repeat("ab", 32))
+	defer setUserKEK("")
+	dump, err := helpBackupRequest(rootToken)
+	if err != nil {
+		t.Fatalf("failed to backup db %s", err.Error())
+	}
+	backupKey := make([]byte, 32)
+	if err = e.db.restoreBackup(dump, backupKey, false); err == nil {
+		t.Fatalf("plaintext backup should be rejected when backup key is set\n")
+	}
+	if err = e.db.restoreBackup(dump, backupKey, true); err != nil {
+		t.Fatalf("failed to restore plaintext backup with opt-in: %s", err)
+	}
+}
+
+func TestRestoreBadDump(t *testing.T) {
+	raw, _ := helpRestoreRequest(rootToken, []byte("BEGIN TRANSACTION;\nDROP TABLE users;\nCOMMIT;\n"))
+	if raw["status"].(string) == "ok" {
+		t.Fatalf("restore should fail\n")
+	}
+	token, _ := uuid.GenerateUUID()
+	_, err := helpRestoreRequest(token, []byte("BEGIN TRANSACTION;\nCOMMIT;\n"))
+	if err == nil {
+		t.Fatalf("restore should fail with bad token\n")
+	}
+}
+
+func TestEncryptedBackupFormat(t *testing.T) {
+	backupKey := make([]byte, 32)
+	dump := []byte("BEGIN TRANSACTION;\nCREATE TABLE users (token STRING);\nINSERT INTO \"users\" VALUES('t1');\nCOMMIT;\n")
+	var buf bytes.Buffer
+	bw, err := newBackupWriter(&buf, backupKey)
+	if err != nil {
+		t.Fatalf("failed to create backup writer: %s", err)
+	}
+	bw.Write(dump)
+	bw.Close()
+	data := buf.Bytes()
+	if isEncryptedBackup(data) == false || bytes.Contains(data, []byte("INSERT INTO")) {
+		t.Fatalf("backup is not encrypted\n")
+	}
+	result, manifest, err := readBackup(data, backupKey)
+	if err != nil {
+		t.Fatalf("failed to read backup: %s", err)
+	}
+	if bytes.Equal(result, dump) == false || manifest.Tables["users"] != 1 {
+		t.Fatalf("backup content mismatch\n")
+	}
+	otherKey := make([]byte, 32)
+	otherKey[0] = 1
+	if _, _, err = readBackup(data, otherKey); err == nil {
+		t.Fatalf("backup should not open with wrong key\n")
+	}
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-5] ^= 1
+	if _, _, err = readBackup(tampered, backupKey); err == nil {
+		t.Fatalf("tampered backup should fail\n")
+	}
+	if _, _, err = readBackup(data[:len(data)-10], backupKey); err == nil {
+		t.Fatalf("truncated backup should fail\n")
+	}
+}
+
+func TestBackupSizeLimit(t *testing.T) {
+	backupKey := make([]byte, 32)
+	dump := []byte("BEGIN TRANSACTION;\nCREATE TABLE users (token STRING);\n" +
+		strings.Repeat("INSERT INTO \"users\" VALUES('t1');\n", 100) + "COMMIT;\n")
+	var buf bytes.Buffer
+	bw, _ := newBackupWriter(&buf, backupKey)
+	bw.Write(dump)
+	bw.Close()
+	defer func(size int64) { backupMaxSize = size }(backupMaxSize)
+	backupMaxSize = int64(len(dump) - 1)
+	if _, _, err := readBackup(buf.Bytes(), backupKey); err == nil {
+		t.Fatalf("decompressed backup over the limit should fail\n")
+	}
+	backupMaxSize = 16
+	raw, _ := helpRestoreRequest(rootToken, dump)
+	if raw["status"].(string) == "ok" {
+		t.Fatalf("restore over the limit should fail\n")
+	}
+}
+
+func TestScheduledBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "databunker-backup")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	old := []string{"databunker-backup-20200101-000000.sql", "databunker-backup-20200102-000000.dbk", "other.sql"}
+	for _, name := range old {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("old"), 0600)
+	}
+	setUserKEK(strings.Repeat("ab", 32))
+	defer setUserKEK("")
+	e.db.scheduledBackup(dir, nil, 2)
+	files, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if len(names) != 3 || names[0] != old[1] || names[1] == old[0] || names[2] != "other.sql" {
+		t.Fatalf("wrong backup files after rotation: %v\n", names)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, names[1]))
+	if strings.Contains(string(data), "CREATE TABLE") == false {
+		t.Fatalf("scheduled backup is empty\n")
+	}
+	request := httptest.NewRequest("GET", "http://localhost:3000/v1/status", nil)
+	raw, err := helpServe(request)
+	if err != nil {
+		t.Fatalf("failed to get status: %s", err)
+	}
+	backup, ok := raw["backup"].(map[string]interface{})
+	if _, found := backup["file"]; !ok || backup["status"].(string) != "ok" || found {
+		t.Fatalf("wrong backup status: %v\n", raw)
+	}
+	request = httptest.NewRequest("GET", "http://localhost:3000/v1/sys/backup/status", nil)
+	request.Header.Set("X-Bunker-Token", rootToken)
+	raw, err = helpServe(request)
+	if err != nil {
+		t.Fatalf("failed to get backup status: %s", err)
+	}
+	backup, ok = raw["backup"].(map[string]interface{})
+	if !ok || backup["file"].(string) != filepath.Join(dir, names[1]) {
+		t.Fatalf("wrong backup file in admin status: %v\n", raw)
+	}
+	metrics, _ := helpMetricsRequest(rootToken)
+	if strings.Contains(string(metrics), "databunker_backup_last_success 1") == false {
+		t.Fatalf("backup metrics are missing\n")
+	}
+}
+
+func TestWithTxRollback(t *testing.T) {
+	rtoken, _ := uuid.GenerateUUID()
+	err := e.db.withTx(func(dbTx dbcon) error {
+		bdoc := bson.M{"rtoken": rtoken, "status": "open"}
+		_, err := dbTx.store.CreateRecord(storage.TblName.Requests, &bdoc)
+		if err != nil {
+			return err
+		}
+		record, _ := dbTx.store.GetRecord(storage.TblName.Requests, "rtoken", rtoken)
+		if record == nil {
+			t.Fatalf("record is not visible inside transaction\n")
+		}
+		return errors.New("abort")
+	})
+	if err == nil || err.Error() != "abort" {
+		t.Fatalf("transaction error is lost: %v\n", err)
+	}
+	record, _ := e.db.store.GetRecord(storage.TblName.Requests, "rtoken", rtoken)
+	if record != nil {
+		t.Fatalf("record was not rolled back\n")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// default interval of the cleanup job in seconds
+const cleanupInterval = 10 * 60
+
+var (
+	cleanupDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "databunker_cleanup_deleted_records_total",
+		Help: "Number of expired records deleted by the cleanup job.",
+	}, []string{"table"})
+	cleanupLastTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "databunker_cleanup_last_time",
+		Help: "Unix time of the last cleanup job run.",
+	})
+	cleanupLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "databunker_cleanup_last_success",
+		Help: "1 if the last cleanup job run succeeded, 0 otherwise.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cleanupDeleted, cleanupLastTime, cleanupLastSuccess)
+}
+
+// closed requests are deleted after max_request_retention_period
+var closedRequestStatuses = []string{"approved", "canceled"}
+
+// cleanupExpiredRecords deletes records that are expired or older than
+// allowed by the retention policy. It returns number of deleted records per table.
+func (dbobj dbcon) cleanupExpiredRecords(conf Config) (erasureReport, error) {
+	report := make(erasureReport)
+	var num int64
+	var err error
+	retention := func(period string) int32 {
+		exp, _ := parseExpiration0(period)
+		return exp
+	}
+	expiring := map[string]storage.Tbl{
+		"sessions":      storage.TblName.Sessions,
+		"sharedrecords": storage.TblName.Sharedrecords,
+		"xtokens":       storage.TblName.Xtokens,
+	}
+	for table, tbl := range expiring {
+		num, err = dbobj.store.DeleteExpiredAll(tbl)
+		if err = report.add(table, num, err); err != nil {
+			return report, err
+		}
+	}
+	if exp := retention(conf.Policy.MaxSessionRetentionPeriod); exp > 0 {
+		num, err = dbobj.store.DeleteOlder(storage.TblName.Sessions, exp, "", "")
+		if err = report.add("sessions", num, err); err != nil {
+			return report, err
+		}
+	}
+	if exp := retention(conf.Policy.MaxShareableRecordRetentionPeriod); exp > 0 {
+		num, err = dbobj.store.DeleteOlder(storage.TblName.Sharedrecords, exp, "", "")
+		if err = report.add("sharedrecords", num, err); err != nil {
+			return report, err
+		}
+	}
+	if exp := retention(conf.Policy.MaxRequestRetentionPeriod); exp > 0 {
+		for _, status := range closedRequestStatuses {
+			num, err = dbobj.store.DeleteOlder(storage.TblName.Requests, exp, "status", status)
+			if err = report.add("requests", num, err); err != nil {
+				return report, err
+			}
+		}
+	}
+	// sqlite database is vacuumed after audit cleanup, so it goes last
+	if exp := retention(conf.Policy.MaxAuditRetentionPeriod); exp > 0 {
+		num, err = dbobj.store.DeleteExpired0(storage.TblName.Audit, exp)
+		if err = report.add("audit", num, err); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// runCleanup runs retention cleanup and agreement expiry and updates cleanup metrics
+func (dbobj dbcon) runCleanup(conf Config) {
+	report, err := dbobj.cleanupExpiredRecords(conf)
+	for table, num := range report {
+		cleanupDeleted.WithLabelValues(table).Add(float64(num))
+	}
+	cleanupLastTime.Set(float64(time.Now().Unix()))
+	if err != nil {
+		log.Printf("db cleanup failed: %s\n", err)
+		cleanupLastSuccess.Set(0)
+	} else {
+		cleanupLastSuccess.Set(1)
+	}
+	dbobj.expireAgreementRecords(conf.Notification.NotificationURL)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRetentionCleanup(t *testing.T) {
+	now := int32(time.Now().Unix())
+	old := now - 100*24*3600
+	records := map[storage.Tbl]bson.M{
+		storage.TblName.Sessions:      {"token": "cleanup", "session": "expired-session", "endtime": now - 10, "when": now - 100},
+		storage.TblName.Sharedrecords: {"token": "cleanup", "record": "old-record", "endtime": now + 3600, "when": old},
+		storage.TblName.Xtokens:       {"token": "cleanup", "xtoken": "expired-xtoken", "type": "login", "endtime": now - 10},
+		storage.TblName.Requests:      {"token": "cleanup", "rtoken": "closed-request", "status": "approved", "when": old},
+	}
+	for tbl, bdoc := range records {
+		_, err := e.db.store.CreateRecord(tbl, &bdoc)
+		if err != nil {
+			t.Fatalf("failed to create record: %s", err)
+		}
+	}
+	bdoc := bson.M{"token": "cleanup", "rtoken": "open-request", "status": "open", "when": old}
+	e.db.store.CreateRecord(storage.TblName.Requests, &bdoc)
+	conf := e.conf
+	conf.Policy.MaxShareableRecordRetentionPeriod = "3m"
+	conf.Policy.MaxRequestRetentionPeriod = "3m"
+	report, err := e.db.cleanupExpiredRecords(conf)
+	if err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+	for _, table := range []string{"sessions", "sharedrecords", "xtokens", "requests"} {
+		if report[table] < 1 {
+			t.Fatalf("expired records are not deleted from %s: %v", table, report)
+		}
+	}
+	for tbl := range records {
+		count, _ := e.db.store.CountRecords(tbl, "token", "cleanup")
+		if tbl == storage.TblName.Requests && count != 1 {
+			t.Fatalf("open request should be kept")
+		} else if tbl != storage.TblName.Requests && count != 0 {
+			t.Fatalf("expired records are left after cleanup")
+		}
+	}
+	e.db.runCleanup(conf)
+	raw, _ := helpMetricsRequest(rootToken)
+	if strings.Contains(string(raw), `databunker_cleanup_deleted_records_total{table="sessions"}`) == false {
+		t.Fatalf("cleanup metrics are missing")
+	}
+}
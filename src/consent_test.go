@@ -3,9 +3,12 @@ package main
 import (
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	uuid "github.com/hashicorp/go-uuid"
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func helpAcceptConsent(mode string, address string, brief string, dataJSON string) (map[string]interface{}, error) {
@@ -284,3 +287,47 @@ func TestGetAllUserConsentsFake(t *testing.T) {
 		t.Fatalf("Should fail to get all user consents")
 	}
 }
+
+func TestAgreementWhoEncryption(t *testing.T) {
+	_, err := e.db.acceptAgreement("", "email", "who@consent.com", "whobrief", "yes", "", "", "", 0, 0)
+	if err != nil {
+		t.Fatalf("failed to accept agreement: %s", err)
+	}
+	count, _ := e.db.store.CountRecords(storage.TblName.Agreements, "who", "who@consent.com")
+	if count != 0 {
+		t.Fatalf("agreement address is saved in plaintext\n")
+	}
+	// agreement saved by the previous version
+	bdoc := bson.M{"who": "who@consent.com", "token": "", "brief": "whobrief2", "mode": "email", "status": "yes"}
+	e.db.store.CreateRecord(storage.TblName.Agreements, &bdoc)
+	defer atomic.StoreInt32(&agreementLegacyRows, 1)
+	err = e.db.migrateAgreementWho(nil)
+	if err != nil {
+		t.Fatalf("failed to migrate agreements: %s", err)
+	}
+	count, _ = e.db.store.CountRecords(storage.TblName.Agreements, "who", "who@consent.com")
+	if count != 0 || atomic.LoadInt32(&agreementLegacyRows) != 0 {
+		t.Fatalf("agreement address is not encrypted by migration\n")
+	}
+	request := httptest.NewRequest("GET", "http://localhost:3000/v1/agreement/email/who@consent.com", nil)
+	request.Header.Set("X-Bunker-Token", rootToken)
+	raw, _ := helpServe(request)
+	if raw["status"].(string) != "ok" || raw["total"].(float64) != 2 {
+		t.Fatalf("failed to get agreements by address: %v", raw)
+	}
+	for _, record := range raw["rows"].([]interface{}) {
+		if record.(map[string]interface{})["who"].(string) != "who@consent.com" {
+			t.Fatalf("agreement address is not decrypted: %v", record)
+		}
+	}
+	raw, err = helpCreateUser(`{"login":"whouser","email":"who@consent.com"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	_, count2, _ := e.db.listAgreementRecords(userTOKEN)
+	if count2 != 2 {
+		t.Fatalf("agreements are not linked to the new user\n")
+	}
+	helpDeleteUser("token", userTOKEN)
+}
@@ -1,18 +1,89 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
-	"log"
+	"errors"
 	"io"
+	"log"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
-// shamir secret split
-// https://github.com/hashicorp/vault/tree/master/shamir
-// https://github.com/kinvolk/go-shamir
-// go get github.com/hashicorp/vault/shamir
+// Versioned ciphertext layout:
+//   2 bytes magic, 1 byte version, 1 byte algorithm, 4 bytes master key id
+//   nonce
+//   sealed data
+// Header is authenticated as additional data. Record key is derived with
+// HKDF-SHA256 from master key and per-record key. Ciphertext without header
+// is the legacy format: AES-GCM with master key + record key, nonce at the end.
+
+const (
+	cipherVersion      = 1
+	cipherHeaderLen    = 8
+	cipherAESGCM       = 1
+	cipherXChaCha20    = 2
+	cipherLegacyAESGCM = 0
+)
+
+var cipherMagic = []byte{0xdb, 0x5e}
+
+// recordCipher is an algorithm used for new records, see encryption.cipher configuration
+var recordCipher byte = cipherAESGCM
+
+// setRecordCipher selects algorithm for new records: aes-gcm or xchacha20-poly1305
+func setRecordCipher(name string) error {
+	switch name {
+	case "", "aes-gcm":
+		recordCipher = cipherAESGCM
+	case "xchacha20-poly1305":
+		recordCipher = cipherXChaCha20
+	default:
+		return errors.New("unknown cipher: " + name)
+	}
+	return nil
+}
+
+// masterKeyID returns short master key identifier stored in ciphertext header
+func masterKeyID(masterKey []byte) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("databunker key id"))
+	return mac.Sum(nil)[:4]
+}
+
+// ciphertextInfo returns algorithm and master key id of encrypted data.
+// Legacy ciphertext has cipherLegacyAESGCM algorithm and nil key id.
+func ciphertextInfo(data []byte) (byte, []byte) {
+	if len(data) > cipherHeaderLen && bytes.Equal(data[0:2], cipherMagic) && data[2] == cipherVersion {
+		return data[3], data[4:cipherHeaderLen]
+	}
+	return cipherLegacyAESGCM, nil
+}
+
+func newRecordAEAD(alg byte, masterKey []byte, userKey []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, masterKey, userKey, []byte("databunker record key"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	switch alg {
+	case cipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case cipherXChaCha20:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, errors.New("unknown cipher algorithm")
+}
 
 func generateRecordKey() ([]byte, error) {
 	key := make([]byte, 8)
@@ -30,11 +101,38 @@ func generateMasterKey() ([]byte, error) {
 }
 
 func decrypt(masterKey []byte, userKey []byte, data []byte) ([]byte, error) {
+	if alg, keyID := ciphertextInfo(data); keyID != nil {
+		plaintext, err := decryptVersioned(alg, masterKey, userKey, data)
+		if err == nil {
+			return plaintext, nil
+		}
+		// very unlikely, legacy ciphertext can start with the same bytes
+	}
+	return decryptLegacy(masterKey, userKey, data)
+}
+
+func decryptVersioned(alg byte, masterKey []byte, userKey []byte, data []byte) ([]byte, error) {
+	aead, err := newRecordAEAD(alg, masterKey, userKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < cipherHeaderLen+aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	header := data[:cipherHeaderLen]
+	nonce := data[cipherHeaderLen : cipherHeaderLen+aead.NonceSize()]
+	return aead.Open(nil, nonce, data[cipherHeaderLen+aead.NonceSize():], header)
+}
+
+func decryptLegacy(masterKey []byte, userKey []byte, data []byte) ([]byte, error) {
 	// Load your secret key from a safe place and reuse it across multiple
 	// Seal/Open calls. (Obviously don't use this example key for anything
 	// real.) If you want to convert a passphrase to a key, use a suitable
 	// package like bcrypt or scrypt.
 	// When decoded the key should be 16 bytes (AES-128) or 32 (AES-256).
+	if len(data) <= 12 {
+		return nil, errors.New("ciphertext is too short")
+	}
 	key := append(masterKey, userKey...)
 
 	block, err := aes.NewCipher(key)
@@ -53,31 +151,68 @@ func decrypt(masterKey []byte, userKey []byte, data []byte) ([]byte, error) {
 }
 
 func encrypt(masterKey []byte, userKey []byte, plaintext []byte) ([]byte, error) {
-	// We use 32 byte key (AES-256).
-	// comprising 24 master key
-	// and 8 bytes record key
-	key := append(masterKey, userKey...)
-	block, err := aes.NewCipher(key)
+	// new records always use the versioned format,
+	// legacy records are upgraded when they are written next time
+	aead, err := newRecordAEAD(recordCipher, masterKey, userKey)
 	if err != nil {
 		return nil, err
 	}
-	// Never use more than 2^32 random nonces with a given key because of the risk of a repeat.
-	nonce := make([]byte, 12)
+	header := append([]byte{}, cipherMagic...)
+	header = append(header, cipherVersion, recordCipher)
+	header = append(header, masterKeyID(masterKey)...)
+	nonce := make([]byte, aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-	ciphertext := aesgcm.Seal(nil, nonce, plaintext, nil)
-	//fmt.Printf("%x\n", ciphertext)
-	// apppend random nonce bvalue to the end
-	ciphertext = append(ciphertext, nonce...)
+	ciphertext := append(header, nonce...)
+	ciphertext = aead.Seal(ciphertext, nonce, plaintext, header)
 	return ciphertext, nil
 }
 
+// basicStringKey derives AES-SIV key used to encrypt audit fields
+func basicStringKey(masterKey []byte, code []byte) ([]byte, error) {
+	key := make([]byte, 64)
+	kdf := hkdf.New(sha256.New, masterKey, code, []byte("databunker audit field"))
+	_, err := io.ReadFull(kdf, key)
+	return key, err
+}
+
+// basicStringEncrypt encrypts audit fields. Encryption is deterministic,
+// equal values give equal result, so encrypted value can be searched.
 func basicStringEncrypt(plaintext string, masterKey []byte, code []byte) (string, error) {
+	key, err := basicStringKey(masterKey, code)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sivEncrypt(key, []byte(plaintext))
+	if err != nil {
+		log.Printf("error in sivEncrypt: %s", err)
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// basicStringDecrypt decrypts audit fields, values not migrated from
+// the fixed nonce AES-GCM format are still accepted
+func basicStringDecrypt(data string, masterKey []byte, code []byte) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	key, err := basicStringKey(masterKey, code)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := sivDecrypt(key, ciphertext)
+	if err != nil {
+		return legacyStringDecrypt(data, masterKey, code)
+	}
+	return string(plaintext), nil
+}
+
+// legacyStringEncrypt is an old audit field encryption with fixed nonce.
+// It is kept to find and migrate old audit records.
+func legacyStringEncrypt(plaintext string, masterKey []byte, code []byte) (string, error) {
     //log.Printf("Going to encrypt %s", plaintext)
     nonce := []byte("$DataBunker$")
     key := append(masterKey, code...)
@@ -97,7 +232,7 @@ func basicStringEncrypt(plaintext string, masterKey []byte, code []byte) (string
     return result, nil
 }
 
-func basicStringDecrypt(data string, masterKey []byte, code []byte) (string, error) {
+func legacyStringDecrypt(data string, masterKey []byte, code []byte) (string, error) {
     ciphertext, err := base64.StdEncoding.DecodeString(data)
     if err != nil {
       return "", err
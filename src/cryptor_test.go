@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// helpLegacyEncrypt creates ciphertext in the format used before versioning
+func helpLegacyEncrypt(masterKey []byte, userKey []byte, plaintext []byte) []byte {
+	key := append(append([]byte{}, masterKey...), userKey...)
+	block, _ := aes.NewCipher(key)
+	aesgcm, _ := cipher.NewGCM(block)
+	nonce := []byte("legacy-nonce")
+	return append(aesgcm.Seal(nil, nonce, plaintext, nil), nonce...)
+}
+
+func TestVersionedCiphertext(t *testing.T) {
+	masterKey, _ := generateMasterKey()
+	recordKey, _ := generateRecordKey()
+	plaintext := []byte(`{"name":"alex"}`)
+	defer setRecordCipher("")
+	for _, name := range []string{"aes-gcm", "xchacha20-poly1305"} {
+		setRecordCipher(name)
+		encoded, err := encrypt(masterKey, recordKey, plaintext)
+		if err != nil {
+			t.Fatalf("failed to encrypt with %s: %s", name, err)
+		}
+		alg, keyID := ciphertextInfo(encoded)
+		if alg != recordCipher || bytes.Equal(keyID, masterKeyID(masterKey)) == false {
+			t.Fatalf("wrong ciphertext header for %s\n", name)
+		}
+		decrypted, err := decrypt(masterKey, recordKey, encoded)
+		if err != nil || bytes.Equal(decrypted, plaintext) == false {
+			t.Fatalf("failed to decrypt %s: %s", name, err)
+		}
+		otherKey, _ := generateMasterKey()
+		if _, err = decrypt(otherKey, recordKey, encoded); err == nil {
+			t.Fatalf("decrypted %s with wrong master key\n", name)
+		}
+		encoded[3] = cipherAESGCM + cipherXChaCha20 - encoded[3]
+		if _, err = decrypt(masterKey, recordKey, encoded); err == nil {
+			t.Fatalf("header change is not detected for %s\n", name)
+		}
+	}
+	legacy := helpLegacyEncrypt(masterKey, recordKey, plaintext)
+	if alg, keyID := ciphertextInfo(legacy); alg != cipherLegacyAESGCM || keyID != nil {
+		t.Fatalf("legacy ciphertext is detected as versioned\n")
+	}
+	decrypted, err := decrypt(masterKey, recordKey, legacy)
+	if err != nil || bytes.Equal(decrypted, plaintext) == false {
+		t.Fatalf("failed to decrypt legacy record: %s", err)
+	}
+	if err = setRecordCipher("des"); err == nil {
+		t.Fatalf("unknown cipher is accepted\n")
+	}
+}
+
+func TestAESSIV(t *testing.T) {
+	// RFC 5297, A.1. Deterministic Authenticated Encryption Example
+	key, _ := hex.DecodeString("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ad, _ := hex.DecodeString("101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext, _ := hex.DecodeString("112233445566778899aabbccddee")
+	expected := "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c"
+	result, err := sivEncrypt(key, plaintext, ad)
+	if err != nil || hex.EncodeToString(result) != expected {
+		t.Fatalf("wrong AES-SIV result: %x", result)
+	}
+	decrypted, err := sivDecrypt(key, result, ad)
+	if err != nil || bytes.Equal(decrypted, plaintext) == false {
+		t.Fatalf("failed to decrypt AES-SIV: %s", err)
+	}
+	result[20] ^= 1
+	if _, err = sivDecrypt(key, result, ad); err == nil {
+		t.Fatalf("changed AES-SIV ciphertext is not detected\n")
+	}
+}
+
+func TestAuditEncryptionMigration(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"audituser","name":"audit"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	// audit record in the fixed nonce format
+	atoken, _ := uuid.GenerateUUID()
+	bdoc := bson.M{"atoken": atoken, "when": int32(time.Now().Unix()) - 10, "title": "legacy event", "status": "ok"}
+	bdoc["record"], _ = legacyStringEncrypt(userTOKEN, e.db.masterKey, e.db.GetCode())
+	bdoc["who"], _ = legacyStringEncrypt("audit@user.com", e.db.masterKey, e.db.GetCode())
+	e.db.store.CreateRecord(storage.TblName.Audit, &bdoc)
+	events, count, err := e.db.getAuditEvents(userTOKEN, 0, 10)
+	if err != nil || count != 2 || strings.Contains(string(events), "legacy event") == false {
+		t.Fatalf("legacy audit event is not found: %s", events)
+	}
+	atomic.StoreInt32(&auditLegacyRows, 1)
+	err = e.db.migrateAuditEncryption(nil)
+	if err != nil || atomic.LoadInt32(&auditLegacyRows) != 0 {
+		t.Fatalf("failed to migrate audit: %s", err)
+	}
+	defer atomic.StoreInt32(&auditLegacyRows, 1)
+	record, _ := e.db.store.GetRecord(storage.TblName.Audit, "atoken", atoken)
+	expected, _ := basicStringEncrypt(userTOKEN, e.db.masterKey, e.db.GetCode())
+	if record["record"].(string) != expected {
+		t.Fatalf("audit record is not re-encrypted\n")
+	}
+	events, count, err = e.db.getAuditEvents(userTOKEN, 1, 10)
+	if err != nil || count != 2 || strings.Contains(string(events), "audit@user.com") == false {
+		t.Fatalf("migrated audit event is not found: %s", events)
+	}
+}
+
+func TestAuditPagingMixedEncryption(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"auditpageuser","name":"audit page"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	defer atomic.StoreInt32(&auditLegacyRows, atomic.LoadInt32(&auditLegacyRows))
+	atomic.StoreInt32(&auditLegacyRows, 1)
+	now := int32(time.Now().Unix())
+	// legacy and AES-SIV events are interleaved by time
+	for i := int32(1); i <= 4; i++ {
+		atoken, _ := uuid.GenerateUUID()
+		bdoc := bson.M{"atoken": atoken, "when": now - 10*i, "title": fmt.Sprintf("event %d", i), "status": "ok"}
+		if i%2 == 0 {
+			bdoc["record"], _ = legacyStringEncrypt(userTOKEN, e.db.masterKey, e.db.GetCode())
+		} else {
+			bdoc["record"], _ = basicStringEncrypt(userTOKEN, e.db.masterKey, e.db.GetCode())
+		}
+		e.db.store.CreateRecord(storage.TblName.Audit, &bdoc)
+	}
+	var whens []int64
+	for offset := int32(0); offset < 5; offset += 2 {
+		events, count, err := e.db.getAuditEvents(userTOKEN, offset, 2)
+		if err != nil || count != 5 {
+			t.Fatalf("failed to get audit page: %s", err)
+		}
+		var page []map[string]interface{}
+		json.Unmarshal(events, &page)
+		for _, event := range page {
+			whens = append(whens, int64(event["when"].(float64)))
+		}
+	}
+	if len(whens) != 5 {
+		t.Fatalf("wrong number of events in pages: %v", whens)
+	}
+	for i := 1; i < len(whens); i++ {
+		if whens[i] >= whens[i-1] {
+			t.Fatalf("audit pages are not ordered by time: %v", whens)
+		}
+	}
+}
@@ -31,12 +31,20 @@ func sendCodeByEmail(code int32, address string, cfg Config) {
 		}
 		return
 	*/
+	sendEmail(address, "Access Code", "Access code is "+strconv.Itoa(int((code))), cfg)
+}
+
+// sendLinkByEmail sends magic login link, link is valid for one login only
+func sendLinkByEmail(link string, address string, cfg Config) {
+	sendEmail(address, "Login Link", "Follow the link to log in: "+link+
+		"\nThe link can be used only once.", cfg)
+}
+
+func sendEmail(address string, subject string, bodyMessage string, cfg Config) {
 	Dest := []string{address}
-	Subject := "Access Code"
-	bodyMessage := "Access code is " + strconv.Itoa(int((code)))
 	msg := "From: " + cfg.SMTP.Sender + "\n" +
 		"To: " + strings.Join(Dest, ",") + "\n" +
-		"Subject: " + Subject + "\n" + bodyMessage
+		"Subject: " + subject + "\n" + bodyMessage
 
 	auth := smtp.PlainAuth("", cfg.SMTP.User, cfg.SMTP.Pass, cfg.SMTP.Server)
 	err := smtp.SendMail(cfg.SMTP.Server+":"+cfg.SMTP.Port,
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+)
+
+// exportPart describes one part of the user data export in the manifest
+type exportPart struct {
+	Name        string `json:"name"`
+	File        string `json:"file"`
+	Format      string `json:"format"`
+	Count       int    `json:"count"`
+	Description string `json:"description"`
+	data        []byte
+}
+
+// exportManifest lists all parts of the user data export
+type exportManifest struct {
+	Version int          `json:"version"`
+	Token   string       `json:"token"`
+	Created int32        `json:"created"`
+	Parts   []exportPart `json:"parts"`
+}
+
+// exportUserData collects everything stored about the user: profile,
+// app records, agreements, sessions, shared record grants and audit trail
+func (dbobj dbcon) exportUserData(userTOKEN string) (*exportManifest, error) {
+	manifest := &exportManifest{Version: 1, Token: userTOKEN, Created: int32(time.Now().Unix())}
+	addPart := func(name string, description string, count int, data []byte) {
+		part := exportPart{Name: name, File: name + ".json", Format: "application/json",
+			Count: count, Description: description, data: data}
+		manifest.Parts = append(manifest.Parts, part)
+	}
+	profile, err := dbobj.getUser(userTOKEN)
+	if err != nil {
+		return nil, err
+	}
+	addPart("profile", "user profile", 1, profile)
+
+	appsJSON, err := dbobj.listUserApps(userTOKEN)
+	if err != nil {
+		return nil, err
+	}
+	var apps []string
+	json.Unmarshal(appsJSON, &apps)
+	appRecords := make(map[string]json.RawMessage)
+	for _, appName := range apps {
+		record, err := dbobj.getUserApp(userTOKEN, appName)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			appRecords[appName] = record
+		}
+	}
+	data, _ := json.Marshal(appRecords)
+	addPart("apps", "app records by app name", len(appRecords), data)
+
+	data, count, err := dbobj.listAgreementRecords(userTOKEN)
+	if err != nil {
+		return nil, err
+	}
+	addPart("agreements", "accepted and withdrawn agreements", count, data)
+
+	sessions, _, err := dbobj.getUserSessionsByToken(userTOKEN, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	addPart("sessions", "user sessions", len(sessions), []byte("["+strings.Join(sessions, ",")+"]"))
+
+	records, err := dbobj.store.GetList(storage.TblName.Sharedrecords, "token", userTOKEN, 0, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	if records == nil {
+		data = []byte("[]")
+	} else {
+		data, _ = json.Marshal(records)
+	}
+	addPart("sharedrecords", "shared record grants", len(records), data)
+
+	data, total, err := dbobj.getAuditEvents(userTOKEN, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	addPart("audit", "audit trail of the user record", int(total), data)
+	return manifest, nil
+}
+
+// exportJSON returns export as one JSON document with manifest and all parts
+func (manifest *exportManifest) exportJSON() ([]byte, error) {
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"manifest":`)
+	buf.Write(manifestJSON)
+	for _, part := range manifest.Parts {
+		buf.WriteString(`,"` + part.Name + `":`)
+		buf.Write(part.data)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+// exportZip returns export as ZIP archive with manifest.json and a file per part
+func (manifest *exportManifest) exportZip() ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	files := []exportPart{{File: "manifest.json", data: manifestJSON}}
+	for _, part := range append(files, manifest.Parts...) {
+		f, err := archive.Create(part.File)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Write(part.data); err != nil {
+			return nil, err
+		}
+	}
+	err = archive.Close()
+	return buf.Bytes(), err
+}
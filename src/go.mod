@@ -11,6 +11,7 @@ require (
 	github.com/hashicorp/go-uuid v1.0.2
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/lib/pq v1.7.0 // indirect
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible // indirect
 	github.com/paranoidguy/databunker/src/storage v0.0.0
 	github.com/paranoidguy/jsonschema v0.2.1-0.20200613191419-2e32bc4eae60
@@ -21,6 +22,7 @@ require (
 	github.com/ttacon/builder v0.0.0-20170518171403-c099f663e1c2 // indirect
 	github.com/ttacon/libphonenumber v1.1.0
 	go.mongodb.org/mongo-driver v1.3.0
-	golang.org/x/sys v0.0.0-20200219091948-cb0a6d8edb6c
+	golang.org/x/crypto v0.10.0
+	golang.org/x/sys v0.9.0
 	gopkg.in/yaml.v2 v2.2.8
 )
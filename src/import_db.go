@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// number of users created in one transaction during import
+const importBatch = 100
+
+// errImportDryRun rolls back import in dry-run mode
+var errImportDryRun = errors.New("dry run")
+
+// importResult is a status of a single line of the import file
+type importResult struct {
+	Line    int    `json:"line"`
+	Status  string `json:"status"`
+	Token   string `json:"token,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// importRecord is a user record read from import file
+type importRecord struct {
+	line   int
+	record map[string]interface{}
+	err    error
+}
+
+// importReader returns function that reads the next user record from
+// jsonl (one JSON object per line) or csv (first line is a header) input.
+// It returns nil at the end of input.
+func importReader(r io.Reader, format string) (func() (*importRecord, error), error) {
+	switch format {
+	case "jsonl":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+		line := 0
+		return func() (*importRecord, error) {
+			for scanner.Scan() {
+				line++
+				text := strings.TrimSpace(scanner.Text())
+				if len(text) == 0 {
+					continue
+				}
+				result := &importRecord{line: line}
+				result.err = json.Unmarshal([]byte(text), &result.record)
+				return result, nil
+			}
+			return nil, scanner.Err()
+		}, nil
+	case "csv":
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv header: %s", err)
+		}
+		for i := range header {
+			header[i] = strings.TrimSpace(header[i])
+		}
+		line := 1
+		return func() (*importRecord, error) {
+			values, err := reader.Read()
+			if err == io.EOF {
+				return nil, nil
+			}
+			line++
+			result := &importRecord{line: line, record: make(map[string]interface{})}
+			if err != nil {
+				if _, ok := err.(*csv.ParseError); ok == false {
+					return nil, err
+				}
+				result.err = err
+				return result, nil
+			}
+			if len(values) > len(header) {
+				result.err = errors.New("too many values")
+				return result, nil
+			}
+			for i, value := range values {
+				// empty values are not saved, so they do not create empty indexes
+				if len(value) > 0 {
+					result.record[header[i]] = value
+				}
+			}
+			return result, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown import format: %s", format)
+}
+
+// importUsers creates users from jsonl or csv input. Users are created in
+// batches, each batch in one transaction. Lines with bad data or duplicate
+// login, email, phone or search field values are reported and skipped.
+// In dry-run mode all batches are checked in a single transaction that is
+// rolled back, so duplicates between batches are reported as in real import.
+func (dbobj dbcon) importUsers(r io.Reader, format string, defaultCountry string, dryRun bool) ([]importResult, error) {
+	next, err := importReader(r, format)
+	if err != nil {
+		return nil, err
+	}
+	var results []importResult
+	if dryRun {
+		err = dbobj.withTx(func(dbTx dbcon) error {
+			for {
+				batch, err := readImportBatch(next)
+				if err != nil {
+					return err
+				}
+				if len(batch) == 0 {
+					return errImportDryRun
+				}
+				batchResults, _, err := dbTx.importBatchDo(batch, defaultCountry)
+				if err != nil {
+					return err
+				}
+				results = append(results, batchResults...)
+			}
+		})
+		if err != errImportDryRun {
+			return results, err
+		}
+		return results, nil
+	}
+	for {
+		batch, err := readImportBatch(next)
+		if err != nil {
+			return results, err
+		}
+		if len(batch) == 0 {
+			return results, nil
+		}
+		var batchResults []importResult
+		var created []userJSON
+		err = dbobj.withTx(func(dbTx dbcon) error {
+			var err error
+			batchResults, created, err = dbTx.importBatchDo(batch, defaultCountry)
+			return err
+		})
+		if err != nil {
+			return results, err
+		}
+		i := 0
+		for _, result := range batchResults {
+			if result.Status == "ok" {
+				dbobj.linkNewUserAgreements(result.Token, created[i])
+				i++
+			}
+		}
+		results = append(results, batchResults...)
+	}
+}
+
+// readImportBatch reads up to importBatch records, empty batch is returned
+// at the end of input
+func readImportBatch(next func() (*importRecord, error)) ([]*importRecord, error) {
+	var batch []*importRecord
+	for len(batch) < importBatch {
+		record, err := next()
+		if err != nil || record == nil {
+			return batch, err
+		}
+		batch = append(batch, record)
+	}
+	return batch, nil
+}
+
+// importBatchDo creates users of the batch, it is called inside transaction.
+// Returns results of all lines and parsed data of created users.
+func (dbobj dbcon) importBatchDo(batch []*importRecord, defaultCountry string) ([]importResult, []userJSON, error) {
+	var results []importResult
+	var created []userJSON
+	for _, record := range batch {
+		result := importResult{Line: record.line, Status: "error"}
+		parsedData, userTOKEN, message, err := dbobj.importUser(record, defaultCountry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", record.line, err)
+		}
+		if len(message) > 0 {
+			result.Message = message
+		} else {
+			result.Status = "ok"
+			result.Token = userTOKEN
+			created = append(created, parsedData)
+		}
+		results = append(results, result)
+	}
+	return results, created, nil
+}
+
+// importUser validates a single user record and creates it. It returns
+// the reason when the record is rejected, errors abort the import.
+func (dbobj dbcon) importUser(record *importRecord, defaultCountry string) (userJSON, string, string, error) {
+	if record.err != nil {
+		return userJSON{}, "", "failed to parse: " + record.err.Error(), nil
+	}
+	if len(record.record) == 0 {
+		return userJSON{}, "", "empty record", nil
+	}
+	parsedData, err := parseUserJSON(record.record, defaultCountry)
+	if err != nil {
+		return parsedData, "", "failed to parse: " + err.Error(), nil
+	}
+	err = validateUserRecord(parsedData.jsonData)
+	if err != nil {
+		return parsedData, "", "user schema error: " + err.Error(), nil
+	}
+	userTOKEN, err := dbobj.createUserRecord(parsedData, nil)
+	if err != nil && strings.HasPrefix(err.Error(), "duplicate index") {
+		return parsedData, "", err.Error(), nil
+	}
+	return parsedData, userTOKEN, "", err
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Blind indexes are HMAC-SHA256 of the normalized value with a key derived
+// from master key. Index version is saved in idxver column, so the algorithm
+// can be changed again: lookups try older versions until migration is done.
+// Version 1 (empty idxver) is sha256 of md5(master key) and the value.
+
+const indexVersion = 2
+
+// indexLegacyRows is set to 0 when all indexes are rebuilt with the current version
+var indexLegacyRows int32 = 1
+
+// deriveIndexKey returns blind index key, it is separate from encryption keys
+func deriveIndexKey(masterKey []byte) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte("databunker blind index")), key)
+	return key
+}
+
+func hashIndex(indexKey []byte, indexName string, value string) string {
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(indexName + ":" + value))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hashUserIndex returns blind index of normalized login, email or phone
+func (dbobj dbcon) hashUserIndex(indexName string, value string) string {
+	return hashIndex(dbobj.indexKey, indexName, value)
+}
+
+// userIndexHashes returns all index hashes of the value that can be found
+// in users table. Current version goes first.
+func (dbobj dbcon) userIndexHashes(indexName string, value string) []string {
+	hashes := []string{dbobj.hashUserIndex(indexName, value)}
+	if dbobj.rotationEnabled() {
+		hashes = append(hashes, hashIndex(dbobj.oldIndexKey, indexName, value))
+	}
+	if atomic.LoadInt32(&indexLegacyRows) == 1 {
+		hashes = append(hashes, hashString(dbobj.hash, value))
+		if dbobj.rotationEnabled() {
+			hashes = append(hashes, hashString(dbobj.oldHash, value))
+		}
+	}
+	return hashes
+}
+
+// hashXtoken returns hash of access token. Token is hashed with the version 1
+// hash first, so tokens created before are rebuilt without knowing them.
+func (dbobj dbcon) hashXtoken(token string) string {
+	return hashIndex(dbobj.indexKey, "xtoken", hashString(dbobj.hash, token))
+}
+
+// xtokenHashes returns all hashes of access token that can be found
+// in xtokens table. Current version goes first.
+func (dbobj dbcon) xtokenHashes(token string) []string {
+	hashes := []string{dbobj.hashXtoken(token)}
+	if dbobj.rotationEnabled() {
+		hashes = append(hashes, hashIndex(dbobj.oldIndexKey, "xtoken", hashString(dbobj.oldHash, token)))
+	}
+	if atomic.LoadInt32(&indexLegacyRows) == 1 {
+		hashes = append(hashes, hashString(dbobj.hash, token))
+		if dbobj.rotationEnabled() {
+			hashes = append(hashes, hashString(dbobj.oldHash, token))
+		}
+	}
+	return hashes
+}
+
+// rebuildUserIndexes recalculates login, email and phone indexes that
+// exist in user record. raw is decrypted user profile.
+func (dbobj dbcon) rebuildUserIndexes(userBson bson.M, raw map[string]interface{}, defaultCountry string, bdoc bson.M, bdel bson.M) {
+	for _, idx := range []string{"login", "email", "phone"} {
+		if _, ok := userBson[idx+"idx"].(string); !ok {
+			continue
+		}
+		indexValue := ""
+		if value, ok := raw[idx]; ok {
+			indexValue = getIndexString(value)
+			if idx == "email" {
+				indexValue = normalizeEmail(indexValue)
+			} else if idx == "phone" {
+				indexValue = normalizePhone(indexValue, defaultCountry)
+			}
+		}
+		if len(indexValue) > 0 {
+			bdoc[idx+"idx"] = dbobj.hashUserIndex(idx, indexValue)
+		} else {
+			bdel[idx+"idx"] = ""
+		}
+	}
+	bdoc["idxver"] = int32(indexVersion)
+}
+
+// decryptUserProfile returns decrypted user profile, it is empty for deleted user
+func (dbobj dbcon) decryptUserProfile(userBson bson.M) (map[string]interface{}, error) {
+	raw := make(map[string]interface{})
+	encData0, _ := userBson["data"].(string)
+	if len(encData0) == 0 {
+		return raw, nil
+	}
+	recordKey, err := dbobj.userRecordKey(userBson)
+	if err != nil || recordKey == nil {
+		return raw, err
+	}
+	encData, err := base64.StdEncoding.DecodeString(encData0)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := dbobj.decryptRecord(recordKey, encData)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(decrypted, &raw)
+	return raw, err
+}
+
+// migrateUserIndexes rebuilds blind indexes of a user record
+func (dbobj dbcon) migrateUserIndexes(userBson bson.M, defaultCountry string) error {
+	if getInt64Value(userBson, "idxver") == indexVersion {
+		return nil
+	}
+	userTOKEN := userBson["token"].(string)
+	bdoc := bson.M{}
+	bdel := bson.M{}
+	raw, err := dbobj.decryptUserProfile(userBson)
+	if err != nil {
+		return err
+	}
+	dbobj.rebuildUserIndexes(userBson, raw, defaultCountry, bdoc, bdel)
+	md5, _ := userBson["md5"].(string)
+	if len(md5) == 0 {
+		_, err = dbobj.store.UpdateRecord(storage.TblName.Users, "token", userTOKEN, &bdoc)
+		return err
+	}
+	// record changed in the meantime already has indexes of the current version
+	_, err = dbobj.store.UpdateRecord2(storage.TblName.Users, "token", userTOKEN, "md5", md5, &bdoc, &bdel)
+	return err
+}
+
+// migrateXtokenIndex re-hashes access token of the previous index version
+func (dbobj dbcon) migrateXtokenIndex(record bson.M) error {
+	if getInt64Value(record, "idxver") == indexVersion {
+		return nil
+	}
+	xtoken := record["xtoken"].(string)
+	bdoc := bson.M{"xtoken": hashIndex(dbobj.indexKey, "xtoken", xtoken), "idxver": int32(indexVersion)}
+	_, err := dbobj.store.UpdateRecord(storage.TblName.Xtokens, "xtoken", xtoken, &bdoc)
+	return err
+}
+
+// migrateIndexes rebuilds users and xtokens indexes of the previous version.
+// During master key rotation it is postponed, rotation rebuilds user indexes
+// and tokens are re-hashed on first use.
+func (dbobj dbcon) migrateIndexes(defaultCountry string, stop chan struct{}) error {
+	if dbobj.rotationEnabled() {
+		log.Printf("blind index migration is postponed until master key rotation is done\n")
+		return nil
+	}
+	phases := []batchPhase{
+		{"users", storage.TblName.Users, "token", func(record bson.M) error {
+			return dbobj.migrateUserIndexes(record, defaultCountry)
+		}},
+		{"xtokens", storage.TblName.Xtokens, "xtoken", dbobj.migrateXtokenIndex},
+	}
+	done, err := dbobj.runBatchJob("blind index migration", phases, stop)
+	if done {
+		atomic.StoreInt32(&indexLegacyRows, 0)
+	}
+	return err
+}
+
+// searchFields are extra user record fields declared in generic.search_fields.
+// Their blind indexes are kept in userindexes table and the field names
+// can be used as lookup mode like login, email and phone.
+var searchFields []string
+
+var searchFieldRegex = regexp.MustCompile("^[a-z][a-z0-9_]{0,63}$")
+
+// setSearchFields validates and sets extra search fields
+func setSearchFields(fields []string) error {
+	reserved := []string{"token", "login", "email", "phone", "session"}
+	for _, field := range fields {
+		if searchFieldRegex.MatchString(field) == false || contains(reserved, field) {
+			return fmt.Errorf("bad search field name: %s", field)
+		}
+	}
+	searchFields = fields
+	return nil
+}
+
+func isSearchField(indexName string) bool {
+	return contains(searchFields, indexName)
+}
+
+// searchIndexValues returns values of extra search fields found in user profile
+func searchIndexValues(raw map[string]interface{}) map[string]string {
+	values := make(map[string]string)
+	for _, field := range searchFields {
+		if value, ok := raw[field]; ok {
+			values[field] = getIndexString(value)
+		}
+	}
+	return values
+}
+
+// lookupUserRecordBySearchField finds user by extra search field value
+func (dbobj dbcon) lookupUserRecordBySearchField(indexName string, indexValue string) (bson.M, error) {
+	hashes := []string{dbobj.hashUserIndex(indexName, indexValue)}
+	if dbobj.rotationEnabled() {
+		hashes = append(hashes, hashIndex(dbobj.oldIndexKey, indexName, indexValue))
+	}
+	for _, hashed := range hashes {
+		record, err := dbobj.store.GetRecord(storage.TblName.Userindexes, "idx", hashed)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			return dbobj.lookupUserRecord(record["token"].(string))
+		}
+	}
+	return nil, nil
+}
+
+// checkSearchIndexes returns error if other user has the same search field value
+func (dbobj dbcon) checkSearchIndexes(userTOKEN string, values map[string]string) error {
+	for _, field := range searchFields {
+		if len(values[field]) == 0 {
+			continue
+		}
+		otherUserBson, err := dbobj.lookupUserRecordBySearchField(field, values[field])
+		if err != nil {
+			return err
+		}
+		if otherUserBson != nil && otherUserBson["token"].(string) != userTOKEN {
+			return errors.New("duplicate index: " + field)
+		}
+	}
+	return nil
+}
+
+// saveSearchIndexes updates search field indexes of the user, indexes
+// of the fields missing in values are removed
+func (dbobj dbcon) saveSearchIndexes(userTOKEN string, values map[string]string) error {
+	for _, field := range searchFields {
+		record, err := dbobj.store.GetRecord2(storage.TblName.Userindexes, "token", userTOKEN, "field", field)
+		if err != nil {
+			return err
+		}
+		if len(values[field]) == 0 {
+			if record != nil {
+				_, err = dbobj.store.DeleteRecord2(storage.TblName.Userindexes, "token", userTOKEN, "field", field)
+			}
+		} else if record == nil {
+			bdoc := bson.M{"token": userTOKEN, "field": field, "idx": dbobj.hashUserIndex(field, values[field])}
+			_, err = dbobj.store.CreateRecord(storage.TblName.Userindexes, &bdoc)
+		} else if record["idx"].(string) != dbobj.hashUserIndex(field, values[field]) {
+			bdoc := bson.M{"idx": dbobj.hashUserIndex(field, values[field])}
+			_, err = dbobj.store.UpdateRecord2(storage.TblName.Userindexes, "token", userTOKEN, "field", field, &bdoc, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexSearchFields adds indexes of existing users when a new search field
+// is declared. Every field is indexed once by a separate resumable job.
+func (dbobj dbcon) indexSearchFields(stop chan struct{}) error {
+	for _, field := range searchFields {
+		name := field
+		phases := []batchPhase{
+			{"users", storage.TblName.Users, "token", func(record bson.M) error {
+				userTOKEN := record["token"].(string)
+				indexBson, err := dbobj.store.GetRecord2(storage.TblName.Userindexes, "token", userTOKEN, "field", name)
+				if err != nil || indexBson != nil {
+					return err
+				}
+				raw, err := dbobj.decryptUserProfile(record)
+				if err != nil {
+					return err
+				}
+				values := searchIndexValues(raw)
+				if len(values[name]) == 0 {
+					return nil
+				}
+				otherUserBson, err := dbobj.lookupUserRecordBySearchField(name, values[name])
+				if err != nil {
+					return err
+				}
+				if otherUserBson != nil {
+					log.Printf("user %s has duplicate %s value, it is not indexed\n", userTOKEN, name)
+					return nil
+				}
+				bdoc := bson.M{"token": userTOKEN, "field": name, "idx": dbobj.hashUserIndex(name, values[name])}
+				_, err = dbobj.store.CreateRecord(storage.TblName.Userindexes, &bdoc)
+				return err
+			}},
+		}
+		done, err := dbobj.runBatchJob("search field "+name+" index", phases, stop)
+		if done == false || err != nil {
+			return err
+		}
+	}
+	return nil
+}
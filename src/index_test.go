@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestBlindIndexMigration(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"indexuser","email":"index@user.com","name":"index"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	userBson, _ := e.db.lookupUserRecord(userTOKEN)
+	if userBson["loginidx"].(string) != e.db.hashUserIndex("login", "indexuser") ||
+		userBson["emailidx"].(string) == e.db.hashUserIndex("login", "index@user.com") {
+		t.Fatalf("wrong blind index\n")
+	}
+	// indexes and token of the previous version
+	bdoc := bson.M{"loginidx": hashString(e.db.hash, "indexuser"),
+		"emailidx": hashString(e.db.hash, "index@user.com"), "idxver": int32(1)}
+	e.db.store.UpdateRecord(storage.TblName.Users, "token", userTOKEN, &bdoc)
+	xtoken, _ := uuid.GenerateUUID()
+	bdoc = bson.M{"xtoken": hashString(e.db.hash, xtoken), "token": userTOKEN,
+		"type": "login", "endtime": int32(time.Now().Unix()) + 60}
+	e.db.store.CreateRecord(storage.TblName.Xtokens, &bdoc)
+	raw, err = helpGetUser("login", "indexuser")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to find user by legacy index: %v", raw)
+	}
+	err = e.db.migrateIndexes("", nil)
+	if err != nil || atomic.LoadInt32(&indexLegacyRows) != 0 {
+		t.Fatalf("failed to migrate indexes: %s", err)
+	}
+	defer atomic.StoreInt32(&indexLegacyRows, 1)
+	userBson, _ = e.db.lookupUserRecord(userTOKEN)
+	if userBson["loginidx"].(string) != e.db.hashUserIndex("login", "indexuser") ||
+		userBson["emailidx"].(string) != e.db.hashUserIndex("email", "index@user.com") {
+		t.Fatalf("user indexes are not rebuilt\n")
+	}
+	raw, err = helpGetUser("email", "index@user.com")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to find user by migrated index: %v", raw)
+	}
+	result, err := e.db.checkUserAuthXToken(xtoken)
+	if err != nil || result.token != userTOKEN {
+		t.Fatalf("failed to authenticate with migrated xtoken: %s", err)
+	}
+	_, err = e.db.checkUserAuthXToken(rootToken)
+	if err != nil {
+		t.Fatalf("failed to authenticate with migrated root token: %s", err)
+	}
+}
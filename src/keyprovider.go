@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"golang.org/x/crypto/argon2"
+)
+
+// KeyProvider loads master key from a key source.
+// Built-in providers: env (hex key in -masterkey or DATABUNKER_MASTERKEY),
+// file (key file wrapped with passphrase) and kms (key file wrapped with
+// Vault transit compatible KMS, envelope encryption).
+type KeyProvider interface {
+	// Name returns provider name
+	Name() string
+	// Available checks if master key can be loaded from this provider
+	Available() bool
+	// LoadKey returns master key
+	LoadKey() ([]byte, error)
+	// StoreKey saves newly generated master key
+	StoreKey(masterKey []byte) error
+	// Previous returns provider of the key replaced by StoreKey, nil if not supported
+	Previous() KeyProvider
+}
+
+// newKeyProvider returns key provider selected in key_provider configuration section
+func newKeyProvider(cfg Config, masterKeyPtr *string) (KeyProvider, error) {
+	conf := cfg.KeyProvider
+	switch conf.Type {
+	case "", "env":
+		return &envKeyProvider{masterKeyPtr}, nil
+	case "file":
+		if len(conf.File) == 0 {
+			return nil, errors.New("key_provider.file is missing")
+		}
+		if len(conf.Passphrase) == 0 {
+			return nil, errors.New("passphrase is missing, set DATABUNKER_KEY_PASSPHRASE")
+		}
+		return &fileKeyProvider{conf.File, conf.Passphrase}, nil
+	case "kms":
+		if len(conf.File) == 0 || len(conf.KmsURL) == 0 || len(conf.KmsKey) == 0 {
+			return nil, errors.New("key_provider file, kms_url and kms_key are required")
+		}
+		return &kmsKeyProvider{conf.File, strings.TrimRight(conf.KmsURL, "/"), conf.KmsKey, conf.KmsToken}, nil
+	}
+	return nil, fmt.Errorf("unknown key provider: %s", conf.Type)
+}
+
+// envKeyProvider reads hex encoded master key from command line or environment
+type envKeyProvider struct {
+	masterKeyPtr *string
+}
+
+func (p *envKeyProvider) Name() string {
+	return "env"
+}
+
+func (p *envKeyProvider) Available() bool {
+	return masterkeyProvided(p.masterKeyPtr)
+}
+
+func (p *envKeyProvider) LoadKey() ([]byte, error) {
+	return masterkeyGet(p.masterKeyPtr)
+}
+
+// StoreKey prints the key, operator is responsible to keep it
+func (p *envKeyProvider) StoreKey(masterKey []byte) error {
+	fmt.Printf("Master key: %x\n\n", masterKey)
+	return nil
+}
+
+func (p *envKeyProvider) Previous() KeyProvider {
+	return nil
+}
+
+// wrappedKeyFile is a master key file format shared by file and kms providers
+type wrappedKeyFile struct {
+	Version    int    `json:"version"`
+	Provider   string `json:"provider"`
+	Salt       string `json:"salt,omitempty"`
+	Time       uint32 `json:"time,omitempty"`
+	Memory     uint32 `json:"memory,omitempty"`
+	Threads    uint8  `json:"threads,omitempty"`
+	KmsKey     string `json:"kms_key,omitempty"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+func readWrappedKey(filename string, provider string) (*wrappedKeyFile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var wrapped wrappedKeyFile
+	err = json.Unmarshal(data, &wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("bad key file %s: %s", filename, err)
+	}
+	if wrapped.Version != 1 || wrapped.Provider != provider {
+		return nil, fmt.Errorf("key file %s is not created by %s provider", filename, provider)
+	}
+	return &wrapped, nil
+}
+
+// writeWrappedKey saves key file, current file is kept with .old suffix
+func writeWrappedKey(filename string, wrapped *wrappedKeyFile) error {
+	data, err := json.MarshalIndent(wrapped, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(filename); err == nil {
+		err = os.Rename(filename, filename+".old")
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// fileKeyProvider keeps master key in a file encrypted with a key derived
+// from passphrase using Argon2id
+type fileKeyProvider struct {
+	filename   string
+	passphrase string
+}
+
+func (p *fileKeyProvider) Name() string {
+	return "file"
+}
+
+func (p *fileKeyProvider) Available() bool {
+	return fileExists(p.filename)
+}
+
+func passphraseCipher(passphrase string, wrapped *wrappedKeyFile) (cipher.AEAD, error) {
+	salt, err := base64.StdEncoding.DecodeString(wrapped.Salt)
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, wrapped.Time, wrapped.Memory, wrapped.Threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (p *fileKeyProvider) LoadKey() ([]byte, error) {
+	wrapped, err := readWrappedKey(p.filename, "file")
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := passphraseCipher(p.passphrase, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(wrapped.Ciphertext)
+	if err != nil || len(data) <= aesgcm.NonceSize() {
+		return nil, errors.New("bad key file")
+	}
+	nonce := data[:aesgcm.NonceSize()]
+	masterKey, err := aesgcm.Open(nil, nonce, data[aesgcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+	return masterKey, nil
+}
+
+func (p *fileKeyProvider) StoreKey(masterKey []byte) error {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	wrapped := &wrappedKeyFile{Version: 1, Provider: "file", Time: 3, Memory: 64 * 1024, Threads: 4}
+	wrapped.Salt = base64.StdEncoding.EncodeToString(salt)
+	aesgcm, err := passphraseCipher(p.passphrase, wrapped)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	ciphertext := aesgcm.Seal(nonce, nonce, masterKey, nil)
+	wrapped.Ciphertext = base64.StdEncoding.EncodeToString(ciphertext)
+	err = writeWrappedKey(p.filename, wrapped)
+	if err == nil {
+		fmt.Printf("Master key is saved to %s\n\n", p.filename)
+	}
+	return err
+}
+
+func (p *fileKeyProvider) Previous() KeyProvider {
+	return &fileKeyProvider{p.filename + ".old", p.passphrase}
+}
+
+// kmsKeyProvider keeps master key in a file encrypted by external KMS.
+// It uses Vault transit secrets engine API, kms_url points to the engine
+// mount, for example https://vault:8200/v1/transit
+type kmsKeyProvider struct {
+	filename string
+	url      string
+	keyName  string
+	token    string
+}
+
+func (p *kmsKeyProvider) Name() string {
+	return "kms"
+}
+
+func (p *kmsKeyProvider) Available() bool {
+	return fileExists(p.filename)
+}
+
+// kmsRequest calls KMS API and returns data section of the response
+func (p *kmsKeyProvider) kmsRequest(action string, request map[string]string) (map[string]interface{}, error) {
+	body, _ := json.Marshal(request)
+	req, err := http.NewRequest("POST", p.url+"/"+action+"/"+p.keyName, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(p.token) > 0 {
+		req.Header.Set("X-Vault-Token", p.token)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("kms %s failed, status: %d", action, resp.StatusCode)
+	}
+	var raw struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.Unmarshal(respBody, &raw)
+	if err != nil {
+		return nil, err
+	}
+	if raw.Data == nil {
+		return nil, fmt.Errorf("kms %s failed, empty response", action)
+	}
+	return raw.Data, nil
+}
+
+func (p *kmsKeyProvider) LoadKey() ([]byte, error) {
+	wrapped, err := readWrappedKey(p.filename, "kms")
+	if err != nil {
+		return nil, err
+	}
+	if wrapped.KmsKey != p.keyName {
+		return nil, fmt.Errorf("master key is wrapped with kms key %s", wrapped.KmsKey)
+	}
+	data, err := p.kmsRequest("decrypt", map[string]string{"ciphertext": wrapped.Ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, _ := data["plaintext"].(string)
+	masterKey, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil || len(masterKey) == 0 {
+		return nil, errors.New("kms returned bad plaintext")
+	}
+	return masterKey, nil
+}
+
+func (p *kmsKeyProvider) StoreKey(masterKey []byte) error {
+	data, err := p.kmsRequest("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(masterKey)})
+	if err != nil {
+		return err
+	}
+	ciphertext, _ := data["ciphertext"].(string)
+	if len(ciphertext) == 0 {
+		return errors.New("kms returned empty ciphertext")
+	}
+	wrapped := &wrappedKeyFile{Version: 1, Provider: "kms", KmsKey: p.keyName, Ciphertext: ciphertext}
+	err = writeWrappedKey(p.filename, wrapped)
+	if err == nil {
+		fmt.Printf("Master key wrapped by KMS is saved to %s\n\n", p.filename)
+	}
+	return err
+}
+
+func (p *kmsKeyProvider) Previous() KeyProvider {
+	return &kmsKeyProvider{p.filename + ".old", p.url, p.keyName, p.token}
+}
+
+// previousMasterKey returns master key replaced by the last StoreKey call,
+// it is used to finish master key rotation. nil is returned if not found.
+func previousMasterKey(keys KeyProvider) ([]byte, error) {
+	previous := keys.Previous()
+	if previous == nil || previous.Available() == false {
+		return nil, nil
+	}
+	return previous.LoadKey()
+}
+
+// providerRotationKeys returns old and new master keys for rotation with
+// file or kms provider. New key is saved before re-encryption starts and
+// the old one stays in the .old file, so interrupted rotation can continue.
+// When rotation to the current key is finished, a new rotation is started
+// and the current key replaces the .old file.
+func providerRotationKeys(keys KeyProvider, store storage.Storage) ([]byte, []byte, error) {
+	oldMasterKey, err := previousMasterKey(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	if oldMasterKey != nil {
+		masterKey, err := keys.LoadKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		done, err := masterKeyRotationDone(store, masterKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if done == false {
+			return oldMasterKey, masterKey, nil
+		}
+	}
+	oldMasterKey, err = keys.LoadKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	masterKey, err := generateMasterKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = keys.StoreKey(masterKey)
+	return oldMasterKey, masterKey, err
+}
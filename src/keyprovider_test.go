@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// helpTransitStub emulates Vault transit encrypt and decrypt API
+func helpTransitStub(token string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(403)
+			return
+		}
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/databunker":
+			fmt.Fprintf(w, `{"data":{"ciphertext":"vault:v1:%s"}}`, req["plaintext"])
+		case "/v1/transit/decrypt/databunker":
+			fmt.Fprintf(w, `{"data":{"plaintext":%q}}`, strings.TrimPrefix(req["ciphertext"], "vault:v1:"))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	filename := "/tmp/test-masterkey.json"
+	os.Remove(filename)
+	os.Remove(filename + ".old")
+	var cfg Config
+	cfg.KeyProvider.Type = "file"
+	cfg.KeyProvider.File = filename
+	cfg.KeyProvider.Passphrase = "correct horse battery staple"
+	keys, err := newKeyProvider(cfg, nil)
+	if err != nil || keys.Available() {
+		t.Fatalf("failed to create key provider: %s", err)
+	}
+	masterKey, _ := generateMasterKey()
+	err = keys.StoreKey(masterKey)
+	if err != nil {
+		t.Fatalf("failed to store key: %s", err)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if bytes.Contains(data, []byte(fmt.Sprintf("%x", masterKey))) ||
+		bytes.Contains(data, []byte(base64.StdEncoding.EncodeToString(masterKey))) {
+		t.Fatalf("master key is saved in plain text\n")
+	}
+	result, err := keys.LoadKey()
+	if err != nil || bytes.Equal(result, masterKey) == false {
+		t.Fatalf("failed to load key: %s", err)
+	}
+	cfg.KeyProvider.Passphrase = "wrong passphrase"
+	wrongKeys, _ := newKeyProvider(cfg, nil)
+	if _, err = wrongKeys.LoadKey(); err == nil {
+		t.Fatalf("key loaded with wrong passphrase\n")
+	}
+	oldMasterKey, newMasterKey, err := providerRotationKeys(keys, e.db.store)
+	if err != nil || bytes.Equal(oldMasterKey, masterKey) == false || bytes.Equal(newMasterKey, masterKey) {
+		t.Fatalf("failed to prepare rotation keys: %s", err)
+	}
+	// interrupted rotation continues with the same keys
+	oldMasterKey2, newMasterKey2, err := providerRotationKeys(keys, e.db.store)
+	if err != nil || bytes.Equal(oldMasterKey2, oldMasterKey) == false || bytes.Equal(newMasterKey2, newMasterKey) == false {
+		t.Fatalf("failed to continue rotation: %s", err)
+	}
+}
+
+func TestKmsKeyProvider(t *testing.T) {
+	server := helpTransitStub("vault-token")
+	defer server.Close()
+	filename := "/tmp/test-masterkey-kms.json"
+	os.Remove(filename)
+	var cfg Config
+	cfg.KeyProvider.Type = "kms"
+	cfg.KeyProvider.File = filename
+	cfg.KeyProvider.KmsURL = server.URL + "/v1/transit/"
+	cfg.KeyProvider.KmsKey = "databunker"
+	cfg.KeyProvider.KmsToken = "vault-token"
+	keys, err := newKeyProvider(cfg, nil)
+	if err != nil {
+		t.Fatalf("failed to create key provider: %s", err)
+	}
+	masterKey, _ := generateMasterKey()
+	err = keys.StoreKey(masterKey)
+	if err != nil {
+		t.Fatalf("failed to store key: %s", err)
+	}
+	result, err := keys.LoadKey()
+	if err != nil || bytes.Equal(result, masterKey) == false {
+		t.Fatalf("failed to load key: %s", err)
+	}
+	cfg.KeyProvider.KmsToken = "bad-token"
+	badKeys, _ := newKeyProvider(cfg, nil)
+	if _, err = badKeys.LoadKey(); err == nil {
+		t.Fatalf("key loaded with bad kms token\n")
+	}
+}
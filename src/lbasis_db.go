@@ -90,7 +90,7 @@ func (dbobj dbcon) revokeLegalBasis(brief string) (bool, error) {
 	// look up for user with this legal basis
 	bdoc := bson.M{}
 	now := int32(time.Now().Unix())
-	bdoc["who"] = "admin"
+	bdoc["lastmodifiedby"] = "admin"
 	bdoc["when"] = now
 	bdoc["status"] = "revoked"
 	dbobj.store.UpdateRecord2(storage.TblName.Agreements, "brief", brief, "status", "yes", &bdoc, nil)
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Login code checks are limited per user and per client IP. After every
+// wrong code the user has to wait 1, 2, 4... seconds before the next attempt.
+// When maxLoginAttempts is reached, the code is invalidated and the user is
+// locked for loginLockoutPeriod. Counters are reset after successful login or
+// when the lockout period passes without new failures. Client IP is locked
+// for loginLockoutPeriod after maxLoginAttemptsPerIP failures for any users.
+var (
+	maxLoginAttempts      int32 = 5
+	maxLoginAttemptsPerIP int32 = 20
+	loginLockoutPeriod    int32 = 15 * 60
+)
+
+// setLoginLimits sets login attempt limits from policy, default values are
+// used for zero or empty values
+func setLoginLimits(maxAttempts int32, maxAttemptsPerIP int32, lockoutPeriod string) error {
+	if maxAttempts < 0 || maxAttemptsPerIP < 0 {
+		return errors.New("max login attempts can not be negative")
+	}
+	if maxAttempts > 0 {
+		maxLoginAttempts = maxAttempts
+	}
+	if maxAttemptsPerIP > 0 {
+		maxLoginAttemptsPerIP = maxAttemptsPerIP
+	}
+	if len(lockoutPeriod) > 0 {
+		period, err := parseExpiration0(lockoutPeriod)
+		if err != nil {
+			return err
+		}
+		if period == 0 {
+			return errors.New("login lockout period can not be 0")
+		}
+		loginLockoutPeriod = period
+	}
+	return nil
+}
+
+// loginBackoff returns number of seconds to wait after failed attempt
+func loginBackoff(fails int32) int32 {
+	if fails >= maxLoginAttempts || fails > 30 {
+		return loginLockoutPeriod
+	}
+	backoff := int32(1) << uint(fails-1)
+	if backoff > loginLockoutPeriod {
+		return loginLockoutPeriod
+	}
+	return backoff
+}
+
+// ipLoginState keeps failed login attempts from one client IP
+type ipLoginState struct {
+	fails int32
+	last  int32
+	lock  int32
+}
+
+type loginLimiter struct {
+	sync.Mutex
+	ips map[string]*ipLoginState
+}
+
+var loginIPs = loginLimiter{ips: make(map[string]*ipLoginState)}
+
+// lockedFor returns number of seconds client IP is still locked
+func (l *loginLimiter) lockedFor(ip string) int32 {
+	now := int32(time.Now().Unix())
+	l.Lock()
+	defer l.Unlock()
+	state, ok := l.ips[ip]
+	if !ok || state.lock <= now {
+		return 0
+	}
+	return state.lock - now
+}
+
+// failed counts failed attempt of client IP and returns number of failed
+// attempts and lockout time in seconds
+func (l *loginLimiter) failed(ip string) (int32, int32) {
+	now := int32(time.Now().Unix())
+	l.Lock()
+	defer l.Unlock()
+	if len(l.ips) > 10000 {
+		for key, state := range l.ips {
+			if state.last+loginLockoutPeriod < now && state.lock < now {
+				delete(l.ips, key)
+			}
+		}
+	}
+	state, ok := l.ips[ip]
+	if !ok || (state.last+loginLockoutPeriod < now && state.lock < now) {
+		state = &ipLoginState{}
+		l.ips[ip] = state
+	}
+	state.fails++
+	state.last = now
+	if state.fails < maxLoginAttemptsPerIP {
+		return state.fails, 0
+	}
+	state.lock = now + loginLockoutPeriod
+	return state.fails, loginLockoutPeriod
+}
+
+// trustedProxies are reverse proxies allowed to set X-Forwarded-For header
+var trustedProxies []*net.IPNet
+
+// setTrustedProxies parses list of proxy IP addresses and CIDR networks
+func setTrustedProxies(proxies []string) error {
+	trustedProxies = nil
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") == false {
+			if strings.Contains(proxy, ":") {
+				proxy = proxy + "/128"
+			} else {
+				proxy = proxy + "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return errors.New("bad trusted proxy: " + proxy)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns address of the client without port. When request comes
+// from a trusted proxy, X-Forwarded-For header is checked from the right and
+// the first address that is not a trusted proxy is returned.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if isTrustedProxy(host) == false {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if len(address) == 0 {
+			continue
+		}
+		if isTrustedProxy(address) == false {
+			return address
+		}
+		host = address
+	}
+	return host
+}
+
+// userLoginLockedFor returns number of seconds user login is still locked
+func userLoginLockedFor(userBson bson.M) int32 {
+	lock, _ := userBson["loginlock"].(int32)
+	now := int32(time.Now().Unix())
+	if lock <= now {
+		return 0
+	}
+	return lock - now
+}
+
+// checkLoginCode checks temporary login code of the user. Code is valid
+// only once, it is removed on success and when the user is locked.
+// Returns number of failed attempts and lockout time in seconds.
+func (dbobj dbcon) checkLoginCode(userTOKEN string, code int32) (bool, int32, int32, error) {
+	valid := false
+	var fails, lockout int32
+	err := dbobj.withTx(func(dbTx dbcon) error {
+		record, err := dbTx.store.GetRecord(storage.TblName.Users, "token", userTOKEN)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return errors.New("not found")
+		}
+		now := int32(time.Now().Unix())
+		tempCode, _ := record["tempcode"].(int32)
+		tempCodeExp, _ := record["tempcodeexp"].(int32)
+		bdoc := bson.M{}
+		if tempCode != 0 && code == tempCode && tempCodeExp >= now {
+			valid = true
+			bdoc["tempcode"] = int32(0)
+			bdoc["tempcodeexp"] = int32(0)
+			bdoc["loginfails"] = int32(0)
+			bdoc["loginlock"] = int32(0)
+			_, err = dbTx.store.UpdateRecord(storage.TblName.Users, "token", userTOKEN, &bdoc)
+			return err
+		}
+		fails, _ = record["loginfails"].(int32)
+		lock, _ := record["loginlock"].(int32)
+		if lock+loginLockoutPeriod < now {
+			// previous failures are forgotten
+			fails = 0
+		}
+		fails++
+		lockout = loginBackoff(fails)
+		bdoc["loginfails"] = fails
+		bdoc["loginlock"] = now + lockout
+		if fails >= maxLoginAttempts {
+			bdoc["tempcode"] = int32(0)
+			bdoc["tempcodeexp"] = int32(0)
+		}
+		_, err = dbTx.store.UpdateRecord(storage.TblName.Users, "token", userTOKEN, &bdoc)
+		return err
+	})
+	return valid, fails, lockout, err
+}
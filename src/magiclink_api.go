@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// userMagicLink is opened from the email. It only redirects user to the
+// frontend with the link in URL fragment, the link is not used here. Email
+// scanners open links before the user, so link is exchanged for a login
+// token by the frontend with POST /v1/magiclink.
+func (e mainEnv) userMagicLink(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if len(e.conf.SelfService.MagicLinkRedirect) == 0 {
+		returnError(w, r, "magic link redirect is not configured", 405, nil, nil)
+		return
+	}
+	values := url.Values{"link": {ps.ByName("link")}}
+	http.Redirect(w, r, e.conf.SelfService.MagicLinkRedirect+"#"+values.Encode(), http.StatusFound)
+}
+
+// userMagicLogin exchanges magic link sent by email for a login token
+func (e mainEnv) userMagicLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	event := audit("user login by magic link", "", "token", "")
+	defer func() { event.submit(e.db) }()
+	ip := clientIP(r)
+	if seconds := loginIPs.lockedFor(ip); seconds > 0 {
+		returnError(w, r, "too many login attempts", 429, fmt.Errorf("ip %s is locked for %d seconds", ip, seconds), event)
+		return
+	}
+	records, err := getJSONPostData(r)
+	if err != nil || records == nil {
+		returnError(w, r, "failed to decode request body", 405, err, event)
+		return
+	}
+	userTOKEN, err := e.db.useMagicLink(getStringValue(records, "link"))
+	if err != nil {
+		loginIPs.failed(ip)
+		returnError(w, r, "bad login link", 405, err, event)
+		return
+	}
+	event.Record = userTOKEN
+	event.Who = userTOKEN
+	xtoken, refresh, hashedToken, err := e.db.loginUserXtokens(userTOKEN)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	event.Msg = "generated: " + hashedToken
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","xtoken":"%s","token":"%s","refresh":"%s","ttl":%d}`,
+		xtoken, userTOKEN, refresh, loginTokenTTL)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Magic link is sent by email instead of login code when enabled in
+// selfservice config. Link value is "<uuid>.<endtime>.<signature>", uuid is
+// saved hashed in xtokens table with "magiclink" type and removed on first
+// use. Signature is checked before database lookup, so forged and expired
+// links are rejected early.
+
+var magicLinkTTL int32 = 15 * 60
+
+// setMagicLinkTTL sets lifetime of magic link from policy, default value is
+// used for empty string
+func setMagicLinkTTL(ttl string) error {
+	if len(ttl) == 0 {
+		return nil
+	}
+	value, err := parseExpiration0(ttl)
+	if err != nil {
+		return err
+	}
+	if value == 0 {
+		return errors.New("magic link ttl can not be 0")
+	}
+	magicLinkTTL = value
+	return nil
+}
+
+func signMagicLink(indexKey []byte, id string, endtime int32) string {
+	return xtokenID(hashIndex(indexKey, "magiclink", fmt.Sprintf("%s.%d", id, endtime)))
+}
+
+// createMagicLink saves single-use login link of the user and returns its value
+func (dbobj dbcon) createMagicLink(userTOKEN string) (string, error) {
+	endtime := int32(time.Now().Unix()) + magicLinkTTL
+	id, _, err := dbobj.createUserXtoken(userTOKEN, "magiclink", "", magicLinkTTL)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%d.%s", id, endtime, signMagicLink(dbobj.indexKey, id, endtime)), nil
+}
+
+// useMagicLink checks magic link and removes it. Returns user token.
+// Failed login counters of the user are reset.
+func (dbobj dbcon) useMagicLink(link string) (string, error) {
+	parts := strings.Split(link, ".")
+	if len(parts) != 3 || isValidUUID(parts[0]) == false {
+		return "", errors.New("bad link")
+	}
+	id := parts[0]
+	endtime64, err := strconv.ParseInt(parts[1], 10, 32)
+	if err != nil {
+		return "", errors.New("bad link")
+	}
+	endtime := int32(endtime64)
+	keys := [][]byte{dbobj.indexKey}
+	if dbobj.rotationEnabled() {
+		keys = append(keys, dbobj.oldIndexKey)
+	}
+	signed := false
+	for _, key := range keys {
+		if hmac.Equal([]byte(signMagicLink(key, id, endtime)), []byte(parts[2])) {
+			signed = true
+		}
+	}
+	if signed == false {
+		return "", errors.New("bad link signature")
+	}
+	if int32(time.Now().Unix()) > endtime {
+		return "", errors.New("link expired")
+	}
+	userTOKEN := ""
+	err = dbobj.withTx(func(dbTx dbcon) error {
+		var record bson.M
+		for _, hashed := range dbTx.xtokenHashes(id) {
+			record, err = dbTx.store.GetRecord(storage.TblName.Xtokens, "xtoken", hashed)
+			if record != nil || err != nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if record == nil || record["type"].(string) != "magiclink" {
+			return errors.New("link is used or not found")
+		}
+		_, err = dbTx.store.DeleteRecord(storage.TblName.Xtokens, "xtoken", record["xtoken"].(string))
+		if err != nil {
+			return err
+		}
+		userTOKEN = record["token"].(string)
+		bdoc := bson.M{}
+		bdoc["loginfails"] = int32(0)
+		bdoc["loginlock"] = int32(0)
+		_, err = dbTx.store.UpdateRecord(storage.TblName.Users, "token", userTOKEN, &bdoc)
+		return err
+	})
+	return userTOKEN, err
+}
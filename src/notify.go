@@ -41,12 +41,13 @@ func notifyProfileChange(notifyURL string, old []byte, profile []byte, mode stri
 	go notify(notifyURL, host, []byte(requestBody))
 }
 
-func notifyForgetMe(notifyURL string, profile []byte, mode string, address string) {
+func notifyForgetMe(notifyURL string, profile []byte, erasure erasureReport, mode string, address string) {
 	if len(notifyURL) == 0 {
 		return
 	}
-	requestBody := fmt.Sprintf(`{"action":"%s","address":"%s","mode":"%s","profile":%s}`,
-		"forgetme", address, mode, profile)
+	erasureJSON, _ := json.Marshal(erasure)
+	requestBody := fmt.Sprintf(`{"action":"%s","address":"%s","erasure":%s,"mode":"%s","profile":%s}`,
+		"forgetme", address, erasureJSON, mode, profile)
 	host := autocontext.GetAuto("host")
 	go notify(notifyURL, host, []byte(requestBody))
 }
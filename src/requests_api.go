@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -135,6 +136,11 @@ func (e mainEnv) getUserRequest(w http.ResponseWriter, r *http.Request, ps httpr
 	if value, ok := requestInfo["brief"]; ok {
 		brief = value.(string)
 	}
+	scope := requestScope(r)
+	if len(appName) > 0 && scope.allowsApp(appName) == false {
+		returnError(w, r, "app is not allowed by token scope", 403, nil, event)
+		return
+	}
 	if len(appName) > 0 {
 		resultJSON, err = e.db.getUserApp(userTOKEN, appName)
 	} else if len(brief) > 0 {
@@ -150,6 +156,18 @@ func (e mainEnv) getUserRequest(w http.ResponseWriter, r *http.Request, ps httpr
 		returnError(w, r, "not found", 405, err, event)
 		return
 	}
+	if len(appName) == 0 && len(brief) == 0 {
+		resultJSON, err = scope.filterFields(resultJSON)
+		if err == nil && len(change) > 0 {
+			var changeJSON []byte
+			changeJSON, err = scope.filterFields([]byte(change))
+			change = string(changeJSON)
+		}
+		if err != nil {
+			returnError(w, r, "internal error", 405, err, event)
+			return
+		}
+	}
 	//fmt.Printf("Full json: %s\n", resultJSON)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(200)
@@ -216,8 +234,11 @@ func (e mainEnv) approveUserRequest(w http.ResponseWriter, r *http.Request, ps h
 	}
 	if action == "forget-me" {
 		e.globalUserDelete(userTOKEN)
-		result, err := e.db.deleteUserRecord(resultJSON, userTOKEN)
+		// open requests of the user are erased, so this one is closed first
+		e.db.updateRequestStatus(request, "approved", "")
+		result, erasure, err := e.db.deleteUserRecord(resultJSON, userTOKEN, e.conf)
 		if err != nil {
+			e.db.updateRequestStatus(request, "open", "")
 			returnError(w, r, "internal error", 405, err, event)
 			return
 		}
@@ -226,8 +247,13 @@ func (e mainEnv) approveUserRequest(w http.ResponseWriter, r *http.Request, ps h
 			event.Status = "failed"
 			event.Msg = "failed to delete"
 		}
+		erasureJSON, _ := json.Marshal(erasure)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, `{"status":"ok","result":"done","erasure":%s}`, erasureJSON)
 		notifyURL := e.conf.Notification.NotificationURL
-		notifyForgetMe(notifyURL, resultJSON, "token", userTOKEN)
+		notifyForgetMe(notifyURL, resultJSON, erasure, "token", userTOKEN)
+		return
 	} else if action == "change-profile" {
 		oldJSON, newJSON, lookupErr, err := e.db.updateUserRecord(requestInfo["change"].([]uint8), userTOKEN, event, e.conf)
 		if lookupErr {
@@ -25,6 +25,17 @@ type requestEvent struct {
 }
 
 func (dbobj dbcon) saveUserRequest(action string, token string, app string, brief string, change []byte) (string, string, error) {
+	var rtoken, rstatus string
+	// lookup and insert are done in one transaction to avoid duplicate requests
+	err := dbobj.withTx(func(dbTx dbcon) error {
+		var err error
+		rtoken, rstatus, err = dbTx.saveUserRequestDo(action, token, app, brief, change)
+		return err
+	})
+	return rtoken, rstatus, err
+}
+
+func (dbobj dbcon) saveUserRequestDo(action string, token string, app string, brief string, change []byte) (string, string, error) {
 	now := int32(time.Now().Unix())
 	bdoc := bson.M{}
 	bdoc["token"] = token
@@ -37,6 +48,9 @@ func (dbobj dbcon) saveUserRequest(action string, token string, app string, brie
 		bdoc["brief"] = brief
 	}
 	record, err := dbobj.store.LookupRecord(storage.TblName.Requests, bdoc)
+	if err != nil {
+		return "", "", err
+	}
 	if record != nil {
 		fmt.Printf("This record already exists.\n")
                 return record["rtoken"].(string), "request-exists", nil
@@ -144,6 +158,8 @@ func (dbobj dbcon) getRequest(rtoken string) (bson.M, error) {
 func (dbobj dbcon) updateRequestStatus(rtoken string, status string, reason string) {
 	bdoc := bson.M{}
 	bdoc["status"] = status
+	// retention of closed requests starts from the status change
+	bdoc["when"] = int32(time.Now().Unix())
 	if len(reason) > 0 {
 		bdoc["reason"] = reason
 	}
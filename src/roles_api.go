@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// roleList returns built-in, config and saved roles
+func (e mainEnv) roleList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if e.enforceAdmin(w, r) == "" {
+		return
+	}
+	roles, err := e.listRoles()
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, nil)
+		return
+	}
+	resultJSON, err := json.Marshal(roles)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","total":%d,"rows":%s}`, len(roles), resultJSON)
+}
+
+// roleSave creates a role or replaces its rules
+func (e mainEnv) roleSave(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	event := audit("save role "+name, "", "", "")
+	defer func() { event.submit(e.db) }()
+	if e.enforceAuth(w, r, event) == "" {
+		return
+	}
+	records, err := getJSONPostData(r)
+	if err != nil || records == nil {
+		returnError(w, r, "failed to decode request body", 405, err, event)
+		return
+	}
+	role := adminRole{
+		Name:  name,
+		Allow: getListValue(records, "allow"),
+		Deny:  getListValue(records, "deny"),
+	}
+	err = e.db.saveRole(role)
+	if err != nil {
+		returnError(w, r, err.Error(), 405, err, event)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// roleDelete deletes role saved with the API, config and built-in roles are
+// used again after it
+func (e mainEnv) roleDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	event := audit("delete role "+name, "", "", "")
+	defer func() { event.submit(e.db) }()
+	if e.enforceAuth(w, r, event) == "" {
+		return
+	}
+	num, err := e.db.deleteRole(name)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	if num == 0 {
+		returnError(w, r, "role not found", 405, nil, event)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	w.Write([]byte(`{"status":"ok"}`))
+}
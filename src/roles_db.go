@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// adminRole is a named set of endpoint rules attached to service tokens.
+// Request is denied when it matches any deny rule, otherwise it must match
+// one of allow rules. Rules have the same format as token endpoints. Roles
+// saved with the API override roles from config, config overrides built-in roles.
+type adminRole struct {
+	Name   string   `json:"name" yaml:"-"`
+	Allow  []string `json:"allow" yaml:"allow"`
+	Deny   []string `json:"deny,omitempty" yaml:"deny"`
+	Source string   `json:"source" yaml:"-"`
+}
+
+var builtinRoles = map[string]adminRole{
+	// data protection officer handles user requests
+	"dpo": {Allow: []string{"/v1/request", "GET /v1/user/", "GET /v1/userapp/", "GET /v1/agreement/",
+		"GET /v1/audit/", "GET /v1/lbasis", "GET /v1/pactivity"}},
+	// support staff can read user records, but not export them
+	"support": {Allow: []string{"GET /v1/user/", "GET /v1/userapp/", "GET /v1/session/", "GET /v1/agreement/"},
+		Deny: []string{"GET /v1/user/*/*/export"}},
+	"auditor": {Allow: []string{"GET /v1/audit/", "GET /v1/requests"}},
+}
+
+func (role *adminRole) allows(r *http.Request) bool {
+	if matchEndpoints(role.Deny, r) {
+		return false
+	}
+	return matchEndpoints(role.Allow, r)
+}
+
+func (role adminRole) validate() error {
+	if regexTokenName.MatchString(role.Name) == false {
+		return errors.New("bad role name")
+	}
+	if len(role.Allow) == 0 {
+		return errors.New("role must allow at least one endpoint")
+	}
+	if err := validateEndpoints(role.Allow); err != nil {
+		return err
+	}
+	return validateEndpoints(role.Deny)
+}
+
+func roleFromRecord(record bson.M) *adminRole {
+	role := adminRole{
+		Allow:  splitList(record["allow"]),
+		Deny:   splitList(record["deny"]),
+		Source: "api",
+	}
+	role.Name, _ = record["name"].(string)
+	return &role
+}
+
+// saveRole creates or replaces role saved in the database
+func (dbobj dbcon) saveRole(role adminRole) error {
+	if err := role.validate(); err != nil {
+		return err
+	}
+	return dbobj.withTx(func(dbTx dbcon) error {
+		bdoc := bson.M{}
+		bdoc["allow"] = strings.Join(role.Allow, ",")
+		bdoc["deny"] = strings.Join(role.Deny, ",")
+		bdoc["when"] = int32(time.Now().Unix())
+		record, err := dbTx.store.GetRecord(storage.TblName.Roles, "name", role.Name)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			_, err = dbTx.store.UpdateRecord(storage.TblName.Roles, "name", role.Name, &bdoc)
+			return err
+		}
+		bdoc["name"] = role.Name
+		_, err = dbTx.store.CreateRecord(storage.TblName.Roles, &bdoc)
+		return err
+	})
+}
+
+func (dbobj dbcon) deleteRole(name string) (int64, error) {
+	return dbobj.store.DeleteRecord(storage.TblName.Roles, "name", name)
+}
+
+// findRole returns role by name from the database, config or built-in roles
+func (e mainEnv) findRole(name string) (*adminRole, error) {
+	record, err := e.db.store.GetRecord(storage.TblName.Roles, "name", name)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		return roleFromRecord(record), nil
+	}
+	if role, ok := e.conf.Roles[name]; ok {
+		role.Name = name
+		role.Source = "config"
+		return &role, nil
+	}
+	if role, ok := builtinRoles[name]; ok {
+		role.Name = name
+		role.Source = "builtin"
+		return &role, nil
+	}
+	return nil, nil
+}
+
+// listRoles returns all roles sorted by name
+func (e mainEnv) listRoles() ([]*adminRole, error) {
+	roles := make(map[string]*adminRole)
+	for name, role := range builtinRoles {
+		role := role
+		role.Name = name
+		role.Source = "builtin"
+		roles[name] = &role
+	}
+	for name, role := range e.conf.Roles {
+		role := role
+		role.Name = name
+		role.Source = "config"
+		roles[name] = &role
+	}
+	records, err := e.db.store.GetList0(storage.TblName.Roles, 0, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		role := roleFromRecord(record)
+		roles[role.Name] = role
+	}
+	var names []string
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := []*adminRole{}
+	for _, name := range names {
+		result = append(result, roles[name])
+	}
+	return result, nil
+}
+
+// authorize checks token scope and role of the request. It is used by
+// enforceAuth and enforceAdmin for all tokens, root and user login tokens
+// have no scope.
+func (e mainEnv) authorize(authResult tokenAuthResult, r *http.Request) bool {
+	scope := authResult.scope
+	if scope.allows(r) == false {
+		return false
+	}
+	if scope == nil || len(scope.Role) == 0 {
+		return true
+	}
+	role, err := e.findRole(scope.Role)
+	if err != nil || role == nil {
+		return false
+	}
+	return role.allows(r)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// number of records re-encrypted between progress updates
+const rotationBatch = 50
+
+// newRotationDB returns dbcon object. When oldMasterKey is set, records
+// encrypted with the old key can still be read until rotation is done.
+func newRotationDB(store storage.Storage, masterKey []byte, oldMasterKey []byte) *dbcon {
+	hash := md5.Sum(masterKey)
+	db := &dbcon{store: store, masterKey: masterKey, hash: hash[:], indexKey: deriveIndexKey(masterKey)}
+	if len(oldMasterKey) > 0 && bytes.Equal(oldMasterKey, masterKey) == false {
+		oldHash := md5.Sum(oldMasterKey)
+		db.oldMasterKey = oldMasterKey
+		db.oldHash = oldHash[:]
+		db.oldIndexKey = deriveIndexKey(oldMasterKey)
+	}
+	return db
+}
+
+// batchPhase is one table walked by runBatchJob
+type batchPhase struct {
+	name string
+	tbl  storage.Tbl
+	key  string
+	fn   func(record bson.M) error
+}
+
+// runBatchJob calls fn of every phase for all records of the phase table
+// ordered by key. Progress is saved in keyrotation table after every batch,
+// so the job continues from the same place after restart. It returns true
+// when all phases are done and false when stop channel is closed.
+func (dbobj dbcon) runBatchJob(title string, phases []batchPhase, stop chan struct{}) (bool, error) {
+	keyhash := hashString(dbobj.hash, title)
+	state, err := dbobj.store.GetRecord(storage.TblName.Keyrotation, "keyhash", keyhash)
+	if err != nil {
+		return false, err
+	}
+	phase := phases[0].name
+	lastkey := ""
+	if state == nil {
+		bdoc := bson.M{"phase": phase, "lastkey": lastkey, "keyhash": keyhash, "when": int32(time.Now().Unix())}
+		_, err = dbobj.store.CreateRecord(storage.TblName.Keyrotation, &bdoc)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		phase = state["phase"].(string)
+		lastkey = state["lastkey"].(string)
+	}
+	current := len(phases)
+	for i, p := range phases {
+		if p.name == phase {
+			current = i
+		}
+	}
+	if current == len(phases) {
+		return true, nil
+	}
+	log.Printf("%s, phase: %s, last key: %s\n", title, phase, lastkey)
+	for current < len(phases) {
+		select {
+		case <-stop:
+			log.Printf("%s stopped\n", title)
+			return false, nil
+		default:
+		}
+		p := phases[current]
+		records, err := dbobj.store.GetListAfter(p.tbl, p.key, lastkey, rotationBatch)
+		if err != nil {
+			return false, err
+		}
+		for _, record := range records {
+			lastkey = record[p.key].(string)
+			err = p.fn(record)
+			if err != nil {
+				return false, err
+			}
+		}
+		if len(records) < rotationBatch {
+			current++
+			phase = "done"
+			if current < len(phases) {
+				phase = phases[current].name
+			}
+			lastkey = ""
+		}
+		bdoc := bson.M{"phase": phase, "lastkey": lastkey, "when": int32(time.Now().Unix())}
+		_, err = dbobj.store.UpdateRecord(storage.TblName.Keyrotation, "keyhash", keyhash, &bdoc)
+		if err != nil {
+			return false, err
+		}
+	}
+	log.Printf("%s is done\n", title)
+	return true, nil
+}
+
+func (dbobj dbcon) rotationEnabled() bool {
+	return len(dbobj.oldMasterKey) > 0
+}
+
+// decryptRecord decrypts record data, it falls back to the old master key during rotation
+func (dbobj dbcon) decryptRecord(recordKey []byte, data []byte) ([]byte, error) {
+	if _, keyID := ciphertextInfo(data); keyID != nil && dbobj.rotationEnabled() &&
+		bytes.Equal(keyID, masterKeyID(dbobj.oldMasterKey)) {
+		// header shows the record is not re-encrypted yet
+		return decrypt(dbobj.oldMasterKey, recordKey, data)
+	}
+	decrypted, err := decrypt(dbobj.masterKey, recordKey, data)
+	if err != nil && dbobj.rotationEnabled() {
+		return decrypt(dbobj.oldMasterKey, recordKey, data)
+	}
+	return decrypted, err
+}
+
+// decryptString decrypts audit fields, it falls back to the old master key during rotation
+func (dbobj dbcon) decryptString(data string) (string, error) {
+	result, err := basicStringDecrypt(data, dbobj.masterKey, dbobj.GetCode())
+	if err != nil && dbobj.rotationEnabled() {
+		return basicStringDecrypt(data, dbobj.oldMasterKey, dbobj.oldHash[4:12])
+	}
+	return result, err
+}
+
+// reencryptValue moves base64 encoded record data from the old master key to the current one.
+// It returns false if value is already encrypted with the current key.
+func (dbobj dbcon) reencryptValue(recordKey []byte, value string) (string, bool, error) {
+	encData, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", false, err
+	}
+	if len(encData) <= 12 {
+		return "", false, errors.New("bad encrypted value")
+	}
+	if _, err = decrypt(dbobj.masterKey, recordKey, encData); err == nil {
+		return value, false, nil
+	}
+	decrypted, err := decrypt(dbobj.oldMasterKey, recordKey, encData)
+	if err != nil {
+		return "", false, err
+	}
+	encoded, err := encrypt(dbobj.masterKey, recordKey, decrypted)
+	if err != nil {
+		return "", false, err
+	}
+	return base64.StdEncoding.EncodeToString(encoded), true, nil
+}
+
+// masterKeyRotationTitle is the name of rotation job in keyrotation table
+const masterKeyRotationTitle = "master key rotation"
+
+// masterKeyRotationDone returns true when rotation to masterKey is finished
+func masterKeyRotationDone(store storage.Storage, masterKey []byte) (bool, error) {
+	hash := md5.Sum(masterKey)
+	state, err := store.GetRecord(storage.TblName.Keyrotation, "keyhash", hashString(hash[:], masterKeyRotationTitle))
+	if err != nil || state == nil {
+		return false, err
+	}
+	return state["phase"].(string) == "done", nil
+}
+
+// rotateMasterKey re-encrypts users, app records, sessions, requests and audit
+// with the current master key. Progress is saved after every batch, so the job
+// continues from the same place after restart. It returns when done or when
+// stop channel is closed.
+func (dbobj dbcon) rotateMasterKey(defaultCountry string, stop chan struct{}) error {
+	if dbobj.rotationEnabled() == false {
+		return errors.New("old master key is missing or equal to the new key")
+	}
+	title := masterKeyRotationTitle
+	state, err := dbobj.store.GetRecord(storage.TblName.Keyrotation, "keyhash", hashString(dbobj.hash, title))
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		// progress of the rotation to a different key is not relevant anymore
+		old, err := dbobj.store.GetList0(storage.TblName.Keyrotation, 0, 0, "")
+		if err != nil {
+			return err
+		}
+		for _, record := range old {
+			dbobj.store.DeleteRecord(storage.TblName.Keyrotation, "keyhash", record["keyhash"].(string))
+		}
+	} else if state["phase"].(string) == "done" {
+		return nil
+	}
+	userApps, err := dbobj.listAllAppsOnly()
+	if err != nil {
+		return err
+	}
+	phases := []batchPhase{
+		{"users", storage.TblName.Users, "token", func(record bson.M) error {
+			return dbobj.rotateUserRecord(record, userApps, defaultCountry)
+		}},
+		{"agreements", storage.TblName.Agreements, "who", dbobj.rotateAgreementRecord},
+		{"audit", storage.TblName.Audit, "atoken", dbobj.rotateAuditRecord},
+	}
+	done, err := dbobj.runBatchJob(title, phases, stop)
+	if err != nil || done == false {
+		return err
+	}
+	// shares of the old key can not unseal database anymore
+	config, err := getSealConfig(dbobj.store)
+	if err != nil {
+		return err
+	}
+	if config != nil {
+		err = dbobj.saveSealConfig(config["shares"].(int32), config["threshold"].(int32))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateUserRecord re-encrypts user profile with all linked records and
+// recalculates login, email and phone index hashes
+func (dbobj dbcon) rotateUserRecord(userBson bson.M, userApps []string, defaultCountry string) error {
+	userTOKEN := userBson["token"].(string)
+	recordKey, err := dbobj.userRecordKey(userBson)
+	if err != nil {
+		return err
+	}
+	if recordKey == nil {
+		// user record was deleted
+		return nil
+	}
+	return dbobj.withTx(func(dbTx dbcon) error {
+		encData0, _ := userBson["data"].(string)
+		if len(encData0) > 0 {
+			err := dbTx.rotateUserProfile(userBson, recordKey, defaultCountry)
+			if err != nil {
+				return fmt.Errorf("user %s: %s", userTOKEN, err)
+			}
+		}
+		for _, appName := range userApps {
+			record, err := dbTx.store.GetRecordInTable("app_"+appName, "token", userTOKEN)
+			if err != nil {
+				return err
+			}
+			if record == nil {
+				continue
+			}
+			encoded, changed, err := dbTx.reencryptValue(recordKey, record["data"].(string))
+			if err != nil {
+				return fmt.Errorf("user %s app %s: %s", userTOKEN, appName, err)
+			}
+			if changed {
+				bdoc := bson.M{"data": encoded}
+				_, err = dbTx.store.UpdateRecordInTable("app_"+appName, "token", userTOKEN, &bdoc)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		sessions, err := dbTx.store.GetList(storage.TblName.Sessions, "token", userTOKEN, 0, 0, "")
+		if err != nil {
+			return err
+		}
+		for _, record := range sessions {
+			encoded, changed, err := dbTx.reencryptValue(recordKey, record["data"].(string))
+			if err != nil {
+				return fmt.Errorf("user %s session: %s", userTOKEN, err)
+			}
+			if changed {
+				bdoc := bson.M{"data": encoded}
+				_, err = dbTx.store.UpdateRecord(storage.TblName.Sessions, "session", record["session"].(string), &bdoc)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		requests, err := dbTx.store.GetList(storage.TblName.Requests, "token", userTOKEN, 0, 0, "")
+		if err != nil {
+			return err
+		}
+		for _, record := range requests {
+			change := ""
+			switch value := record["change"].(type) {
+			case string:
+				change = value
+			case []uint8:
+				change = string(value)
+			}
+			if len(change) == 0 {
+				continue
+			}
+			encoded, changed, err := dbTx.reencryptValue(recordKey, change)
+			if err != nil {
+				return fmt.Errorf("user %s request: %s", userTOKEN, err)
+			}
+			if changed {
+				bdoc := bson.M{"change": encoded}
+				_, err = dbTx.store.UpdateRecord(storage.TblName.Requests, "rtoken", record["rtoken"].(string), &bdoc)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (dbobj dbcon) rotateUserProfile(userBson bson.M, recordKey []byte, defaultCountry string) error {
+	userTOKEN := userBson["token"].(string)
+	encData, err := base64.StdEncoding.DecodeString(userBson["data"].(string))
+	if err != nil {
+		return err
+	}
+	if _, err = decrypt(dbobj.masterKey, recordKey, encData); err == nil {
+		// already rotated or changed after rotation was started
+		return nil
+	}
+	decrypted, err := decrypt(dbobj.oldMasterKey, recordKey, encData)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	err = json.Unmarshal(decrypted, &raw)
+	if err != nil {
+		return err
+	}
+	bdoc := bson.M{}
+	bdel := bson.M{}
+	dbobj.rebuildUserIndexes(userBson, raw, defaultCountry, bdoc, bdel)
+	encoded, err := encrypt(dbobj.masterKey, recordKey, decrypted)
+	if err != nil {
+		return err
+	}
+	encodedStr := base64.StdEncoding.EncodeToString(encoded)
+	bdoc["data"] = encodedStr
+	md5Hash := md5.Sum([]byte(encodedStr))
+	bdoc["md5"] = base64.StdEncoding.EncodeToString(md5Hash[:])
+	// md5 filter makes sure the record was not changed in the meantime,
+	// in that case it is already encrypted with the new key
+	result, err := dbobj.store.UpdateRecord2(storage.TblName.Users, "token", userTOKEN, "md5", userBson["md5"].(string), &bdoc, &bdel)
+	if err != nil || result == 0 {
+		return err
+	}
+	return dbobj.saveSearchIndexes(userTOKEN, searchIndexValues(raw))
+}
+
+// rotateAgreementRecord re-encrypts address of the consent-giver and
+// recalculates its blind index. All agreements of the address are updated at
+// once. Agreements with plaintext address are left to the migration job.
+func (dbobj dbcon) rotateAgreementRecord(record bson.M) error {
+	whoidx, _ := record["whoidx"].(string)
+	if len(whoidx) == 0 {
+		return nil
+	}
+	who := record["who"].(string)
+	usercode, err := dbobj.decryptString(who)
+	if err != nil {
+		return err
+	}
+	if whoidx == hashIndex(dbobj.indexKey, "who", usercode) {
+		// already rotated
+		return nil
+	}
+	bdoc := bson.M{}
+	err = dbobj.setAgreementWho(bdoc, usercode)
+	if err != nil {
+		return err
+	}
+	_, err = dbobj.store.UpdateRecord(storage.TblName.Agreements, "who", who, &bdoc)
+	return err
+}
+
+// rotateAuditRecord re-encrypts audit who and record fields and
+// before/after copies of the user record
+func (dbobj dbcon) rotateAuditRecord(record bson.M) error {
+	bdoc := bson.M{}
+	userTOKEN := dbobj.upgradeAuditFields(record, bdoc)
+	if len(userTOKEN) > 0 {
+		userBson, err := dbobj.lookupUserRecord(userTOKEN)
+		if err != nil {
+			return err
+		}
+		var recordKey []byte
+		if userBson != nil {
+			recordKey, _ = dbobj.userRecordKey(userBson)
+		}
+		for _, field := range []string{"before", "after"} {
+			value, _ := record[field].(string)
+			if len(value) == 0 || len(recordKey) == 0 {
+				continue
+			}
+			encoded, changed, err := dbobj.reencryptValue(recordKey, value)
+			if err == nil && changed {
+				bdoc[field] = encoded
+			}
+		}
+	}
+	if len(bdoc) == 0 {
+		return nil
+	}
+	_, err := dbobj.store.UpdateRecord(storage.TblName.Audit, "atoken", record["atoken"].(string), &bdoc)
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMasterKeyRotation(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"rotateuser","email":"rotate@user.com","name":"rotate"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	raw, err = helpCreateUserApp(userTOKEN, "rotateapp", `{"shoe-size":42}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user app: %v", raw)
+	}
+	raw, err = helpCreateSession("token", userTOKEN, `{"expiration":"1d","cookie":"rotate"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create session: %v", raw)
+	}
+	sessionTOKEN := raw["session"].(string)
+	oldKey := e.db.masterKey
+	newKey, _ := generateMasterKey()
+
+	// half rotated database is readable using both keys
+	db := newRotationDB(e.db.store, newKey, oldKey)
+	user, _, err := db.getUserIndex("rotate@user.com", "email", e.conf)
+	if err != nil || strings.Contains(string(user), "rotateuser") == false {
+		t.Fatalf("failed to read user during rotation: %s", err)
+	}
+	err = db.rotateMasterKey("", nil)
+	if err != nil {
+		t.Fatalf("failed to rotate master key: %s", err)
+	}
+
+	// old key is not needed after rotation
+	db = newRotationDB(e.db.store, newKey, nil)
+	user, _, err = db.getUserIndex("rotate@user.com", "email", e.conf)
+	if err != nil || strings.Contains(string(user), "rotateuser") == false {
+		t.Fatalf("failed to read user after rotation: %s", err)
+	}
+	app, err := db.getUserApp(userTOKEN, "rotateapp")
+	if err != nil || strings.Contains(string(app), "shoe-size") == false {
+		t.Fatalf("failed to read app record after rotation: %s", err)
+	}
+	_, session, _, err := db.getUserSession(sessionTOKEN)
+	if err != nil || strings.Contains(string(session), "rotate") == false {
+		t.Fatalf("failed to read session after rotation: %s", err)
+	}
+	events, _, err := db.getAuditEvents(userTOKEN, 0, 10)
+	if err != nil || strings.Contains(string(events), "create user record") == false {
+		t.Fatalf("failed to read audit after rotation: %s", err)
+	}
+	if _, err = e.db.getUserApp(userTOKEN, "rotateapp"); err == nil {
+		t.Fatalf("record is still encrypted with the old key\n")
+	}
+
+	// rotate back, so other tests can use the original key
+	err = newRotationDB(e.db.store, oldKey, newKey).rotateMasterKey("", nil)
+	if err != nil {
+		t.Fatalf("failed to rotate master key back: %s", err)
+	}
+	raw, err = helpGetUser("login", "rotateuser")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to read user after second rotation: %v", raw)
+	}
+}
+
+func TestProviderRotationTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "databunker-rotation")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	raw, err := helpCreateUser(`{"login":"twiceuser","email":"twice@user.com","name":"twice"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	var cfg Config
+	cfg.KeyProvider.Type = "file"
+	cfg.KeyProvider.File = filepath.Join(dir, "masterkey.json")
+	cfg.KeyProvider.Passphrase = "correct horse battery staple"
+	keys, _ := newKeyProvider(cfg, nil)
+	keys.StoreKey(e.db.masterKey)
+	currentKey := e.db.masterKey
+	for i := 0; i < 2; i++ {
+		oldKey, newKey, err := providerRotationKeys(keys, e.db.store)
+		if err != nil || bytes.Equal(oldKey, currentKey) == false || bytes.Equal(newKey, currentKey) {
+			t.Fatalf("rotation %d did not start with a new key: %s", i, err)
+		}
+		if err = newRotationDB(e.db.store, newKey, oldKey).rotateMasterKey("", nil); err != nil {
+			t.Fatalf("rotation %d failed: %s", i, err)
+		}
+		currentKey = newKey
+	}
+	previous, _ := previousMasterKey(keys)
+	if bytes.Equal(previous, e.db.masterKey) {
+		t.Fatalf("previous key file is not replaced by the second rotation\n")
+	}
+	user, err := newRotationDB(e.db.store, currentKey, nil).getUser(userTOKEN)
+	if err != nil || strings.Contains(string(user), "twiceuser") == false {
+		t.Fatalf("failed to read user after two rotations: %s", err)
+	}
+
+	// rotate back, so other tests can use the original key
+	err = newRotationDB(e.db.store, e.db.masterKey, currentKey).rotateMasterKey("", nil)
+	if err != nil {
+		t.Fatalf("failed to rotate master key back: %s", err)
+	}
+	helpDeleteUser("token", userTOKEN)
+}
@@ -77,9 +77,8 @@ func (dbobj dbcon) getUserSessionsByToken(userTOKEN string, offset int32, limit
 		// not found
 		return nil, 0, err
 	}
-	userKey := userBson["key"].(string)
-	recordKey, err := base64.StdEncoding.DecodeString(userKey)
-	if err != nil {
+	recordKey, err := dbobj.userRecordKey(userBson)
+	if err != nil || recordKey == nil {
 		return nil, 0, err
 	}
 
@@ -99,7 +98,7 @@ func (dbobj dbcon) getUserSessionsByToken(userTOKEN string, offset int32, limit
 		session := element["session"].(string)
 		encData0 := element["data"].(string)
 		encData, _ := base64.StdEncoding.DecodeString(encData0)
-		decrypted, _ := decrypt(dbobj.masterKey, recordKey, encData)
+		decrypted, _ := dbobj.decryptRecord(recordKey, encData)
 		sEvent := fmt.Sprintf(`{"when":%d,"session":"%s","data":%s}`, when, session, string(decrypted))
 		results = append(results, sEvent)
 	}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// Shamir secret sharing over GF(2^8), the same scheme as in
+// https://github.com/hashicorp/vault/tree/master/shamir
+// Every share is the secret length plus one trailing byte with x coordinate.
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	// generator 3 with AES reduction polynomial x^8 + x^4 + x^3 + x + 1
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfExp[i+255] = x
+		gfLog[x] = byte(i)
+		x = gfMulSlow(x, 3)
+	}
+}
+
+func gfMulSlow(a byte, b byte) byte {
+	var result byte
+	for b > 0 {
+		if b&1 == 1 {
+			result ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return result
+}
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a byte, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// splitSecret splits secret into parts shares, any threshold of them restore it
+func splitSecret(secret []byte, parts int, threshold int) ([][]byte, error) {
+	if threshold < 2 || parts < threshold || parts > 255 {
+		return nil, errors.New("shares must be between threshold and 255, threshold at least 2")
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("secret is empty")
+	}
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coefficients := make([]byte, threshold)
+	for idx, value := range secret {
+		coefficients[0] = value
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			// evaluate polynomial using Horner's method
+			x := shares[i][len(secret)]
+			var y byte
+			for j := threshold - 1; j >= 0; j-- {
+				y = gfMul(y, x) ^ coefficients[j]
+			}
+			shares[i][idx] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineShares restores secret using Lagrange interpolation at x=0
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are required")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("share is too short")
+	}
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, errors.New("shares have different length")
+		}
+		xs[i] = share[size-1]
+		if xs[i] == 0 {
+			return nil, errors.New("bad share")
+		}
+		for j := 0; j < i; j++ {
+			if xs[j] == xs[i] {
+				return nil, errors.New("duplicate share")
+			}
+		}
+	}
+	secret := make([]byte, size-1)
+	for idx := range secret {
+		var value byte
+		for i := range shares {
+			basis := byte(1)
+			for j := range shares {
+				if i != j {
+					basis = gfMul(basis, gfDiv(xs[j], xs[j]^xs[i]))
+				}
+			}
+			value ^= gfMul(shares[i][idx], basis)
+		}
+		secret[idx] = value
+	}
+	return secret, nil
+}
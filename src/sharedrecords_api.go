@@ -60,10 +60,29 @@ func (e mainEnv) newSharedRecord(w http.ResponseWriter, r *http.Request, ps http
 			appName = strings.ToLower(value.(string))
 			if len(appName) > 0 && isValidApp(appName) == false {
 				returnError(w, r, "unknown app name", 405, nil, event)
+				return
 			}
 		} else {
 			// type is different
 			returnError(w, r, "failed to parse app field", 405, nil, event)
+			return
+		}
+	}
+	// shared record is read without token, so it is limited to the token scope here
+	scope := requestScope(r)
+	if len(appName) > 0 && scope.allowsApp(appName) == false {
+		returnError(w, r, "app is not allowed by token scope", 403, nil, event)
+		return
+	}
+	if len(appName) == 0 && len(session) == 0 && scope != nil && len(scope.Fields) > 0 {
+		var allFields []string
+		if len(fields) > 0 {
+			allFields = parseFields(fields)
+		}
+		fields = strings.Join(scope.limitFields(allFields), ",")
+		if len(fields) == 0 {
+			returnError(w, r, "field is not allowed by token scope", 403, nil, event)
+			return
 		}
 	}
 	if len(expiration) == 0 {
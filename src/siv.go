@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// AES-SIV deterministic authenticated encryption, RFC 5297.
+// Key is 32, 48 or 64 bytes: first half is used for S2V (AES-CMAC),
+// second half for AES-CTR. Output is 16 bytes synthetic IV + ciphertext.
+
+func sivDouble(block []byte) []byte {
+	result := make([]byte, len(block))
+	var carry byte
+	for i := len(block) - 1; i >= 0; i-- {
+		result[i] = block[i]<<1 | carry
+		carry = block[i] >> 7
+	}
+	if carry != 0 {
+		result[len(result)-1] ^= 0x87
+	}
+	return result
+}
+
+func sivXor(dst []byte, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// aesCMAC computes AES-CMAC, RFC 4493
+func aesCMAC(block cipher.Block, data []byte) []byte {
+	size := block.BlockSize()
+	subkey := make([]byte, size)
+	block.Encrypt(subkey, subkey)
+	k1 := sivDouble(subkey)
+	k2 := sivDouble(k1)
+	last := make([]byte, size)
+	n := (len(data) + size - 1) / size
+	if n > 0 && len(data)%size == 0 {
+		copy(last, data[(n-1)*size:])
+		sivXor(last, k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		rest := data[(n-1)*size:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		sivXor(last, k2)
+	}
+	x := make([]byte, size)
+	for i := 0; i < n-1; i++ {
+		sivXor(x, data[i*size:(i+1)*size])
+		block.Encrypt(x, x)
+	}
+	sivXor(x, last)
+	block.Encrypt(x, x)
+	return x
+}
+
+func sivS2V(block cipher.Block, plaintext []byte, additional [][]byte) []byte {
+	d := aesCMAC(block, make([]byte, aes.BlockSize))
+	for _, ad := range additional {
+		d = sivDouble(d)
+		sivXor(d, aesCMAC(block, ad))
+	}
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = append([]byte{}, plaintext...)
+		sivXor(t[len(t)-aes.BlockSize:], d)
+	} else {
+		t = sivDouble(d)
+		padded := make([]byte, aes.BlockSize)
+		copy(padded, plaintext)
+		padded[len(plaintext)] = 0x80
+		sivXor(t, padded)
+	}
+	return aesCMAC(block, t)
+}
+
+func sivCTR(key []byte, v []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	q := append([]byte{}, v...)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	result := make([]byte, len(data))
+	cipher.NewCTR(block, q).XORKeyStream(result, data)
+	return result, nil
+}
+
+func sivEncrypt(key []byte, plaintext []byte, additional ...[]byte) ([]byte, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, errors.New("bad AES-SIV key length")
+	}
+	macBlock, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	v := sivS2V(macBlock, plaintext, additional)
+	ciphertext, err := sivCTR(key[len(key)/2:], v, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append(v, ciphertext...), nil
+}
+
+func sivDecrypt(key []byte, data []byte, additional ...[]byte) ([]byte, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, errors.New("bad AES-SIV key length")
+	}
+	if len(data) < aes.BlockSize {
+		return nil, errors.New("ciphertext is too short")
+	}
+	macBlock, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	v := data[:aes.BlockSize]
+	plaintext, err := sivCTR(key[len(key)/2:], v, data[aes.BlockSize:])
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(v, sivS2V(macBlock, plaintext, additional)) != 1 {
+		return nil, errors.New("message authentication failed")
+	}
+	return plaintext, nil
+}
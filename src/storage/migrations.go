@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration describes a single schema upgrade step
+type migration struct {
+	version int
+	title   string
+	apply   func(tx *sql.Tx) error
+}
+
+// schemaMigrations is an ordered list of schema upgrade steps.
+// New steps are appended at the end with the next version number.
+// Every step must work both with SQLite and PostgreSQL.
+var schemaMigrations = []migration{
+	{1, "initial schema", func(tx *sql.Tx) error {
+		return nil
+	}},
+	{2, "master key rotation progress", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS keyrotation (
+					  phase TEXT,
+					  lastkey TEXT,
+					  keyhash TEXT,
+					  "when" INTEGER);`)
+		return err
+	}},
+	{3, "master key shares configuration", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS sealconfig (
+					  shares INTEGER,
+					  threshold INTEGER,
+					  keycheck TEXT,
+					  "when" INTEGER);`)
+		return err
+	}},
+	{4, "users blind index version", addColumn("users", "idxver", "INTEGER")},
+	{5, "xtokens blind index version", addColumn("xtokens", "idxver", "INTEGER")},
+	{6, "search field indexes", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS userindexes (
+					  token TEXT,
+					  field TEXT,
+					  idx TEXT);`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS userindexes_token ON userindexes (token);`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS userindexes_idx ON userindexes (idx);`)
+		return err
+	}},
+	{7, "user creation time", addColumn("users", "created", "INTEGER")},
+	{8, "user deletion time", addColumn("users", "deleted", "INTEGER")},
+	{9, "user data keys", createUserkeys},
+	{10, "agreements blind index of who", func(tx *sql.Tx) error {
+		err := addColumn("agreements", "whoidx", "TEXT")(tx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS agreements_whoidx ON agreements (whoidx);`)
+		return err
+	}},
+	{11, "named service tokens", func(tx *sql.Tx) error {
+		for _, column := range []string{"name", "access", "endpoints"} {
+			if err := addColumn("xtokens", column, "TEXT")(tx); err != nil {
+				return err
+			}
+		}
+		return addColumn("xtokens", "when", "INTEGER")(tx)
+	}},
+	{12, "admin roles", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS roles (
+					  name TEXT,
+					  allow TEXT,
+					  deny TEXT,
+					  "when" INTEGER);`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS roles_name ON roles (name);`)
+		if err != nil {
+			return err
+		}
+		return addColumn("xtokens", "role", "TEXT")(tx)
+	}},
+	{13, "login token families", addColumn("xtokens", "family", "TEXT")},
+	{14, "user login attempts", func(tx *sql.Tx) error {
+		err := addColumn("users", "loginfails", "INTEGER")(tx)
+		if err != nil {
+			return err
+		}
+		return addColumn("users", "loginlock", "INTEGER")(tx)
+	}},
+}
+
+// createUserkeys creates table of user data keys, it is also used to
+// recreate the table when backup without it is restored
+func createUserkeys(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS userkeys (
+				  token TEXT,
+				  key TEXT,
+				  kek TEXT,
+				  "when" INTEGER);`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS userkeys_token ON userkeys (token);`)
+	return err
+}
+
+// migrationLockID is PostgreSQL advisory lock key taken while migrations
+// are applied
+const migrationLockID = 4171520375
+
+func initMigrations(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS migrations (
+				  version INTEGER,
+				  title TEXT,
+				  "when" INTEGER);`)
+	return err
+}
+
+// schemaVersion returns latest applied migration version
+func schemaVersion(tx *sql.Tx) (int, error) {
+	var version sql.NullInt64
+	err := tx.QueryRow("select max(version) from migrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// addColumn returns migration step that adds a new column to the table
+func addColumn(table string, column string, ctype string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + escapeName(column) + " " + ctype)
+		return err
+	}
+}
+
+// migrateDB applies pending migrations in a single transaction. Several
+// instances can start with the same PostgreSQL database, so the transaction
+// takes an advisory lock and schema version is read after it. Instance that
+// waited for the lock finds migrations already applied.
+func migrateDB(db *sql.DB, postgres bool, dryRun bool) ([]string, error) {
+	var result []string
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if postgres {
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = initMigrations(tx)
+	if err != nil {
+		return nil, err
+	}
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range schemaMigrations {
+		if m.version <= version {
+			continue
+		}
+		title := fmt.Sprintf("%d: %s", m.version, m.title)
+		result = append(result, title)
+		if dryRun {
+			continue
+		}
+		fmt.Printf("Applying schema migration %s\n", title)
+		err = m.apply(tx)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s failed: %s", title, err)
+		}
+		_, err = tx.Exec(`insert into migrations (version, title, "when") values ($1,$2,$3)`,
+			m.version, m.title, int32(time.Now().Unix()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dryRun {
+		return result, nil
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
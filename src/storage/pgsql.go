@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	_ "github.com/lib/pq" // load postgresql driver here
+)
+
+// PGSQLStorage struct is used to store PostgreSQL database object
+type PGSQLStorage struct {
+	sqlStorage
+}
+
+func pgsqlExists(dburl string) bool {
+	db, err := sql.Open("postgres", dburl)
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	var count int
+	q := "select count(*) from information_schema.tables where table_schema=current_schema() AND table_name='users'"
+	err = db.QueryRow(q).Scan(&count)
+	if err != nil {
+		fmt.Printf("error checking postgresql database: %s\n", err)
+		return false
+	}
+	return count > 0
+}
+
+func pgsqlConnect(dburl string) *sql.DB {
+	db, err := sql.Open("postgres", dburl)
+	if err != nil {
+		log.Fatalf("Failed to open postgresql connection: %s", err)
+	}
+	err = db.Ping()
+	if err != nil {
+		log.Fatalf("Error on opening database connection: %s", err.Error())
+	}
+	return db
+}
+
+// pgsqlSafeURL hides password part of the connection URL
+func pgsqlSafeURL(dburl string) string {
+	start := strings.Index(dburl, "://")
+	end := strings.LastIndex(dburl, "@")
+	if start < 0 || end < start {
+		return dburl
+	}
+	return dburl[:start+3] + "****" + dburl[end:]
+}
+
+func openPGSQL(dburl string) (Storage, error) {
+	fmt.Printf("Databunker postgresql db is: %s\n", pgsqlSafeURL(dburl))
+	db := pgsqlConnect(dburl)
+	dbobj := PGSQLStorage{sqlStorage{db: db}}
+
+	// load all table names
+	q := "select table_name from information_schema.tables where table_schema=current_schema()"
+	rows, err := dbobj.db.Query(q)
+	if err != nil {
+		return dbobj, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := ""
+		rows.Scan(&t)
+		knownApps = append(knownApps, t)
+	}
+	fmt.Printf("tables: %s\n", knownApps)
+	_, err = migrateDB(dbobj.db, true, false)
+	return dbobj, err
+}
+
+func initPGSQL(dburl string) (Storage, error) {
+	fmt.Printf("Init Databunker postgresql db: %s\n", pgsqlSafeURL(dburl))
+	db := pgsqlConnect(dburl)
+	dbobj := PGSQLStorage{sqlStorage{db: db}}
+	for _, queries := range pgsqlTables {
+		err := execQueries(dbobj.db, queries)
+		if err != nil {
+			return dbobj, err
+		}
+	}
+	_, err := migrateDB(dbobj.db, true, false)
+	return dbobj, err
+}
+
+// BackupDB function is not supported for PostgreSQL, use pg_dump instead
+func (dbobj PGSQLStorage) BackupDB(w io.Writer) error {
+	return errors.New("backup is not supported for postgresql, use pg_dump")
+}
+
+// RestoreDB function is not supported for PostgreSQL, use pg_restore instead
+func (dbobj PGSQLStorage) RestoreDB(dump []byte) error {
+	return errors.New("restore is not supported for postgresql, use pg_restore")
+}
+
+// WithTx runs fn inside a single serializable database transaction
+func (dbobj PGSQLStorage) WithTx(fn func(tx Storage) error) error {
+	opts := &sql.TxOptions{Isolation: sql.LevelSerializable}
+	return dbobj.withTx(opts, func(s sqlStorage) Storage { return PGSQLStorage{s} }, fn)
+}
+
+// GetAllTables returns app tables found in database. Database can be shared
+// by several Databunker instances, so tables created by other instances are
+// loaded from information_schema and not from the cache.
+func (dbobj PGSQLStorage) GetAllTables() ([]string, error) {
+	q := `select table_name from information_schema.tables where table_schema=current_schema() AND table_name LIKE 'app\_%' ORDER BY table_name`
+	tx, err := dbobj.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		t := ""
+		if err = rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// IndexNewApp creates a new app table and creates indexes for it.
+func (dbobj PGSQLStorage) IndexNewApp(appName string) {
+	if contains(knownApps, appName) == false {
+		// it is a new app, create an index
+		fmt.Printf("This is a new app, creating table & index for: %s\n", appName)
+		queries := []string{"CREATE TABLE IF NOT EXISTS " + appName + ` (
+			token TEXT,
+			md5 TEXT,
+			rofields TEXT,
+			data TEXT,
+			status TEXT,
+			"when" INTEGER);`,
+			"CREATE INDEX IF NOT EXISTS " + appName + "_token ON " + appName + " (token);"}
+		err := execQueries(dbobj.db, queries)
+		if err == nil {
+			knownApps = append(knownApps, appName)
+		}
+	}
+	return
+}
+
+var pgsqlTables = [][]string{
+	{`CREATE TABLE IF NOT EXISTS users (
+			  token TEXT,
+			  key TEXT,
+			  md5 TEXT,
+			  loginidx TEXT,
+			  emailidx TEXT,
+			  phoneidx TEXT,
+			  rofields TEXT,
+			  tempcodeexp INTEGER,
+			  tempcode INTEGER,
+			  data TEXT
+			);`,
+		`CREATE INDEX IF NOT EXISTS users_token ON users (token);`,
+		`CREATE INDEX IF NOT EXISTS users_login ON users (loginidx);`,
+		`CREATE INDEX IF NOT EXISTS users_email ON users (emailidx);`,
+		`CREATE INDEX IF NOT EXISTS users_phone ON users (phoneidx);`},
+	{`CREATE TABLE IF NOT EXISTS xtokens (
+				  xtoken TEXT,
+				  token TEXT,
+				  type TEXT,
+				  app TEXT,
+				  fields TEXT,
+				  endtime INTEGER
+				);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS xtokens_xtoken ON xtokens (xtoken);`,
+		`CREATE INDEX IF NOT EXISTS xtokens_uniq ON xtokens (token, type);`},
+	{`CREATE TABLE IF NOT EXISTS audit (
+				  atoken TEXT,
+				  identity TEXT,
+				  record TEXT,
+				  who TEXT,
+				  mode TEXT,
+				  app TEXT,
+				  title TEXT,
+				  status TEXT,
+				  msg TEXT,
+				  debug TEXT,
+				  before TEXT,
+				  after TEXT,
+				  "when" INTEGER);`,
+		`CREATE INDEX IF NOT EXISTS audit_atoken ON audit (atoken);`,
+		`CREATE INDEX IF NOT EXISTS audit_record ON audit (record);`},
+	{`CREATE TABLE IF NOT EXISTS sessions (
+				  token TEXT,
+				  session TEXT,
+				  data TEXT,
+				  endtime INTEGER,
+				  "when" INTEGER);`,
+		`CREATE INDEX IF NOT EXISTS sessions_token ON sessions (token);`,
+		`CREATE INDEX IF NOT EXISTS sessions_session ON sessions (session);`},
+	{`CREATE TABLE IF NOT EXISTS requests (
+				  rtoken TEXT,
+				  token TEXT,
+				  app TEXT,
+				  brief TEXT,
+				  action TEXT,
+				  status TEXT,
+				  change TEXT,
+				  reason TEXT,
+				  creationtime INTEGER,
+				  "when" INTEGER);`,
+		`CREATE INDEX IF NOT EXISTS requests_rtoken ON requests (rtoken);`,
+		`CREATE INDEX IF NOT EXISTS requests_token ON requests (token);`,
+		`CREATE INDEX IF NOT EXISTS requests_status ON requests (status);`},
+	{`CREATE TABLE IF NOT EXISTS sharedrecords (
+				  token TEXT,
+				  record TEXT,
+				  partner TEXT,
+				  session TEXT,
+				  app TEXT,
+				  fields TEXT,
+				  endtime INTEGER,
+				  "when" INTEGER);`,
+		`CREATE INDEX IF NOT EXISTS sharedrecords_record ON sharedrecords (record);`},
+	{`CREATE TABLE IF NOT EXISTS processingactivities (
+				  activity TEXT,
+				  title TEXT,
+				  script TEXT,
+				  fulldesc TEXT,
+				  legalbasis TEXT,
+				  applicableto TEXT,
+				  creationtime INTEGER);`,
+		`CREATE INDEX IF NOT EXISTS processingactivities_activity ON processingactivities (activity);`},
+	{`CREATE TABLE IF NOT EXISTS legalbasis (
+				  brief TEXT,
+				  status TEXT,
+				  module TEXT,
+				  shortdesc TEXT,
+				  fulldesc TEXT,
+				  basistype TEXT,
+				  requiredmsg TEXT,
+				  usercontrol BOOLEAN,
+				  requiredflag BOOLEAN,
+				  creationtime INTEGER);`,
+		`CREATE INDEX IF NOT EXISTS legalbasis_brief ON legalbasis (brief);`},
+	{`CREATE TABLE IF NOT EXISTS agreements (
+				  who TEXT,
+				  mode TEXT,
+				  token TEXT,
+				  brief TEXT,
+				  status TEXT,
+				  referencecode TEXT,
+				  lastmodifiedby TEXT,
+				  agreementmethod TEXT,
+				  creationtime INTEGER,
+				  starttime INTEGER,
+				  endtime INTEGER,
+				  "when" INTEGER);`,
+		`CREATE INDEX IF NOT EXISTS agreements_token ON agreements (token);`,
+		`CREATE INDEX IF NOT EXISTS agreements_brief ON agreements (brief);`},
+}
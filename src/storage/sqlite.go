@@ -0,0 +1,425 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3" // load sqlite3 here
+	"github.com/schollz/sqlite3dump"
+)
+
+// SQLiteStorage struct is used to store SQLite database object
+type SQLiteStorage struct {
+	sqlStorage
+}
+
+func sqliteFile(filepath *string) string {
+	dbfile := "./databunker.db"
+	if filepath != nil {
+		if len(*filepath) > 0 {
+			dbfile = *filepath
+		}
+	}
+	if len(dbfile) >= 3 && dbfile[len(dbfile)-3:] != ".db" {
+		dbfile = dbfile + ".db"
+	}
+	return dbfile
+}
+
+func sqliteExists(filepath *string) bool {
+	dbfile := sqliteFile(filepath)
+	if _, err := os.Stat(dbfile); os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+
+func sqliteConnect(dbfile string) *sql.DB {
+	db, err := sql.Open("sqlite3", "file:"+dbfile+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		log.Fatalf("Failed to open databunker.db file: %s", err)
+	}
+	err = db.Ping()
+	if err != nil {
+		log.Fatalf("Error on opening database connection: %s", err.Error())
+	}
+	return db
+}
+
+func openSQLite(filepath *string) (Storage, error) {
+	dbfile := sqliteFile(filepath)
+	fmt.Printf("Databunker db file is: %s\n", dbfile)
+	db := sqliteConnect(dbfile)
+	_, err := db.Exec("vacuum")
+	if err != nil {
+		log.Fatalf("Error on vacuum database command")
+	}
+	dbobj := SQLiteStorage{sqlStorage{db: db}}
+
+	// load all table names
+	q := "select name from sqlite_master where type ='table'"
+	tx, err := dbobj.db.Begin()
+	if err != nil {
+		return dbobj, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(q)
+	if err != nil {
+		return dbobj, err
+	}
+	for rows.Next() {
+		t := ""
+		rows.Scan(&t)
+		knownApps = append(knownApps, t)
+	}
+	tx.Commit()
+	fmt.Printf("tables: %s\n", knownApps)
+	_, err = migrateDB(dbobj.db, false, false)
+	return dbobj, err
+}
+
+func initSQLite(filepath *string) (Storage, error) {
+	dbfile := sqliteFile(filepath)
+	fmt.Printf("Init Databunker db file is: %s\n", dbfile)
+	db := sqliteConnect(dbfile)
+	dbobj := SQLiteStorage{sqlStorage{db: db}}
+
+	initSQLiteUsers(dbobj.db)
+	initSQLiteXTokens(dbobj.db)
+	initSQLiteAudit(dbobj.db)
+	initSQLiteSessions(dbobj.db)
+	initSQLiteRequests(dbobj.db)
+	initSQLiteSharedRecords(dbobj.db)
+	initSQLiteProcessingactivities(dbobj.db)
+	initSQLiteLegalbasis(dbobj.db)
+	initSQLiteAgreements(dbobj.db)
+	_, err := migrateDB(dbobj.db, false, false)
+	return dbobj, err
+}
+
+// keyTables keep encryption keys and their rows are never saved in backups.
+// Records erased by destroying their keys stay undecryptable in older backups.
+var keyTables = []string{"userkeys"}
+
+// skipRowsWriter drops insert statements of key tables from the dump,
+// dumper writes every statement with a single Write call
+type skipRowsWriter struct {
+	w io.Writer
+}
+
+func (s skipRowsWriter) Write(p []byte) (int, error) {
+	for _, t := range keyTables {
+		if bytes.HasPrefix(p, []byte(`INSERT INTO "`+t+`" `)) {
+			return len(p), nil
+		}
+	}
+	return s.w.Write(p)
+}
+
+// BackupDB function backups existing databsae and prints database structure to io.Writer
+func (dbobj SQLiteStorage) BackupDB(w io.Writer) error {
+	err := sqlite3dump.DumpDB(dbobj.db, skipRowsWriter{w})
+	if err != nil {
+		fmt.Printf("error in backup: %s", err)
+	}
+	return err
+}
+
+// dumpStatements validates SQLite dump and returns statements without transaction wrapper
+func dumpStatements(dump []byte) (string, error) {
+	begin := []byte("BEGIN TRANSACTION;\n")
+	end := []byte("COMMIT;\n")
+	if !bytes.HasPrefix(dump, begin) || !bytes.HasSuffix(dump, end) {
+		return "", errors.New("bad backup format")
+	}
+	body := dump[len(begin) : len(dump)-len(end)]
+	if !bytes.Contains(body, []byte("CREATE TABLE users")) ||
+		!bytes.Contains(body, []byte("CREATE TABLE xtokens")) {
+		return "", errors.New("backup is missing databunker tables")
+	}
+	return string(body), nil
+}
+
+// OpenDump loads SQLite dump into temporary in-memory database
+func OpenDump(dump []byte) (Storage, error) {
+	body, err := dumpStatements(dump)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// every new connection gets a new empty in-memory database
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(body)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return SQLiteStorage{sqlStorage{db: db}}, nil
+}
+
+// RestoreDB function drops all tables and loads SQLite dump in one transaction
+func (dbobj SQLiteStorage) RestoreDB(dump []byte) error {
+	body, err := dumpStatements(dump)
+	if err != nil {
+		return err
+	}
+	tx, err := dbobj.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("select name from sqlite_master where type ='table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		t := ""
+		rows.Scan(&t)
+		tables = append(tables, t)
+	}
+	rows.Close()
+	// keys are not in the backup, current ones are kept
+	for _, t := range keyTables {
+		if contains(tables, t) {
+			_, err = tx.Exec("CREATE TEMP TABLE " + t + "_live AS SELECT * FROM " + t)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range tables {
+		_, err = tx.Exec("DROP TABLE " + t)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(body)
+	if err != nil {
+		return err
+	}
+	// backup can be created before user keys table was added
+	if err = createUserkeys(tx); err != nil {
+		return err
+	}
+	for _, t := range keyTables {
+		if contains(tables, t) {
+			queries := []string{"DELETE FROM " + t, "INSERT INTO " + t + " SELECT * FROM " + t + "_live",
+				"DROP TABLE " + t + "_live"}
+			for _, q := range queries {
+				if _, err = tx.Exec(q); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	rows, err = tx.Query("select name from sqlite_master where type ='table'")
+	if err != nil {
+		return err
+	}
+	var restored []string
+	for rows.Next() {
+		t := ""
+		rows.Scan(&t)
+		restored = append(restored, t)
+	}
+	rows.Close()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	knownApps = restored
+	fmt.Printf("restored tables: %s\n", knownApps)
+	// backup can be created by older version
+	_, err = migrateDB(dbobj.db, false, false)
+	return err
+}
+
+// DeleteExpired0 deletes expired records in database and vacuums it
+func (dbobj SQLiteStorage) DeleteExpired0(t Tbl, expt int32) (int64, error) {
+	num, err := dbobj.sqlStorage.DeleteExpired0(t, expt)
+	// vacuum database, it can not run inside transaction
+	if dbobj.tx == nil {
+		dbobj.db.Exec("vacuum")
+	}
+	return num, err
+}
+
+// WithTx runs fn inside a single database transaction
+func (dbobj SQLiteStorage) WithTx(fn func(tx Storage) error) error {
+	return dbobj.withTx(nil, func(s sqlStorage) Storage { return SQLiteStorage{s} }, fn)
+}
+
+// IndexNewApp creates a new app table and creates indexes for it.
+func (dbobj SQLiteStorage) IndexNewApp(appName string) {
+	if contains(knownApps, appName) == false {
+		// it is a new app, create an index
+		fmt.Printf("This is a new app, creating table & index for: %s\n", appName)
+		queries := []string{"CREATE TABLE IF NOT EXISTS " + appName + ` (
+			token STRING,
+			md5 STRING,
+			rofields STRING,
+			data TEXT,
+			status STRING,
+			` + "`when` int);",
+			"CREATE INDEX " + appName + "_token ON " + appName + " (token);"}
+		err := execQueries(dbobj.db, queries)
+		if err == nil {
+			knownApps = append(knownApps, appName)
+		}
+	}
+	return
+}
+
+func initSQLiteUsers(db *sql.DB) error {
+	queries := []string{`CREATE TABLE IF NOT EXISTS users (
+			  token STRING,
+			  key STRING,
+			  md5 STRING,
+			  loginidx STRING,
+			  emailidx STRING,
+			  phoneidx STRING,
+			  rofields STRING,
+			  tempcodeexp int,
+			  tempcode int,
+			  data TEXT
+			);`,
+		`CREATE INDEX users_token ON users (token);`,
+		`CREATE INDEX users_login ON users (loginidx);`,
+		`CREATE INDEX users_email ON users (emailidx);`,
+		`CREATE INDEX users_phone ON users (phoneidx);`}
+	return execQueries(db, queries)
+}
+
+func initSQLiteXTokens(db *sql.DB) error {
+	queries := []string{`CREATE TABLE IF NOT EXISTS xtokens (
+				  xtoken STRING,
+				  token STRING,
+				  type STRING,
+				  app STRING,
+				  fields STRING,
+				  endtime int
+				);`,
+		`CREATE UNIQUE INDEX xtokens_xtoken ON xtokens (xtoken);`,
+		`CREATE INDEX xtokens_uniq ON xtokens (token, type);`}
+	return execQueries(db, queries)
+}
+
+func initSQLiteSharedRecords(db *sql.DB) error {
+	queries := []string{`CREATE TABLE IF NOT EXISTS sharedrecords (
+				  token STRING,
+				  record STRING,
+				  partner STRING,
+				  session STRING,
+				  app STRING,
+				  fields STRING,
+				  endtime int,
+				  ` + "`when` int);",
+		`CREATE INDEX sharedrecords_record ON sharedrecords (record);`}
+	return execQueries(db, queries)
+}
+
+func initSQLiteAudit(db *sql.DB) error {
+	queries := []string{`CREATE TABLE IF NOT EXISTS audit (
+				  atoken STRING,
+				  identity STRING,
+				  record STRING,
+				  who STRING,
+				  mode STRING,
+				  app STRING,
+				  title STRING,
+				  status STRING,
+				  msg STRING,
+				  debug STRING,
+				  before TEXT,
+				  after TEXT,
+				  ` + "`when` int);",
+		`CREATE INDEX audit_atoken ON audit (atoken);`,
+		`CREATE INDEX audit_record ON audit (record);`}
+	return execQueries(db, queries)
+}
+
+func initSQLiteRequests(db *sql.DB) error {
+	queries := []string{`CREATE TABLE IF NOT EXISTS requests (
+				  rtoken STRING,
+				  token STRING,
+				  app STRING,
+				  brief STRING,
+				  action STRING,
+				  status STRING,
+				  change STRING,
+				  reason STRING,
+				  creationtime int,
+				  ` + "`when` int);",
+		`CREATE INDEX requests_rtoken ON requests (rtoken);`,
+		`CREATE INDEX requests_token ON requests (token);`,
+		`CREATE INDEX requests_status ON requests (status);`}
+	return execQueries(db, queries)
+}
+
+func initSQLiteProcessingactivities(db *sql.DB) error {
+	queries := []string{`CREATE TABLE IF NOT EXISTS processingactivities (
+				  activity STRING,
+				  title STRING,
+				  script STRING,
+				  fulldesc STRING,
+				  legalbasis STRING,
+				  applicableto STRING,
+				  creationtime int);`,
+		`CREATE INDEX processingactivities_activity ON processingactivities (activity);`}
+	return execQueries(db, queries)
+}
+
+func initSQLiteLegalbasis(db *sql.DB) error {
+	queries := []string{`CREATE TABLE IF NOT EXISTS legalbasis (
+				  brief STRING,
+				  status STRING,
+				  module STRING,
+				  shortdesc STRING,
+				  fulldesc STRING,
+				  basistype STRING,
+				  requiredmsg STRING,
+				  usercontrol BOOLEAN,
+				  requiredflag BOOLEAN,
+				  creationtime int);`,
+		`CREATE INDEX legalbasis_brief ON legalbasis (brief);`}
+	return execQueries(db, queries)
+}
+
+func initSQLiteAgreements(db *sql.DB) error {
+	queries := []string{`CREATE TABLE IF NOT EXISTS agreements (
+				  who STRING,
+				  mode STRING,
+				  token STRING,
+				  brief STRING,
+				  status STRING,
+				  referencecode STRING,
+				  lastmodifiedby STRING,
+				  agreementmethod STRING,
+				  creationtime int,
+				  starttime int,
+				  endtime int,
+				  ` + "`when` int);",
+		`CREATE INDEX agreements_token ON agreements (token);`,
+		`CREATE INDEX agreements_brief ON agreements (brief);`}
+	return execQueries(db, queries)
+}
+
+func initSQLiteSessions(db *sql.DB) error {
+	queries := []string{`CREATE TABLE IF NOT EXISTS sessions (
+				  token STRING,
+				  session STRING,
+				  data TEXT,
+				  endtime int,
+				  ` + "`when` int);",
+		`CREATE INDEX sessions_token ON sessions (token);`,
+		`CREATE INDEX sessions_session ON sessions (session);`}
+	return execQueries(db, queries)
+}
@@ -3,17 +3,16 @@ package storage
 // https://stackoverflow.com/questions/21986780/is-it-possible-to-retrieve-a-column-value-by-name-using-golang-database-sql
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3" // load sqlite3 here
-	"github.com/schollz/sqlite3dump"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -27,180 +26,213 @@ type Tbl int
 
 // listTbls used to store list of tables
 type listTbls struct {
-	Users         Tbl
-	Audit         Tbl
-	Xtokens       Tbl
-	Sessions      Tbl
-	Requests      Tbl
-	Legalbasis    Tbl
-	Agreements    Tbl
-	Sharedrecords Tbl
+	Users                Tbl
+	Audit                Tbl
+	Xtokens              Tbl
+	Sessions             Tbl
+	Requests             Tbl
+	Legalbasis           Tbl
+	Agreements           Tbl
+	Sharedrecords        Tbl
 	Processingactivities Tbl
+	Keyrotation          Tbl
+	Sealconfig           Tbl
+	Userindexes          Tbl
+	Userkeys             Tbl
+	Roles                Tbl
 }
 
 // TblName is enum of tables
 var TblName = &listTbls{
-	Users:         0,
-	Audit:         1,
-	Xtokens:       2,
-	Sessions:      3,
-	Requests:      4,
-	Legalbasis:    5,
-	Agreements:    6,
-	Sharedrecords: 7,
+	Users:                0,
+	Audit:                1,
+	Xtokens:              2,
+	Sessions:             3,
+	Requests:             4,
+	Legalbasis:           5,
+	Agreements:           6,
+	Sharedrecords:        7,
 	Processingactivities: 8,
+	Keyrotation:          9,
+	Sealconfig:           10,
+	Userindexes:          11,
+	Userkeys:             12,
+	Roles:                13,
 }
 
-// DBStorage struct is used to store database object
-type DBStorage struct {
+// Storage is the interface implemented by every database backend
+type Storage interface {
+	Ping() error
+	CloseDB()
+	BackupDB(w io.Writer) error
+	RestoreDB(dump []byte) error
+	InitUserApps() error
+	CreateRecordInTable(tbl string, data interface{}) (int, error)
+	CreateRecord(t Tbl, data interface{}) (int, error)
+	CountRecords0(t Tbl) (int64, error)
+	CountRecords(t Tbl, keyName string, keyValue string) (int64, error)
+	UpdateRecord(t Tbl, keyName string, keyValue string, bdoc *bson.M) (int64, error)
+	UpdateRecordInTable(table string, keyName string, keyValue string, bdoc *bson.M) (int64, error)
+	UpdateRecord2(t Tbl, keyName string, keyValue string, keyName2 string, keyValue2 string, bdoc *bson.M, bdel *bson.M) (int64, error)
+	UpdateRecordInTable2(table string, keyName string, keyValue string, keyName2 string, keyValue2 string, bdoc *bson.M, bdel *bson.M) (int64, error)
+	LookupRecord(t Tbl, row bson.M) (bson.M, error)
+	GetRecord(t Tbl, keyName string, keyValue string) (bson.M, error)
+	GetRecordInTable(table string, keyName string, keyValue string) (bson.M, error)
+	GetRecord2(t Tbl, keyName string, keyValue string, keyName2 string, keyValue2 string) (bson.M, error)
+	DeleteRecord(t Tbl, keyName string, keyValue string) (int64, error)
+	DeleteRecordInTable(table string, keyName string, keyValue string) (int64, error)
+	DeleteRecord2(t Tbl, keyName string, keyValue string, keyName2 string, keyValue2 string) (int64, error)
+	DeleteExpired0(t Tbl, expt int32) (int64, error)
+	DeleteExpired(t Tbl, keyName string, keyValue string) (int64, error)
+	DeleteExpiredAll(t Tbl) (int64, error)
+	DeleteOlder(t Tbl, expt int32, keyName string, keyValue string) (int64, error)
+	CleanupRecord(t Tbl, keyName string, keyValue string, data interface{}) (int64, error)
+	GetExpiring(t Tbl, keyName string, keyValue string) ([]bson.M, error)
+	GetUniqueList(t Tbl, keyName string) ([]bson.M, error)
+	GetList0(t Tbl, start int32, limit int32, orderField string) ([]bson.M, error)
+	GetList(t Tbl, keyName string, keyValue string, start int32, limit int32, orderField string) ([]bson.M, error)
+	GetListAfter(t Tbl, keyName string, keyValue string, limit int32) ([]bson.M, error)
+	GetAllTables() ([]string, error)
+	ValidateNewApp(appName string) bool
+	IndexNewApp(appName string)
+	WithTx(fn func(tx Storage) error) error
+}
+
+// sqlStorage struct keeps queries shared by all database/sql based backends.
+// tx is set when storage object is bound to a transaction started by WithTx.
+type sqlStorage struct {
 	db *sql.DB
+	tx *sql.Tx
 }
 
-// DBExists function checks if database exists
-func DBExists(filepath *string) bool {
-	dbfile := "./databunker.db"
-	if filepath != nil {
-		if len(*filepath) > 0 {
-			dbfile = *filepath
-		}
-	}
-	if len(dbfile) >= 3 && dbfile[len(dbfile)-3:] != ".db" {
-		dbfile = dbfile + ".db"
-	}
-	if _, err := os.Stat(dbfile); os.IsNotExist(err) {
-		return false
-	}
-	return true
+// dbTx is a transaction used by a single storage call. When the call is
+// made inside WithTx, commit and rollback are left to WithTx.
+type dbTx struct {
+	*sql.Tx
+	nested bool
 }
 
-// CreateTestDB creates a test db
-func CreateTestDB() string {
-	testDBFile := "/tmp/test-sqlite.db"
-	os.Remove(testDBFile)
-	return testDBFile
+// Commit commits transaction unless it belongs to WithTx
+func (t dbTx) Commit() error {
+	if t.nested {
+		return nil
+	}
+	return t.Tx.Commit()
 }
-// OpenDB function opens the database
-func OpenDB(filepath *string) (DBStorage, error) {
-	dbfile := "./databunker.db"
-	if filepath != nil {
-		if len(*filepath) > 0 {
-			dbfile = *filepath
-		}
+
+// Rollback aborts transaction unless it belongs to WithTx
+func (t dbTx) Rollback() error {
+	if t.nested {
+		return nil
 	}
-	if len(dbfile) >= 3 && dbfile[len(dbfile)-3:] != ".db" {
-		dbfile = dbfile + ".db"
+	return t.Tx.Rollback()
+}
+
+// begin starts a new transaction or joins the one started by WithTx
+func (dbobj sqlStorage) begin() (dbTx, error) {
+	if dbobj.tx != nil {
+		return dbTx{dbobj.tx, true}, nil
 	}
-	fmt.Printf("Databunker db file is: %s\n", dbfile)
-	// collect list of all tables
-	/*
-		if _, err := os.Stat(dbfile); !os.IsNotExist(err) {
-			db2, err := ql.OpenFile(dbfile, &ql.Options{FileFormat: 2})
-			if err != nil {
-				return dbobj, err
-			}
-			dbinfo, err := db2.Info()
-			for _, v := range dbinfo.Tables {
-				knownApps = append(knownApps, v.Name)
-			}
-			db2.Close()
-		}
-	*/
+	tx, err := dbobj.db.Begin()
+	return dbTx{tx, false}, err
+}
 
-	//ql.RegisterDriver2()
-	//db, err := sql.Open("ql2", dbfile)
-	db, err := sql.Open("sqlite3", "file:"+dbfile+"?_journal_mode=WAL")
-	if err != nil {
-		log.Fatalf("Failed to open databunker.db file: %s", err)
+// withTx runs fn with storage object bound to a single transaction.
+// Nested calls join the outer transaction.
+func (dbobj sqlStorage) withTx(opts *sql.TxOptions, wrap func(sqlStorage) Storage, fn func(tx Storage) error) (err error) {
+	if dbobj.tx != nil {
+		return fn(wrap(dbobj))
 	}
-	err = db.Ping()
+	tx, err := dbobj.db.BeginTx(context.Background(), opts)
 	if err != nil {
-		log.Fatalf("Error on opening database connection: %s", err.Error())
+		return err
 	}
-	_, err = db.Exec("vacuum")
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	err = fn(wrap(sqlStorage{dbobj.db, tx}))
 	if err != nil {
-		log.Fatalf("Error on vacuum database command")
+		tx.Rollback()
+		return err
 	}
-	dbobj := DBStorage{db}
+	return tx.Commit()
+}
 
-	// load all table names
-	q := "select name from sqlite_master where type ='table'"
-	tx, err := dbobj.db.Begin()
-	if err != nil {
-		return dbobj, err
-	}
-	defer tx.Rollback()
-	rows, err := tx.Query(q)
-	for rows.Next() {
-		t := ""
-		rows.Scan(&t)
-		knownApps = append(knownApps, t)
+// isPostgres function checks if database name is a PostgreSQL connection URL
+func isPostgres(dbname *string) bool {
+	if dbname == nil {
+		return false
 	}
-	tx.Commit()
-	fmt.Printf("tables: %s\n", knownApps)
-	return dbobj, nil
+	return strings.HasPrefix(*dbname, "postgres://") || strings.HasPrefix(*dbname, "postgresql://")
 }
 
-// InitDB function creates tables and indexes
-func InitDB(filepath *string) (DBStorage, error){
-	dbfile := "./databunker.db"
-	if filepath != nil {
-		if len(*filepath) > 0 {
-			dbfile = *filepath
-		}
+// DBExists function checks if database exists
+func DBExists(dbname *string) bool {
+	if isPostgres(dbname) {
+		return pgsqlExists(*dbname)
 	}
-	if len(dbfile) >= 3 && dbfile[len(dbfile)-3:] != ".db" {
-		dbfile = dbfile + ".db"
+	return sqliteExists(dbname)
+}
+
+// CreateTestDB creates a test db
+func CreateTestDB() string {
+	testDBFile := "/tmp/test-sqlite.db"
+	os.Remove(testDBFile)
+	return testDBFile
+}
+
+// OpenDB function opens the database. A postgres:// URL selects
+// the PostgreSQL backend, anything else is treated as SQLite file name.
+func OpenDB(dbname *string) (Storage, error) {
+	if isPostgres(dbname) {
+		return openPGSQL(*dbname)
 	}
-	fmt.Printf("Init Databunker db file is: %s\n", dbfile)
-	db, err := sql.Open("sqlite3", "file:"+dbfile+"?_journal_mode=WAL")
-	if err != nil {
-		log.Fatalf("Failed to open databunker.db file: %s", err)
+	return openSQLite(dbname)
+}
+
+// InitDB function creates tables and indexes
+func InitDB(dbname *string) (Storage, error) {
+	if isPostgres(dbname) {
+		return initPGSQL(*dbname)
 	}
-	err = db.Ping()
-	if err != nil {
-		log.Fatalf("Error on opening database connection: %s", err.Error())
-	}
-	dbobj := DBStorage{db}
-	
-	initUsers(dbobj.db)
-	initXTokens(dbobj.db)
-	initAudit(dbobj.db)
-	initSessions(dbobj.db)
-	initRequests(dbobj.db)
-	initSharedRecords(dbobj.db)
-	initProcessingactivities(dbobj.db)
-	initLegalbasis(dbobj.db)
-	initAgreements(dbobj.db)
-	return dbobj, nil
+	return initSQLite(dbname)
 }
 
+// MigrateDB function applies pending schema migrations and returns their titles.
+// When dryRun is set, pending migrations are only listed.
+func MigrateDB(dbname *string, dryRun bool) ([]string, error) {
+	var db *sql.DB
+	if isPostgres(dbname) {
+		db = pgsqlConnect(*dbname)
+	} else {
+		db = sqliteConnect(sqliteFile(dbname))
+	}
+	defer db.Close()
+	return migrateDB(db, isPostgres(dbname), dryRun)
+}
 
-func (dbobj DBStorage) Ping() error {
-        return dbobj.db.Ping()
+// Ping function checks database connection
+func (dbobj sqlStorage) Ping() error {
+	return dbobj.db.Ping()
 }
 
 // CloseDB function closes the open database
-func (dbobj DBStorage) CloseDB() {
+func (dbobj sqlStorage) CloseDB() {
 	dbobj.db.Close()
 }
 
-// BackupDB function backups existing databsae and prints database structure to http.ResponseWriter
-func (dbobj DBStorage) BackupDB(w http.ResponseWriter) {
-	err := sqlite3dump.DumpDB(dbobj.db, w)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Printf("error in backup: %s", err)
-	}
-}
-
 // InitUserApps initialises list of databases.
-func (dbobj DBStorage) InitUserApps() error {
+func (dbobj sqlStorage) InitUserApps() error {
 	return nil
 }
 
+// escapeName quotes reserved words; double quotes work in SQLite and PostgreSQL
 func escapeName(name string) string {
 	if name == "when" {
-		name = "`when`"
+		name = "\"when\""
 	}
 	return name
 }
@@ -328,12 +360,22 @@ func getTable(t Tbl) string {
 		return "sharedrecords"
 	case TblName.Processingactivities:
 		return "processingactivities"
+	case TblName.Keyrotation:
+		return "keyrotation"
+	case TblName.Sealconfig:
+		return "sealconfig"
+	case TblName.Userindexes:
+		return "userindexes"
+	case TblName.Userkeys:
+		return "userkeys"
+	case TblName.Roles:
+		return "roles"
 	}
 	return "users"
 }
 
 // CreateRecordInTable creates new record
-func (dbobj DBStorage) CreateRecordInTable(tbl string, data interface{}) (int, error) {
+func (dbobj sqlStorage) CreateRecordInTable(tbl string, data interface{}) (int, error) {
 	fields, values := decodeFieldsValues(data)
 	valuesInQ := "$1"
 	for idx := range values {
@@ -344,7 +386,7 @@ func (dbobj DBStorage) CreateRecordInTable(tbl string, data interface{}) (int, e
 	q := "insert into " + tbl + " (" + fields + ") values (" + valuesInQ + ")"
 	fmt.Printf("q: %s\n", q)
 	//fmt.Printf("values: %s\n", values...)
-	tx, err := dbobj.db.Begin()
+	tx, err := dbobj.begin()
 	if err != nil {
 		return 0, err
 	}
@@ -360,19 +402,19 @@ func (dbobj DBStorage) CreateRecordInTable(tbl string, data interface{}) (int, e
 }
 
 // CreateRecord creates new record
-func (dbobj DBStorage) CreateRecord(t Tbl, data interface{}) (int, error) {
+func (dbobj sqlStorage) CreateRecord(t Tbl, data interface{}) (int, error) {
 	//if reflect.TypeOf(value) == reflect.TypeOf("string")
 	tbl := getTable(t)
 	return dbobj.CreateRecordInTable(tbl, data)
 }
 
 // CountRecords returns number of records in table
-func (dbobj DBStorage) CountRecords0(t Tbl) (int64, error) {
+func (dbobj sqlStorage) CountRecords0(t Tbl) (int64, error) {
 	tbl := getTable(t)
 	q := "select count(*) from " + tbl
 	fmt.Printf("q: %s\n", q)
 
-	tx, err := dbobj.db.Begin()
+	tx, err := dbobj.begin()
 	if err != nil {
 		return 0, err
 	}
@@ -391,12 +433,12 @@ func (dbobj DBStorage) CountRecords0(t Tbl) (int64, error) {
 }
 
 // CountRecords returns number of records that match filter
-func (dbobj DBStorage) CountRecords(t Tbl, keyName string, keyValue string) (int64, error) {
+func (dbobj sqlStorage) CountRecords(t Tbl, keyName string, keyValue string) (int64, error) {
         tbl := getTable(t)
         q := "select count(*) from " + tbl + " WHERE " + escapeName(keyName) + "=$1"
         fmt.Printf("q: %s\n", q)
 
-        tx, err := dbobj.db.Begin()
+        tx, err := dbobj.begin()
         if err != nil {
                 return 0, err
         }
@@ -415,41 +457,46 @@ func (dbobj DBStorage) CountRecords(t Tbl, keyName string, keyValue string) (int
 }
 
 // UpdateRecord updates database record
-func (dbobj DBStorage) UpdateRecord(t Tbl, keyName string, keyValue string, bdoc *bson.M) (int64, error) {
+func (dbobj sqlStorage) UpdateRecord(t Tbl, keyName string, keyValue string, bdoc *bson.M) (int64, error) {
 	table := getTable(t)
-	filter := escapeName(keyName) + "=\"" + keyValue + "\""
-	return dbobj.updateRecordInTableDo(table, filter, bdoc, nil)
+	return dbobj.updateRecordInTableDo(table, []string{keyName}, []interface{}{keyValue}, bdoc, nil)
 }
 
 // UpdateRecordInTable updates database record
-func (dbobj DBStorage) UpdateRecordInTable(table string, keyName string, keyValue string, bdoc *bson.M) (int64, error) {
-	filter := escapeName(keyName) + "=\"" + keyValue + "\""
-	return dbobj.updateRecordInTableDo(table, filter, bdoc, nil)
+func (dbobj sqlStorage) UpdateRecordInTable(table string, keyName string, keyValue string, bdoc *bson.M) (int64, error) {
+	return dbobj.updateRecordInTableDo(table, []string{keyName}, []interface{}{keyValue}, bdoc, nil)
 }
 
 // UpdateRecord2 updates database record
-func (dbobj DBStorage) UpdateRecord2(t Tbl, keyName string, keyValue string,
+func (dbobj sqlStorage) UpdateRecord2(t Tbl, keyName string, keyValue string,
 	keyName2 string, keyValue2 string, bdoc *bson.M, bdel *bson.M) (int64, error) {
 	table := getTable(t)
-	filter := escapeName(keyName) + "=\"" + keyValue + "\" AND " +
-		escapeName(keyName2) + "=\"" + keyValue2 + "\""
-	return dbobj.updateRecordInTableDo(table, filter, bdoc, bdel)
+	return dbobj.updateRecordInTableDo(table, []string{keyName, keyName2},
+		[]interface{}{keyValue, keyValue2}, bdoc, bdel)
 }
 
 // UpdateRecordInTable2 updates database record
-func (dbobj DBStorage) UpdateRecordInTable2(table string, keyName string,
+func (dbobj sqlStorage) UpdateRecordInTable2(table string, keyName string,
 	keyValue string, keyName2 string, keyValue2 string, bdoc *bson.M, bdel *bson.M) (int64, error) {
-	filter := escapeName(keyName) + "=\"" + keyValue + "\" AND " +
-		escapeName(keyName2) + "=\"" + keyValue2 + "\""
-	return dbobj.updateRecordInTableDo(table, filter, bdoc, bdel)
+	return dbobj.updateRecordInTableDo(table, []string{keyName, keyName2},
+		[]interface{}{keyValue, keyValue2}, bdoc, bdel)
 }
 
-func (dbobj DBStorage) updateRecordInTableDo(table string, filter string, bdoc *bson.M, bdel *bson.M) (int64, error) {
+func (dbobj sqlStorage) updateRecordInTableDo(table string, keys []string, keyValues []interface{}, bdoc *bson.M, bdel *bson.M) (int64, error) {
 	op, values := decodeForUpdate(bdoc, bdel)
+	// filter values are passed as query arguments after the updated values
+	filter := ""
+	for idx, keyName := range keys {
+		if idx > 0 {
+			filter = filter + " AND "
+		}
+		values = append(values, keyValues[idx])
+		filter = filter + escapeName(keyName) + "=$" + strconv.Itoa(len(values))
+	}
 	q := "update " + table + " SET " + op + " WHERE " + filter
 	fmt.Printf("q: %s\n", q)
 
-	tx, err := dbobj.db.Begin()
+	tx, err := dbobj.begin()
 	if err != nil {
 		return 0, err
 	}
@@ -466,7 +513,7 @@ func (dbobj DBStorage) updateRecordInTableDo(table string, filter string, bdoc *
 }
 
 // Lookup record by multiple fields
-func (dbobj DBStorage) LookupRecord(t Tbl, row bson.M) (bson.M, error) {
+func (dbobj sqlStorage) LookupRecord(t Tbl, row bson.M) (bson.M, error) {
 	table := getTable(t)
 	q := "select * from " + table + " WHERE "
 	num := 1
@@ -483,7 +530,7 @@ func (dbobj DBStorage) LookupRecord(t Tbl, row bson.M) (bson.M, error) {
 }
 
 // GetRecord returns specific record from database
-func (dbobj DBStorage) GetRecord(t Tbl, keyName string, keyValue string) (bson.M, error) {
+func (dbobj sqlStorage) GetRecord(t Tbl, keyName string, keyValue string) (bson.M, error) {
 	table := getTable(t)
 	q := "select * from " + table + " WHERE " + escapeName(keyName) + "=$1"
 	values := make([]interface{}, 0)
@@ -492,7 +539,7 @@ func (dbobj DBStorage) GetRecord(t Tbl, keyName string, keyValue string) (bson.M
 }
 
 // GetRecordInTable returns specific record from database
-func (dbobj DBStorage) GetRecordInTable(table string, keyName string, keyValue string) (bson.M, error) {
+func (dbobj sqlStorage) GetRecordInTable(table string, keyName string, keyValue string) (bson.M, error) {
 	q := "select * from " + table + " WHERE " + escapeName(keyName) + "=$1"
 	values := make([]interface{}, 0)
 	values = append(values, keyValue)
@@ -500,7 +547,7 @@ func (dbobj DBStorage) GetRecordInTable(table string, keyName string, keyValue s
 }
 
 // GetRecord2  returns specific record from database
-func (dbobj DBStorage) GetRecord2(t Tbl, keyName string, keyValue string,
+func (dbobj sqlStorage) GetRecord2(t Tbl, keyName string, keyValue string,
 	keyName2 string, keyValue2 string) (bson.M, error) {
 	table := getTable(t)
 	q := "select * from " + table + " WHERE " + escapeName(keyName) + "=$1 AND " +
@@ -511,10 +558,10 @@ func (dbobj DBStorage) GetRecord2(t Tbl, keyName string, keyValue string,
 	return dbobj.getRecordInTableDo(q, values)
 }
 
-func (dbobj DBStorage) getRecordInTableDo(q string, values []interface{}) (bson.M, error) {
+func (dbobj sqlStorage) getRecordInTableDo(q string, values []interface{}) (bson.M, error) {
 	fmt.Printf("query: %s\n", q)
 
-	tx, err := dbobj.db.Begin()
+	tx, err := dbobj.begin()
 	if err != nil {
 		return nil, err
 	}
@@ -593,17 +640,17 @@ func (dbobj DBStorage) getRecordInTableDo(q string, values []interface{}) (bson.
 }
 
 // DeleteRecord deletes record in database
-func (dbobj DBStorage) DeleteRecord(t Tbl, keyName string, keyValue string) (int64, error) {
+func (dbobj sqlStorage) DeleteRecord(t Tbl, keyName string, keyValue string) (int64, error) {
 	tbl := getTable(t)
 	return dbobj.DeleteRecordInTable(tbl, keyName, keyValue)
 }
 
 // DeleteRecordInTable deletes record in database
-func (dbobj DBStorage) DeleteRecordInTable(table string, keyName string, keyValue string) (int64, error) {
+func (dbobj sqlStorage) DeleteRecordInTable(table string, keyName string, keyValue string) (int64, error) {
 	q := "delete from " + table + " WHERE " + escapeName(keyName) + "=$1"
 	fmt.Printf("q: %s\n", q)
 
-	tx, err := dbobj.db.Begin()
+	tx, err := dbobj.begin()
 	if err != nil {
 		return 0, err
 	}
@@ -620,17 +667,17 @@ func (dbobj DBStorage) DeleteRecordInTable(table string, keyName string, keyValu
 }
 
 // DeleteRecord2 deletes record in database
-func (dbobj DBStorage) DeleteRecord2(t Tbl, keyName string, keyValue string, keyName2 string, keyValue2 string) (int64, error) {
+func (dbobj sqlStorage) DeleteRecord2(t Tbl, keyName string, keyValue string, keyName2 string, keyValue2 string) (int64, error) {
 	tbl := getTable(t)
 	return dbobj.deleteRecordInTable2(tbl, keyName, keyValue, keyName2, keyValue2)
 }
 
-func (dbobj DBStorage) deleteRecordInTable2(table string, keyName string, keyValue string, keyName2 string, keyValue2 string) (int64, error) {
+func (dbobj sqlStorage) deleteRecordInTable2(table string, keyName string, keyValue string, keyName2 string, keyValue2 string) (int64, error) {
 	q := "delete from " + table + " WHERE " + escapeName(keyName) + "=$1 AND " +
 		escapeName(keyName2) + "=$2"
 	fmt.Printf("q: %s\n", q)
 
-	tx, err := dbobj.db.Begin()
+	tx, err := dbobj.begin()
 	if err != nil {
 		return 0, err
 	}
@@ -647,21 +694,21 @@ func (dbobj DBStorage) deleteRecordInTable2(table string, keyName string, keyVal
 }
 
 /*
-func (dbobj DBStorage) deleteDuplicate2(t Tbl, keyName string, keyValue string, keyName2 string, keyValue2 string) (int64, error) {
+func (dbobj sqlStorage) deleteDuplicate2(t Tbl, keyName string, keyValue string, keyName2 string, keyValue2 string) (int64, error) {
 	tbl := getTable(t)
 	return dbobj.deleteDuplicateInTable2(tbl, keyName, keyValue, keyName2, keyValue2)
 }
 */
 
 /*
-func (dbobj DBStorage) deleteDuplicateInTable2(table string, keyName string, keyValue string, keyName2 string, keyValue2 string) (int64, error) {
+func (dbobj sqlStorage) deleteDuplicateInTable2(table string, keyName string, keyValue string, keyName2 string, keyValue2 string) (int64, error) {
 	q := "delete from " + table + " where " + escapeName(keyName) + "=$1 AND " +
 		escapeName(keyName2) + "=$2 AND rowid not in " +
 		"(select min(rowid) from " + table + " where " + escapeName(keyName) + "=$3 AND " +
 		escapeName(keyName2) + "=$4)"
 	fmt.Printf("q: %s\n", q)
 
-	tx, err := dbobj.db.Begin()
+	tx, err := dbobj.begin()
 	if err != nil {
 		return 0, err
 	}
@@ -679,12 +726,12 @@ func (dbobj DBStorage) deleteDuplicateInTable2(table string, keyName string, key
 */
 
 // DeleteExpired0 deletes expired records in database
-func (dbobj DBStorage) DeleteExpired0(t Tbl, expt int32) (int64, error) {
+func (dbobj sqlStorage) DeleteExpired0(t Tbl, expt int32) (int64, error) {
 	table := getTable(t)
 	now := int32(time.Now().Unix())
-	q := fmt.Sprintf("delete from %s WHERE `when`>0 AND `when`<%d", table, now-expt)
+	q := fmt.Sprintf("delete from %s WHERE %s>0 AND %s<%d", table, escapeName("when"), escapeName("when"), now-expt)
 	fmt.Printf("q: %s\n", q)
-	tx, err := dbobj.db.Begin()
+	tx, err := dbobj.begin()
 	if err != nil {
 		return 0, err
 	}
@@ -697,18 +744,16 @@ func (dbobj DBStorage) DeleteExpired0(t Tbl, expt int32) (int64, error) {
 		return 0, err
 	}
 	num, err := result.RowsAffected()
-	// vacuum database
-	dbobj.db.Exec("vacuum")
 	return num, err
 }
 
 // DeleteExpired deletes expired records in database
-func (dbobj DBStorage) DeleteExpired(t Tbl, keyName string, keyValue string) (int64, error) {
+func (dbobj sqlStorage) DeleteExpired(t Tbl, keyName string, keyValue string) (int64, error) {
 	table := getTable(t)
 	q := "delete from " + table + " WHERE endtime>0 AND endtime<$1 AND " + escapeName(keyName) + "=$2"
 	fmt.Printf("q: %s\n", q)
 
-	tx, err := dbobj.db.Begin()
+	tx, err := dbobj.begin()
 	if err != nil {
 		return 0, err
 	}
@@ -725,14 +770,64 @@ func (dbobj DBStorage) DeleteExpired(t Tbl, keyName string, keyValue string) (in
 	return num, err
 }
 
+// DeleteExpiredAll deletes all records with passed endtime
+func (dbobj sqlStorage) DeleteExpiredAll(t Tbl) (int64, error) {
+	table := getTable(t)
+	q := "delete from " + table + " WHERE endtime>0 AND endtime<$1"
+	fmt.Printf("q: %s\n", q)
+
+	tx, err := dbobj.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	now := int32(time.Now().Unix())
+	result, err := tx.Exec(q, now)
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteOlder deletes records last changed more than expt seconds ago.
+// Only records with keyName equal to keyValue are deleted, unless keyName is empty.
+func (dbobj sqlStorage) DeleteOlder(t Tbl, expt int32, keyName string, keyValue string) (int64, error) {
+	table := getTable(t)
+	now := int32(time.Now().Unix())
+	q := "delete from " + table + " WHERE " + escapeName("when") + ">0 AND " + escapeName("when") + "<$1"
+	args := []interface{}{now - expt}
+	if len(keyName) > 0 {
+		q = q + " AND " + escapeName(keyName) + "=$2"
+		args = append(args, keyValue)
+	}
+	fmt.Printf("q: %s\n", q)
+
+	tx, err := dbobj.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(q, args...)
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 // CleanupRecord nullifies specific feilds in records in database
-func (dbobj DBStorage) CleanupRecord(t Tbl, keyName string, keyValue string, data interface{}) (int64, error) {
+func (dbobj sqlStorage) CleanupRecord(t Tbl, keyName string, keyValue string, data interface{}) (int64, error) {
 	tbl := getTable(t)
 	cleanup := decodeForCleanup(data)
 	q := "update " + tbl + " SET " + cleanup + " WHERE " + escapeName(keyName) + "=$1"
 	fmt.Printf("q: %s\n", q)
 
-	tx, err := dbobj.db.Begin()
+	tx, err := dbobj.begin()
 	if err != nil {
 		return 0, err
 	}
@@ -749,7 +844,7 @@ func (dbobj DBStorage) CleanupRecord(t Tbl, keyName string, keyValue string, dat
 }
 
 // GetExpiring get records that are expiring
-func (dbobj DBStorage) GetExpiring(t Tbl, keyName string, keyValue string) ([]bson.M, error) {
+func (dbobj sqlStorage) GetExpiring(t Tbl, keyName string, keyValue string) ([]bson.M, error) {
 	table := getTable(t)
 	now := int32(time.Now().Unix())
 	q := fmt.Sprintf("select * from %s WHERE endtime>0 AND endtime<%d AND %s=$1", table, now, escapeName(keyName))
@@ -760,7 +855,7 @@ func (dbobj DBStorage) GetExpiring(t Tbl, keyName string, keyValue string) ([]bs
 }
 
 // GetUniqueList returns a unique list of values from specific column in database
-func (dbobj DBStorage) GetUniqueList(t Tbl, keyName string) ([]bson.M, error) {
+func (dbobj sqlStorage) GetUniqueList(t Tbl, keyName string) ([]bson.M, error) {
 	table := getTable(t)
 	keyName = escapeName(keyName)
 	q := "select distinct " + keyName + " from " + table + " ORDER BY " + keyName
@@ -770,7 +865,7 @@ func (dbobj DBStorage) GetUniqueList(t Tbl, keyName string) ([]bson.M, error) {
 }
 
 // GetList is used to return list of rows. It can be used to return values using pager.
-func (dbobj DBStorage) GetList0(t Tbl, start int32, limit int32, orderField string) ([]bson.M, error) {
+func (dbobj sqlStorage) GetList0(t Tbl, start int32, limit int32, orderField string) ([]bson.M, error) {
 	table := getTable(t)
 	if limit > 100 {
 		limit = 100
@@ -792,7 +887,7 @@ func (dbobj DBStorage) GetList0(t Tbl, start int32, limit int32, orderField stri
 }
 
 // GetList is used to return list of rows. It can be used to return values using pager.
-func (dbobj DBStorage) GetList(t Tbl, keyName string, keyValue string, start int32, limit int32, orderField string) ([]bson.M, error) {
+func (dbobj sqlStorage) GetList(t Tbl, keyName string, keyValue string, start int32, limit int32, orderField string) ([]bson.M, error) {
 	table := getTable(t)
 	if limit > 100 {
 		limit = 100
@@ -814,8 +909,20 @@ func (dbobj DBStorage) GetList(t Tbl, keyName string, keyValue string, start int
 	return dbobj.getListDo(q, values)
 }
 
-func (dbobj DBStorage) getListDo(q string, values []interface{}) ([]bson.M, error) {
-	tx, err := dbobj.db.Begin()
+// GetListAfter returns rows ordered by keyName with key greater than keyValue.
+// It is used to walk over the whole table in batches.
+func (dbobj sqlStorage) GetListAfter(t Tbl, keyName string, keyValue string, limit int32) ([]bson.M, error) {
+	table := getTable(t)
+	q := "select * from " + table + " WHERE " + escapeName(keyName) + ">$1 ORDER BY " +
+		escapeName(keyName) + " LIMIT " + strconv.FormatInt(int64(limit), 10)
+	fmt.Printf("q: %s\n", q)
+	values := make([]interface{}, 0)
+	values = append(values, keyValue)
+	return dbobj.getListDo(q, values)
+}
+
+func (dbobj sqlStorage) getListDo(q string, values []interface{}) ([]bson.M, error) {
+	tx, err := dbobj.begin()
 	if err != nil {
 		return nil, err
 	}
@@ -894,17 +1001,25 @@ func (dbobj DBStorage) getListDo(q string, values []interface{}) ([]bson.M, erro
 	return results, nil
 }
 
-// GetAllTables returns all tables that exists in database
-func (dbobj DBStorage) GetAllTables() ([]string, error) {
+// GetAllTables returns all tables that exists in database. Table names are
+// loaded on database open and updated when new app table is created.
+func (dbobj sqlStorage) GetAllTables() ([]string, error) {
 	return knownApps, nil
 }
 
 // ValidateNewApp function check if app name can be part of the table name
-func (dbobj DBStorage) ValidateNewApp(appName string) bool {
+func (dbobj sqlStorage) ValidateNewApp(appName string) bool {
 	if contains(knownApps, appName) == true {
 		return true
 	}
-	if len(knownApps) >= 10 {
+	// only app tables are counted, system tables do not limit apps
+	apps := 0
+	for _, name := range knownApps {
+		if strings.HasPrefix(name, "app_") {
+			apps = apps + 1
+		}
+	}
+	if apps >= 10 {
 		return false
 	}
 	return true
@@ -928,173 +1043,6 @@ func execQueries(db *sql.DB, queries []string) error {
 	return nil
 }
 
-// IndexNewApp creates a new app table and creates indexes for it.
-func (dbobj DBStorage) IndexNewApp(appName string) {
-	if contains(knownApps, appName) == false {
-		// it is a new app, create an index
-		fmt.Printf("This is a new app, creating table & index for: %s\n", appName)
-		queries := []string{"CREATE TABLE IF NOT EXISTS " + appName + ` (
-			token STRING,
-			md5 STRING,
-			rofields STRING,
-			data TEXT,
-			status STRING,
-			` + "`when` int);",
-			"CREATE INDEX " + appName + "_token ON " + appName + " (token);"}
-		err := execQueries(dbobj.db, queries)
-		if err == nil {
-			knownApps = append(knownApps, appName)
-		}
-	}
-	return
-}
-
-func initUsers(db *sql.DB) error {
-	queries := []string{`CREATE TABLE IF NOT EXISTS users (
-			  token STRING,
-			  key STRING,
-			  md5 STRING,
-			  loginidx STRING,
-			  emailidx STRING,
-			  phoneidx STRING,
-			  rofields STRING,
-			  tempcodeexp int,
-			  tempcode int,
-			  data TEXT
-			);`,
-		`CREATE INDEX users_token ON users (token);`,
-		`CREATE INDEX users_login ON users (loginidx);`,
-		`CREATE INDEX users_email ON users (emailidx);`,
-		`CREATE INDEX users_phone ON users (phoneidx);`}
-	return execQueries(db, queries)
-}
-
-func initXTokens(db *sql.DB) error {
-	queries := []string{`CREATE TABLE IF NOT EXISTS xtokens (
-				  xtoken STRING,
-				  token STRING,
-				  type STRING,
-				  app STRING,
-				  fields STRING,
-				  endtime int
-				);`,
-		`CREATE UNIQUE INDEX xtokens_xtoken ON xtokens (xtoken);`,
-		`CREATE INDEX xtokens_uniq ON xtokens (token, type);`}
-	return execQueries(db, queries)
-}
-
-func initSharedRecords(db *sql.DB) error {
-	queries := []string{`CREATE TABLE IF NOT EXISTS sharedrecords (
-				  token STRING,
-				  record STRING,
-				  partner STRING,
-				  session STRING,
-				  app STRING,
-				  fields STRING,
-				  endtime int,
-				  ` + "`when` int);",
-		`CREATE INDEX sharedrecords_record ON sharedrecords (record);`}
-	return execQueries(db, queries)
-}
-
-func initAudit(db *sql.DB) error {
-	queries := []string{`CREATE TABLE IF NOT EXISTS audit (
-				  atoken STRING,
-				  identity STRING,
-				  record STRING,
-				  who STRING,
-				  mode STRING,
-				  app STRING,
-				  title STRING,
-				  status STRING,
-				  msg STRING,
-				  debug STRING,
-				  before TEXT,
-				  after TEXT,
-				  ` + "`when` int);",
-		`CREATE INDEX audit_atoken ON audit (atoken);`,
-		`CREATE INDEX audit_record ON audit (record);`}
-	return execQueries(db, queries)
-}
-
-func initRequests(db *sql.DB) error {
-	queries := []string{`CREATE TABLE IF NOT EXISTS requests (
-				  rtoken STRING,
-				  token STRING,
-				  app STRING,
-				  brief STRING,
-				  action STRING,
-				  status STRING,
-				  change STRING,
-				  reason STRING,
-				  creationtime int,
-				  ` + "`when` int);",
-		`CREATE INDEX requests_rtoken ON requests (rtoken);`,
-		`CREATE INDEX requests_token ON requests (token);`,
-		`CREATE INDEX requests_status ON requests (status);`}
-	return execQueries(db, queries)
-}
-
-func initProcessingactivities(db *sql.DB) error {
-	queries := []string{`CREATE TABLE IF NOT EXISTS processingactivities (
-				  activity STRING,
-				  title STRING,
-				  script STRING,
-				  fulldesc STRING,
-				  legalbasis STRING,
-				  applicableto STRING,
-				  creationtime int);`,
-		`CREATE INDEX processingactivities_activity ON processingactivities (activity);`}
-	return execQueries(db, queries)
-}
-
-func initLegalbasis(db *sql.DB) error {
-	queries := []string{`CREATE TABLE IF NOT EXISTS legalbasis (
-				  brief STRING,
-				  status STRING,
-				  module STRING,
-				  shortdesc STRING,
-				  fulldesc STRING,
-				  basistype STRING,
-				  requiredmsg STRING,
-				  usercontrol BOOLEAN,
-				  requiredflag BOOLEAN,
-				  creationtime int);`,
-		`CREATE INDEX legalbasis_brief ON legalbasis (brief);`}
-	return execQueries(db, queries)
-}
-
-func initAgreements(db *sql.DB) error {
-	queries := []string{`CREATE TABLE IF NOT EXISTS agreements (
-				  who STRING,
-				  mode STRING,
-				  token STRING,
-				  brief STRING,
-				  status STRING,
-				  referencecode STRING,
-				  lastmodifiedby STRING,
-				  agreementmethod STRING,
-				  creationtime int,
-				  starttime int,
-				  endtime int,
-				  ` + "`when` int);",
-		`CREATE INDEX agreements_token ON agreements (token);`,
-		`CREATE INDEX agreements_brief ON agreements (brief);`}
-	return execQueries(db, queries)
-}
-
-func initSessions(db *sql.DB) error {
-	queries := []string{`CREATE TABLE IF NOT EXISTS sessions (
-				  token STRING,
-				  session STRING,
-				  data TEXT,
-				  endtime int,
-				  ` + "`when` int);",
-		`CREATE INDEX sessions_token ON sessions (token);`,
-		`CREATE INDEX sessions_session ON sessions (session);`}
-	return execQueries(db, queries)
-}
-
 func contains(slice []string, item string) bool {
 	set := make(map[string]struct{}, len(slice))
 	for _, s := range slice {
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// getListValue returns list of strings sent as JSON array or comma separated string
+func getListValue(records map[string]interface{}, key string) []string {
+	var result []string
+	switch value := records[key].(type) {
+	case string:
+		if len(strings.TrimSpace(value)) > 0 {
+			for _, item := range parseFields(value) {
+				result = append(result, strings.TrimSpace(item))
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				result = append(result, strings.TrimSpace(str))
+			}
+		}
+	}
+	return result
+}
+
+// tokenCreate mints a new service token. Token is returned only once.
+func (e mainEnv) tokenCreate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	event := audit("create service token", "", "", "")
+	defer func() { event.submit(e.db) }()
+	if e.enforceAuth(w, r, event) == "" {
+		return
+	}
+	records, err := getJSONPostData(r)
+	if err != nil || records == nil {
+		returnError(w, r, "failed to decode request body", 405, err, event)
+		return
+	}
+	scope := tokenScope{
+		Name:      getStringValue(records, "name"),
+		Access:    getStringValue(records, "access"),
+		Apps:      getListValue(records, "apps"),
+		Fields:    getListValue(records, "fields"),
+		Endpoints: getListValue(records, "endpoints"),
+		Role:      getStringValue(records, "role"),
+	}
+	if len(scope.Access) == 0 {
+		scope.Access = "read"
+	}
+	if expiration := getStringValue(records, "expiration"); len(expiration) > 0 {
+		scope.Endtime, err = parseExpiration(expiration)
+		if err != nil {
+			returnError(w, r, "bad expiration", 405, err, event)
+			return
+		}
+	}
+	event.Title = "create service token " + scope.Name
+	if len(scope.Role) > 0 {
+		role, err := e.findRole(scope.Role)
+		if err != nil {
+			returnError(w, r, "internal error", 405, err, event)
+			return
+		}
+		if role == nil {
+			returnError(w, r, "unknown role", 405, nil, event)
+			return
+		}
+	}
+	xtoken, err := e.db.createServiceToken(scope)
+	if err != nil {
+		returnError(w, r, err.Error(), 405, err, event)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","name":%q,"xtoken":%q}`, scope.Name, xtoken)
+}
+
+// tokenList returns all service tokens without token values
+func (e mainEnv) tokenList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if e.enforceAdmin(w, r) == "" {
+		return
+	}
+	resultJSON, count, err := e.db.listServiceTokens()
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","total":%d,"rows":%s}`, count, resultJSON)
+}
+
+// tokenRevoke deletes service token by name
+func (e mainEnv) tokenRevoke(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	event := audit("revoke service token "+name, "", "", "")
+	defer func() { event.submit(e.db) }()
+	if e.enforceAuth(w, r, event) == "" {
+		return
+	}
+	num, err := e.db.revokeServiceToken(name)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	if num == 0 {
+		returnError(w, r, "token not found", 405, nil, event)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	w.Write([]byte(`{"status":"ok"}`))
+}
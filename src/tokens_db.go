@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/paranoidguy/databunker/src/autocontext"
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Service tokens are named admin tokens for integrations. They are saved in
+// xtokens table with "service" type and can be limited to read-only access,
+// to some apps, user profile fields and API endpoints. Token name is saved
+// as audit identity. Service tokens can not manage other tokens or roles,
+// backup or restore the database, all /v1/sys/ endpoints require the root
+// token. Token with a role is also limited by the role rules.
+
+var regexTokenName = regexp.MustCompile("^[a-zA-Z0-9_.-]{1,64}$")
+
+// tokenScope describes what service token is allowed to do
+type tokenScope struct {
+	Name      string   `json:"name"`
+	Access    string   `json:"access"`
+	Apps      []string `json:"apps,omitempty"`
+	Fields    []string `json:"fields,omitempty"`
+	Endpoints []string `json:"endpoints,omitempty"`
+	Role      string   `json:"role,omitempty"`
+	Endtime   int32    `json:"endtime"`
+	When      int32    `json:"when"`
+}
+
+func splitList(value interface{}) []string {
+	str, _ := value.(string)
+	if len(str) == 0 {
+		return nil
+	}
+	return parseFields(str)
+}
+
+func scopeFromRecord(record bson.M) *tokenScope {
+	scope := tokenScope{
+		Apps:      splitList(record["app"]),
+		Fields:    splitList(record["fields"]),
+		Endpoints: splitList(record["endpoints"]),
+	}
+	scope.Name, _ = record["name"].(string)
+	scope.Access, _ = record["access"].(string)
+	scope.Role, _ = record["role"].(string)
+	scope.Endtime, _ = record["endtime"].(int32)
+	scope.When, _ = record["when"].(int32)
+	return &scope
+}
+
+func (scope tokenScope) validate() error {
+	if regexTokenName.MatchString(scope.Name) == false || scope.Name == "root" {
+		return errors.New("bad token name")
+	}
+	if scope.Access != "read" && scope.Access != "write" {
+		return errors.New("access must be read or write")
+	}
+	if err := validateEndpoints(scope.Endpoints); err != nil {
+		return err
+	}
+	for _, list := range [][]string{scope.Apps, scope.Fields} {
+		for _, value := range list {
+			if len(value) == 0 || strings.Contains(value, ",") {
+				return errors.New("bad app or field name")
+			}
+		}
+	}
+	return nil
+}
+
+// createServiceToken saves a new named token and returns it
+func (dbobj dbcon) createServiceToken(scope tokenScope) (string, error) {
+	if err := scope.validate(); err != nil {
+		return "", err
+	}
+	tokenUUID, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	err = dbobj.withTx(func(dbTx dbcon) error {
+		record, err := dbTx.store.GetRecord2(storage.TblName.Xtokens, "type", "service", "name", scope.Name)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			return errors.New("duplicate token name")
+		}
+		bdoc := bson.M{}
+		bdoc["xtoken"] = dbTx.hashXtoken(tokenUUID)
+		bdoc["idxver"] = int32(indexVersion)
+		bdoc["type"] = "service"
+		bdoc["token"] = ""
+		bdoc["name"] = scope.Name
+		bdoc["access"] = scope.Access
+		bdoc["app"] = strings.Join(scope.Apps, ",")
+		bdoc["fields"] = strings.Join(scope.Fields, ",")
+		bdoc["endpoints"] = strings.Join(scope.Endpoints, ",")
+		bdoc["role"] = scope.Role
+		bdoc["endtime"] = scope.Endtime
+		bdoc["when"] = int32(time.Now().Unix())
+		_, err = dbTx.store.CreateRecord(storage.TblName.Xtokens, bdoc)
+		return err
+	})
+	return tokenUUID, err
+}
+
+// listServiceTokens returns scopes of all service tokens, token values are never returned
+func (dbobj dbcon) listServiceTokens() ([]byte, int, error) {
+	records, err := dbobj.store.GetList(storage.TblName.Xtokens, "type", "service", 0, 0, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	scopes := []*tokenScope{}
+	for _, record := range records {
+		scopes = append(scopes, scopeFromRecord(record))
+	}
+	resultJSON, err := json.Marshal(scopes)
+	return resultJSON, len(scopes), err
+}
+
+// revokeServiceToken deletes service token by name
+func (dbobj dbcon) revokeServiceToken(name string) (int64, error) {
+	return dbobj.store.DeleteRecord2(storage.TblName.Xtokens, "type", "service", "name", name)
+}
+
+// allows checks request method and path. Unlimited tokens have nil scope.
+func (scope *tokenScope) allows(r *http.Request) bool {
+	if scope == nil {
+		return true
+	}
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/v1/sys/") {
+		return false
+	}
+	if scope.Access == "read" && r.Method != "GET" {
+		return false
+	}
+	if len(scope.Endpoints) > 0 && matchEndpoints(scope.Endpoints, r) == false {
+		return false
+	}
+	if len(scope.Apps) > 0 || len(scope.Fields) > 0 {
+		// whole user data is exported, imported or deleted here
+		if strings.HasSuffix(path, "/export") || strings.HasPrefix(path, "/v1/users/import") ||
+			(r.Method == "DELETE" && strings.HasPrefix(path, "/v1/user/")) {
+			return false
+		}
+	}
+	if strings.HasPrefix(path, "/v1/userapp/token/") {
+		// /v1/userapp/token/:token/:appname
+		parts := strings.Split(path, "/")
+		if len(parts) > 5 && scope.allowsApp(parts[5]) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// validateEndpoints checks endpoint rules: optional method, space and
+// path starting with /v1/
+func validateEndpoints(endpoints []string) error {
+	for _, endpoint := range endpoints {
+		path := endpoint
+		if pos := strings.Index(endpoint, " "); pos > 0 {
+			path = endpoint[pos+1:]
+		}
+		if strings.HasPrefix(path, "/v1/") == false || strings.Contains(endpoint, ",") {
+			return errors.New("bad endpoint: " + endpoint)
+		}
+	}
+	return nil
+}
+
+// matchEndpoint checks request against endpoint rule like "GET /v1/user/".
+// Method is optional. Path without * matches as prefix. In path with *,
+// every * matches one path segment and * at the end matches the rest.
+func matchEndpoint(endpoint string, r *http.Request) bool {
+	if pos := strings.Index(endpoint, " "); pos > 0 {
+		if endpoint[:pos] != r.Method {
+			return false
+		}
+		endpoint = endpoint[pos+1:]
+	}
+	if strings.Contains(endpoint, "*") == false {
+		return strings.HasPrefix(r.URL.Path, endpoint)
+	}
+	rule := strings.Split(endpoint, "/")
+	path := strings.Split(r.URL.Path, "/")
+	for i, segment := range rule {
+		if i == len(rule)-1 && segment == "*" {
+			return len(path) >= len(rule)
+		}
+		if i >= len(path) || (segment != "*" && segment != path[i]) {
+			return false
+		}
+	}
+	return len(path) == len(rule)
+}
+
+func matchEndpoints(endpoints []string, r *http.Request) bool {
+	for _, endpoint := range endpoints {
+		if matchEndpoint(endpoint, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (scope *tokenScope) allowsApp(appName string) bool {
+	return scope == nil || len(scope.Apps) == 0 || contains(scope.Apps, appName)
+}
+
+func (scope *tokenScope) allowsField(field string) bool {
+	return scope == nil || len(scope.Fields) == 0 || contains(scope.Fields, field)
+}
+
+// filterApps removes apps not allowed by the scope from JSON list of app names
+func (scope *tokenScope) filterApps(appsJSON []byte) []byte {
+	if scope == nil || len(scope.Apps) == 0 {
+		return appsJSON
+	}
+	var apps []string
+	json.Unmarshal(appsJSON, &apps)
+	allowed := []string{}
+	for _, appName := range apps {
+		if scope.allowsApp(appName) {
+			allowed = append(allowed, appName)
+		}
+	}
+	result, _ := json.Marshal(allowed)
+	return result
+}
+
+// filterFields removes profile fields not allowed by the scope
+func (scope *tokenScope) filterFields(profileJSON []byte) ([]byte, error) {
+	if scope == nil || len(scope.Fields) == 0 || profileJSON == nil {
+		return profileJSON, nil
+	}
+	var profile map[string]interface{}
+	err := json.Unmarshal(profileJSON, &profile)
+	if err != nil {
+		return nil, err
+	}
+	for field := range profile {
+		if scope.allowsField(field) == false {
+			delete(profile, field)
+		}
+	}
+	return json.Marshal(profile)
+}
+
+// limitFields returns field names allowed by the scope. All allowed fields
+// are returned when the list is empty. User token is not a profile field.
+// Nested field like "address.city" is allowed by its top level field.
+func (scope *tokenScope) limitFields(fields []string) []string {
+	if scope == nil || len(scope.Fields) == 0 {
+		return fields
+	}
+	if len(fields) == 0 {
+		return scope.Fields
+	}
+	allowed := []string{}
+	for _, field := range fields {
+		if field == "token" || scope.allowsField(strings.SplitN(field, ".", 2)[0]) {
+			allowed = append(allowed, field)
+		}
+	}
+	return allowed
+}
+
+// filterEventFields removes profile fields not allowed by the scope from
+// before and after values of audit event
+func (scope *tokenScope) filterEventFields(eventJSON []byte) ([]byte, error) {
+	if scope == nil || len(scope.Fields) == 0 {
+		return eventJSON, nil
+	}
+	var event map[string]json.RawMessage
+	err := json.Unmarshal(eventJSON, &event)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"before", "after"} {
+		if value, ok := event[name]; ok {
+			if event[name], err = scope.filterFields(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(event)
+}
+
+// allowsProfile checks that all fields of user profile change are allowed by the scope
+func (scope *tokenScope) allowsProfile(profileJSON []byte) bool {
+	if scope == nil || len(scope.Fields) == 0 {
+		return true
+	}
+	var profile map[string]interface{}
+	if json.Unmarshal(profileJSON, &profile) != nil {
+		return false
+	}
+	for field := range profile {
+		if scope.allowsField(field) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// requestScope returns scope of the service token used in the request,
+// it is nil for the root token and user login tokens
+func requestScope(r *http.Request) *tokenScope {
+	scope, _ := autocontext.Get(r, "scope").(*tokenScope)
+	return scope
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func helpCreateServiceToken(dataJSON string) (map[string]interface{}, error) {
+	url := "http://localhost:3000/v1/sys/token"
+	request := httptest.NewRequest("POST", url, strings.NewReader(dataJSON))
+	request.Header.Set("X-Bunker-Token", rootToken)
+	return helpServe(request)
+}
+
+func helpTokenRequest(method string, url string, xtoken string, dataJSON string) (map[string]interface{}, error) {
+	request := httptest.NewRequest(method, "http://localhost:3000"+url, strings.NewReader(dataJSON))
+	request.Header.Set("X-Bunker-Token", xtoken)
+	return helpServe(request)
+}
+
+func TestServiceTokenScope(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"scopeuser","name":"scope","phone":"4444"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	helpCreateUserApp(userTOKEN, "scopeapp", `{"plan":"gold"}`)
+	helpCreateUserApp(userTOKEN, "otherapp", `{"plan":"silver"}`)
+	raw, err = helpCreateServiceToken(`{"name":"crm","access":"read","apps":["scopeapp"],"fields":"login,name"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create service token: %v", raw)
+	}
+	xtoken := raw["xtoken"].(string)
+	raw, _ = helpCreateServiceToken(`{"name":"crm","access":"read"}`)
+	if raw["status"].(string) == "ok" {
+		t.Fatalf("duplicate token name should fail")
+	}
+	raw, err = helpTokenRequest("GET", "/v1/user/token/"+userTOKEN, xtoken, "")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to get user with service token: %v", raw)
+	}
+	data := raw["data"].(map[string]interface{})
+	if data["name"] != "scope" || data["phone"] != nil {
+		t.Fatalf("user fields are not filtered: %v", data)
+	}
+	raw, err = helpTokenRequest("GET", "/v1/userapp/token/"+userTOKEN+"/scopeapp", xtoken, "")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to get allowed app: %v", raw)
+	}
+	_, err = helpTokenRequest("GET", "/v1/userapp/token/"+userTOKEN+"/otherapp", xtoken, "")
+	if err == nil {
+		t.Fatalf("app outside of the scope should be denied")
+	}
+	raw, _ = helpTokenRequest("GET", "/v1/userapp/token/"+userTOKEN, xtoken, "")
+	if apps := raw["apps"].([]interface{}); len(apps) != 1 || apps[0] != "scopeapp" {
+		t.Fatalf("app list is not filtered: %v", raw)
+	}
+	_, err = helpTokenRequest("PUT", "/v1/user/token/"+userTOKEN, xtoken, `{"name":"new"}`)
+	if err == nil {
+		t.Fatalf("read-only token should not change user")
+	}
+	for _, url := range []string{"/v1/sys/tokens", "/v1/sys/backup", "/v1/user/token/" + userTOKEN + "/export"} {
+		if _, err = helpTokenRequest("GET", url, xtoken, ""); err == nil {
+			t.Fatalf("%s should be denied for service token", url)
+		}
+	}
+	raw, _ = helpTokenRequest("GET", "/v1/audit/list/"+userTOKEN, rootToken, "")
+	rows, _ := json.Marshal(raw["rows"])
+	if raw["status"].(string) != "ok" || strings.Contains(string(rows), `"identity":"crm"`) == false {
+		t.Fatalf("token name is not saved in audit: %v", raw)
+	}
+	raw, _ = helpTokenRequest("GET", "/v1/sys/tokens", rootToken, "")
+	if raw["status"].(string) != "ok" || raw["total"].(float64) < 1 {
+		t.Fatalf("failed to list service tokens: %v", raw)
+	}
+	raw, _ = helpTokenRequest("DELETE", "/v1/sys/token/crm", rootToken, "")
+	if raw["status"].(string) != "ok" {
+		t.Fatalf("failed to revoke service token: %v", raw)
+	}
+	_, err = helpTokenRequest("GET", "/v1/user/token/"+userTOKEN, xtoken, "")
+	if err == nil {
+		t.Fatalf("revoked token should be denied")
+	}
+	helpDeleteUser("token", userTOKEN)
+}
+
+func TestServiceTokenEndpoints(t *testing.T) {
+	raw, err := helpCreateServiceToken(`{"name":"auditor","access":"read","endpoints":["GET /v1/audit/"],"expiration":"1h"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create service token: %v", raw)
+	}
+	xtoken := raw["xtoken"].(string)
+	raw, err = helpTokenRequest("GET", "/v1/audit/admin", xtoken, "")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to access allowed endpoint: %v", raw)
+	}
+	if _, err = helpTokenRequest("GET", "/v1/users", xtoken, ""); err == nil {
+		t.Fatalf("endpoint outside of the scope should be denied")
+	}
+	raw, _ = helpCreateServiceToken(`{"name":"root","access":"write"}`)
+	if raw["status"].(string) == "ok" {
+		t.Fatalf("reserved token name should fail")
+	}
+	helpTokenRequest("DELETE", "/v1/sys/token/auditor", rootToken, "")
+}
+
+func TestServiceTokenRoles(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"roleuser","name":"role"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	raw, err = helpCreateServiceToken(`{"name":"helpdesk","access":"write","role":"support"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create service token: %v", raw)
+	}
+	xtoken := raw["xtoken"].(string)
+	raw, err = helpTokenRequest("GET", "/v1/user/token/"+userTOKEN, xtoken, "")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("support should read user: %v", raw)
+	}
+	if _, err = helpTokenRequest("GET", "/v1/user/token/"+userTOKEN+"/export", xtoken, ""); err == nil {
+		t.Fatalf("support should not export user")
+	}
+	if _, err = helpTokenRequest("DELETE", "/v1/user/token/"+userTOKEN, xtoken, ""); err == nil {
+		t.Fatalf("support should not delete user")
+	}
+	// role saved with API overrides built-in role
+	raw, _ = helpTokenRequest("POST", "/v1/sys/role/support", rootToken, `{"allow":["GET /v1/audit/"]}`)
+	if raw["status"].(string) != "ok" {
+		t.Fatalf("failed to save role: %v", raw)
+	}
+	if _, err = helpTokenRequest("GET", "/v1/user/token/"+userTOKEN, xtoken, ""); err == nil {
+		t.Fatalf("changed role should not read user")
+	}
+	raw, _ = helpTokenRequest("GET", "/v1/sys/roles", rootToken, "")
+	if raw["status"].(string) != "ok" || raw["total"].(float64) < 3 {
+		t.Fatalf("failed to list roles: %v", raw)
+	}
+	if _, err = helpTokenRequest("GET", "/v1/sys/roles", xtoken, ""); err == nil {
+		t.Fatalf("service token should not list roles")
+	}
+	raw, _ = helpTokenRequest("DELETE", "/v1/sys/role/support", rootToken, "")
+	if raw["status"].(string) != "ok" {
+		t.Fatalf("failed to delete role: %v", raw)
+	}
+	raw, _ = helpCreateServiceToken(`{"name":"badrole","role":"unknown"}`)
+	if raw["status"].(string) == "ok" {
+		t.Fatalf("token with unknown role should fail")
+	}
+	helpTokenRequest("DELETE", "/v1/sys/token/helpdesk", rootToken, "")
+	helpDeleteUser("token", userTOKEN)
+}
+
+func TestServiceTokenScopeRecords(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"scoperecords","name":"records","phone":"5555"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	helpCreateUserApp(userTOKEN, "scopeapp", `{"plan":"gold"}`)
+	helpCreateUserApp(userTOKEN, "otherapp", `{"plan":"silver"}`)
+	helpChangeUser("token", userTOKEN, `{"name":"records2","phone":"6666"}`)
+	raw, err = helpCreateServiceToken(`{"name":"crmrecords","access":"write","apps":["scopeapp"],"fields":"login,name"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create service token: %v", raw)
+	}
+	xtoken := raw["xtoken"].(string)
+	defer helpTokenRequest("DELETE", "/v1/sys/token/crmrecords", rootToken, "")
+
+	// shared record is limited to the allowed fields
+	for _, dataJSON := range []string{`{}`, `{"fields":"name,phone"}`} {
+		raw, err = helpTokenRequest("POST", "/v1/sharedrecord/token/"+userTOKEN, xtoken, dataJSON)
+		if err != nil || raw["status"].(string) != "ok" {
+			t.Fatalf("failed to create shared record: %v", raw)
+		}
+		raw, err = helpTokenRequest("GET", "/v1/get/"+raw["record"].(string), "", "")
+		if err != nil || raw["status"].(string) != "ok" {
+			t.Fatalf("failed to get shared record: %v", raw)
+		}
+		data := raw["data"].(map[string]interface{})
+		if data["name"] != "records2" || data["phone"] != nil {
+			t.Fatalf("shared record fields are not filtered: %v", data)
+		}
+	}
+	if _, err = helpTokenRequest("POST", "/v1/sharedrecord/token/"+userTOKEN, xtoken, `{"fields":"phone"}`); err == nil {
+		t.Fatalf("shared record with not allowed fields should fail")
+	}
+	if _, err = helpTokenRequest("POST", "/v1/sharedrecord/token/"+userTOKEN, xtoken, `{"app":"otherapp"}`); err == nil {
+		t.Fatalf("shared record of app outside of the scope should fail")
+	}
+
+	// audit event values are filtered
+	raw, _ = helpGetUserAuditEvents(userTOKEN, "?limit=100")
+	profileEvent := ""
+	appEvent := ""
+	for _, row := range raw["rows"].([]interface{}) {
+		record := row.(map[string]interface{})
+		if record["title"] == "change user record by token" {
+			profileEvent = record["atoken"].(string)
+		} else if record["app"] == "otherapp" {
+			appEvent = record["atoken"].(string)
+		}
+	}
+	if len(profileEvent) == 0 || len(appEvent) == 0 {
+		t.Fatalf("audit events are not found: %v", raw)
+	}
+	raw, err = helpTokenRequest("GET", "/v1/audit/get/"+profileEvent, xtoken, "")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to get audit event: %v", raw)
+	}
+	eventJSON, _ := json.Marshal(raw["event"])
+	if strings.Contains(string(eventJSON), "records2") == false || strings.Contains(string(eventJSON), "6666") {
+		t.Fatalf("audit event fields are not filtered: %s", eventJSON)
+	}
+	if _, err = helpTokenRequest("GET", "/v1/audit/get/"+appEvent, xtoken, ""); err == nil {
+		t.Fatalf("audit event of app outside of the scope should be denied")
+	}
+
+	// user request values are filtered
+	rtoken, _, err := e.db.saveUserRequest("change-profile", userTOKEN, "", "", []byte(`{"name":"new","phone":"7777"}`))
+	if err != nil {
+		t.Fatalf("failed to save user request: %s", err)
+	}
+	raw, err = helpTokenRequest("GET", "/v1/request/"+rtoken, xtoken, "")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to get user request: %v", raw)
+	}
+	change := raw["change"].(map[string]interface{})
+	original := raw["original"].(map[string]interface{})
+	if change["name"] != "new" || change["phone"] != nil || original["phone"] != nil {
+		t.Fatalf("user request fields are not filtered: %v", raw)
+	}
+	rtoken, _, _ = e.db.saveUserRequest("change-app-data", userTOKEN, "otherapp", "", []byte(`{"plan":"bronze"}`))
+	if _, err = helpTokenRequest("GET", "/v1/request/"+rtoken, xtoken, ""); err == nil {
+		t.Fatalf("user request of app outside of the scope should be denied")
+	}
+	helpDeleteUser("token", userTOKEN)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// sealState keeps master key shares submitted to a sealed server
+type sealState struct {
+	sync.Mutex
+	sealed    bool
+	threshold int
+	keycheck  string
+	shares    [][]byte
+	onUnseal  func(masterKey []byte)
+}
+
+var seal sealState
+
+func (s *sealState) isSealed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.sealed
+}
+
+// sealedHandler rejects all requests except status and unseal while server is sealed
+func sealedHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if seal.isSealed() && path != "/v1/status" && path != "/status" && path != "/v1/sys/unseal" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(503)
+			fmt.Fprintf(w, `{"status":"error","message":"databunker is sealed"}`)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// unsealDB API call accepts one master key share. When enough shares are
+// submitted, master key is restored and server starts to serve requests.
+func (e mainEnv) unsealDB(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	records, err := getJSONPostData(r)
+	if err != nil {
+		returnError(w, r, "failed to decode request body", 405, err, nil)
+		return
+	}
+	shareStr := ""
+	if value, ok := records["share"]; ok {
+		shareStr, _ = value.(string)
+	}
+	share, err := hex.DecodeString(shareStr)
+	if err != nil || len(share) < 2 {
+		returnError(w, r, "bad share", 405, errors.New("bad share"), nil)
+		return
+	}
+	seal.Lock()
+	defer seal.Unlock()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if seal.sealed == false {
+		w.WriteHeader(200)
+		fmt.Fprintf(w, `{"status":"ok","sealed":false}`)
+		return
+	}
+	for _, other := range seal.shares {
+		if bytes.Equal(other, share) {
+			returnError(w, r, "duplicate share", 405, errors.New("duplicate share"), nil)
+			return
+		}
+	}
+	seal.shares = append(seal.shares, share)
+	if len(seal.shares) < seal.threshold {
+		w.WriteHeader(200)
+		fmt.Fprintf(w, `{"status":"ok","sealed":true,"progress":%d,"threshold":%d}`, len(seal.shares), seal.threshold)
+		return
+	}
+	masterKey, err := combineShares(seal.shares)
+	// start from scratch if shares are wrong
+	seal.shares = nil
+	if err != nil || masterKeyCheck(masterKey) != seal.keycheck {
+		returnError(w, r, "failed to unseal, wrong shares", 405, err, nil)
+		return
+	}
+	seal.sealed = false
+	fmt.Println("Databunker is unsealed")
+	if seal.onUnseal != nil {
+		seal.onUnseal(masterKey)
+	}
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","sealed":false}`)
+}
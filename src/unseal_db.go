@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// masterKeyCheck returns value used to verify master key, the key itself is never stored
+func masterKeyCheck(masterKey []byte) string {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("databunker master key check"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getSealConfig returns master key shares configuration, nil if master key is not split
+func getSealConfig(store storage.Storage) (bson.M, error) {
+	records, err := store.GetList0(storage.TblName.Sealconfig, 0, 1, "")
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+// saveSealConfig stores number of master key shares and check value of the current key
+func (dbobj dbcon) saveSealConfig(shares int32, threshold int32) error {
+	old, err := getSealConfig(dbobj.store)
+	if err != nil {
+		return err
+	}
+	bdoc := bson.M{}
+	bdoc["shares"] = shares
+	bdoc["threshold"] = threshold
+	bdoc["keycheck"] = masterKeyCheck(dbobj.masterKey)
+	bdoc["when"] = int32(time.Now().Unix())
+	if old != nil {
+		_, err = dbobj.store.UpdateRecord(storage.TblName.Sealconfig, "keycheck", old["keycheck"].(string), &bdoc)
+		return err
+	}
+	_, err = dbobj.store.CreateRecord(storage.TblName.Sealconfig, &bdoc)
+	return err
+}
+
+// checkMasterKey verifies master key when key check value is stored in database.
+// During key rotation the old key is accepted as well.
+func checkMasterKey(store storage.Storage, masterKey []byte, oldMasterKey []byte) error {
+	config, err := getSealConfig(store)
+	if err != nil || config == nil {
+		return err
+	}
+	keycheck := config["keycheck"].(string)
+	if keycheck == masterKeyCheck(masterKey) {
+		return nil
+	}
+	if len(oldMasterKey) > 0 && keycheck == masterKeyCheck(oldMasterKey) {
+		return nil
+	}
+	return errors.New("master key does not match database")
+}
+
+// printMasterKeyShares splits master key and prints the shares
+func printMasterKeyShares(masterKey []byte, shares int, threshold int) error {
+	parts, err := splitSecret(masterKey, shares, threshold)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Master key is split into %d shares, %d of them are required to unseal databunker.\n", shares, threshold)
+	fmt.Printf("Give every share to a different operator.\n\n")
+	for idx, part := range parts {
+		fmt.Printf("Master key share %d: %x\n", idx+1, part)
+	}
+	fmt.Println("")
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func helpUnseal(share []byte) (map[string]interface{}, int) {
+	url := "http://localhost:3000/v1/sys/unseal"
+	request := httptest.NewRequest("POST", url, strings.NewReader(fmt.Sprintf(`{"share":"%x"}`, share)))
+	request.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	sealedHandler(router).ServeHTTP(rr, request)
+	var raw map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &raw)
+	return raw, rr.Code
+}
+
+func TestShamirSplitCombine(t *testing.T) {
+	secret, _ := generateMasterKey()
+	shares, err := splitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("failed to split secret: %s", err)
+	}
+	result, err := combineShares([][]byte{shares[4], shares[0], shares[2]})
+	if err != nil || bytes.Equal(result, secret) == false {
+		t.Fatalf("failed to combine shares\n")
+	}
+	result, _ = combineShares([][]byte{shares[1], shares[3]})
+	if bytes.Equal(result, secret) {
+		t.Fatalf("secret restored with less shares than threshold\n")
+	}
+	if _, err = splitSecret(secret, 2, 3); err == nil {
+		t.Fatalf("threshold can not be above number of shares\n")
+	}
+}
+
+func TestUnseal(t *testing.T) {
+	shares, _ := splitSecret(e.db.masterKey, 3, 2)
+	var unsealedKey []byte
+	seal.sealed = true
+	seal.threshold = 2
+	seal.keycheck = masterKeyCheck(e.db.masterKey)
+	seal.onUnseal = func(masterKey []byte) { unsealedKey = masterKey }
+	defer func() {
+		seal.sealed = false
+		seal.onUnseal = nil
+	}()
+	request := httptest.NewRequest("GET", "http://localhost:3000/v1/userapp/list", nil)
+	request.Header.Set("X-Bunker-Token", rootToken)
+	rr := httptest.NewRecorder()
+	sealedHandler(router).ServeHTTP(rr, request)
+	if rr.Code != 503 {
+		t.Fatalf("sealed server should reject requests, got: %d\n", rr.Code)
+	}
+	raw, _ := helpUnseal(shares[0])
+	if raw["sealed"] != true || raw["progress"].(float64) != 1 {
+		t.Fatalf("wrong unseal progress: %v\n", raw)
+	}
+	wrong := append([]byte{}, shares[1]...)
+	wrong[0] ^= 1
+	_, code := helpUnseal(wrong)
+	if code == 200 || seal.isSealed() == false {
+		t.Fatalf("wrong share should not unseal\n")
+	}
+	helpUnseal(shares[2])
+	raw, code = helpUnseal(shares[1])
+	if code != 200 || raw["sealed"] != false || bytes.Equal(unsealedKey, e.db.masterKey) == false {
+		t.Fatalf("failed to unseal: %v\n", raw)
+	}
+}
@@ -143,6 +143,7 @@ func (e mainEnv) userappList(w http.ResponseWriter, r *http.Request, ps httprout
 		returnError(w, r, "internal error", 405, err, event)
 		return
 	}
+	result = requestScope(r).filterApps(result)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(200)
 	fmt.Fprintf(w, `{"status":"ok","token":"%s","apps":%s}`, userTOKEN, result)
@@ -214,6 +215,7 @@ func (e mainEnv) appList(w http.ResponseWriter, r *http.Request, ps httprouter.P
 		returnError(w, r, "internal error", 405, err, nil)
 		return
 	}
+	result = requestScope(r).filterApps(result)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(200)
 	fmt.Fprintf(w, `{"status":"ok","apps":%s}`, result)
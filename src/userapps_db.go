@@ -71,11 +71,13 @@ func (dbobj dbcon) updateAppRecord(jsonDataPatch []byte, userTOKEN string, appNa
 		return userTOKEN, err
 	}
 	// get user key
-	userKey := userBson["key"].(string)
-	recordKey, err := base64.StdEncoding.DecodeString(userKey)
+	recordKey, err := dbobj.userRecordKey(userBson)
 	if err != nil {
 		return userTOKEN, err
 	}
+	if recordKey == nil {
+		return userTOKEN, errors.New("user record not found")
+	}
 
 	record, err := dbobj.store.GetRecordInTable("app_"+appName, "token", userTOKEN)
 	if err != nil {
@@ -90,7 +92,7 @@ func (dbobj dbcon) updateAppRecord(jsonDataPatch []byte, userTOKEN string, appNa
 	if err != nil {
 		return userTOKEN, err
 	}
-	decrypted, err := decrypt(dbobj.masterKey, recordKey, encData)
+	decrypted, err := dbobj.decryptRecord(recordKey, encData)
 	if err != nil {
 		return userTOKEN, err
 	}
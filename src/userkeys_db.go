@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// User data keys are kept in userkeys table, apart from the encrypted
+// records. Rows of this table are never saved in backups, so when the key
+// is destroyed by forget-me, user profile, app records and sessions can not
+// be decrypted in any older backup. Keys are backed up separately with
+// exportUserKeys. Keys are wrapped with key-encryption key
+// when encryption.kek is set. Users created before the table was added keep
+// the key in users.key until migrateUserKeys moves it.
+
+// userKEK wraps user data keys, keys are stored as is when it is nil
+var userKEK []byte
+
+// setUserKEK sets key-encryption key from hex string, empty string disables wrapping
+func setUserKEK(keyStr string) error {
+	if len(keyStr) == 0 {
+		userKEK = nil
+		return nil
+	}
+	if len(keyStr) != 64 || isValidHex(keyStr) == false {
+		return errors.New("kek must be 64 hex characters")
+	}
+	kek, err := hex.DecodeString(keyStr)
+	if err != nil {
+		return err
+	}
+	userKEK = kek
+	return nil
+}
+
+// kekID returns short identifier of the key-encryption key saved with wrapped keys
+func kekID(kek []byte) string {
+	mac := hmac.New(sha256.New, kek)
+	mac.Write([]byte("databunker kek id"))
+	return hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+func kekCipher(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapUserKey returns encoded user key and id of the key-encryption key.
+// User token is authenticated, so wrapped key can not be moved to other user.
+func wrapUserKey(userTOKEN string, recordKey []byte) (string, string, error) {
+	if userKEK == nil {
+		return base64.StdEncoding.EncodeToString(recordKey), "", nil
+	}
+	aead, err := kekCipher(userKEK)
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", err
+	}
+	sealed := aead.Seal(nonce, nonce, recordKey, []byte(userTOKEN))
+	return base64.StdEncoding.EncodeToString(sealed), kekID(userKEK), nil
+}
+
+// unwrapUserKey returns user key saved in userkeys table record
+func unwrapUserKey(userTOKEN string, record bson.M) ([]byte, error) {
+	encoded, _ := record["key"].(string)
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	kek, _ := record["kek"].(string)
+	if len(kek) == 0 {
+		return data, nil
+	}
+	if userKEK == nil || kek != kekID(userKEK) {
+		return nil, errors.New("user key is wrapped with a different kek")
+	}
+	aead, err := kekCipher(userKEK)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) <= aead.NonceSize() {
+		return nil, errors.New("bad wrapped user key")
+	}
+	nonce := data[:aead.NonceSize()]
+	return aead.Open(nil, nonce, data[aead.NonceSize():], []byte(userTOKEN))
+}
+
+// saveUserKey saves data key of a new user
+func (dbobj dbcon) saveUserKey(userTOKEN string, recordKey []byte) error {
+	wrapped, kek, err := wrapUserKey(userTOKEN, recordKey)
+	if err != nil {
+		return err
+	}
+	bdoc := bson.M{"token": userTOKEN, "key": wrapped, "kek": kek, "when": int32(time.Now().Unix())}
+	_, err = dbobj.store.CreateRecord(storage.TblName.Userkeys, &bdoc)
+	return err
+}
+
+// userRecordKey returns data key of the user, nil when the key is destroyed
+func (dbobj dbcon) userRecordKey(userBson bson.M) ([]byte, error) {
+	if userKey, _ := userBson["key"].(string); len(userKey) > 0 {
+		// key is not moved to userkeys table yet
+		return base64.StdEncoding.DecodeString(userKey)
+	}
+	userTOKEN, _ := userBson["token"].(string)
+	record, err := dbobj.store.GetRecord(storage.TblName.Userkeys, "token", userTOKEN)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return unwrapUserKey(userTOKEN, record)
+}
+
+// destroyUserKey deletes data key of the user, records encrypted with it
+// can not be decrypted anymore
+func (dbobj dbcon) destroyUserKey(userTOKEN string) (int64, error) {
+	num, err := dbobj.store.DeleteRecord(storage.TblName.Userkeys, "token", userTOKEN)
+	if err != nil {
+		return 0, err
+	}
+	if num == 0 {
+		userBson, err := dbobj.lookupUserRecord(userTOKEN)
+		if err != nil {
+			return 0, err
+		}
+		if userKey, _ := userBson["key"].(string); len(userKey) > 0 {
+			num = 1
+		}
+	}
+	bdel := bson.M{"key": ""}
+	_, err = dbobj.store.CleanupRecord(storage.TblName.Users, "token", userTOKEN, bdel)
+	return num, err
+}
+
+// replaceUserKey destroys current data key of the user and saves a new one
+func (dbobj dbcon) replaceUserKey(userTOKEN string, recordKey []byte) (int64, error) {
+	num, err := dbobj.destroyUserKey(userTOKEN)
+	if err != nil {
+		return 0, err
+	}
+	return num, dbobj.saveUserKey(userTOKEN, recordKey)
+}
+
+// migrateUserKeys moves user keys from users table to userkeys table and
+// wraps stored keys when key-encryption key is set. Job is saved with kek
+// id, so it runs again when a new kek is configured.
+func (dbobj dbcon) migrateUserKeys(stop chan struct{}) error {
+	phases := []batchPhase{
+		{"users", storage.TblName.Users, "token", func(record bson.M) error {
+			userKey, _ := record["key"].(string)
+			if len(userKey) == 0 {
+				return nil
+			}
+			recordKey, err := base64.StdEncoding.DecodeString(userKey)
+			if err != nil {
+				return err
+			}
+			return dbobj.withTx(func(dbTx dbcon) error {
+				_, err := dbTx.replaceUserKey(record["token"].(string), recordKey)
+				return err
+			})
+		}},
+	}
+	title := "user key table"
+	if userKEK != nil {
+		title = "user key table, kek " + kekID(userKEK)
+		phases = append(phases, batchPhase{"userkeys", storage.TblName.Userkeys, "token", func(record bson.M) error {
+			if kek, _ := record["kek"].(string); len(kek) > 0 {
+				return nil
+			}
+			userTOKEN := record["token"].(string)
+			recordKey, err := unwrapUserKey(userTOKEN, record)
+			if err != nil {
+				return err
+			}
+			wrapped, kek, err := wrapUserKey(userTOKEN, recordKey)
+			if err != nil {
+				return err
+			}
+			bdoc := bson.M{"key": wrapped, "kek": kek}
+			_, err = dbobj.store.UpdateRecord(storage.TblName.Userkeys, "token", userTOKEN, &bdoc)
+			return err
+		}})
+	}
+	_, err := dbobj.runBatchJob(title, phases, stop)
+	return err
+}
+
+// userKeysExport is the key table backup. It is a separate artifact from the
+// database backup, so that backups alone can not be decrypted and keys
+// destroyed by forget-me are gone from new exports. All keys are wrapped
+// with the key-encryption key. To recover on a new instance, import keys
+// with the same kek first and then restore the database backup.
+type userKeysExport struct {
+	Version int           `json:"version"`
+	Created int32         `json:"created"`
+	Kek     string        `json:"kek"`
+	Keys    []exportedKey `json:"keys"`
+}
+
+type exportedKey struct {
+	Token string `json:"token"`
+	Key   string `json:"key"`
+	Kek   string `json:"kek"`
+	When  int32  `json:"when"`
+}
+
+// exportUserKeys returns all keys of userkeys table wrapped with the kek
+func (dbobj dbcon) exportUserKeys() (*userKeysExport, error) {
+	if userKEK == nil {
+		return nil, errors.New("encryption.kek is required to export user keys")
+	}
+	records, err := dbobj.store.GetList0(storage.TblName.Userkeys, 0, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	export := userKeysExport{Version: 1, Created: int32(time.Now().Unix()), Kek: kekID(userKEK), Keys: []exportedKey{}}
+	for _, record := range records {
+		key := exportedKey{}
+		key.Token, _ = record["token"].(string)
+		key.Key, _ = record["key"].(string)
+		key.Kek, _ = record["kek"].(string)
+		key.When, _ = record["when"].(int32)
+		if len(key.Kek) == 0 {
+			// key is not wrapped by migrateUserKeys yet
+			recordKey, err := unwrapUserKey(key.Token, record)
+			if err != nil {
+				return nil, err
+			}
+			key.Key, key.Kek, err = wrapUserKey(key.Token, recordKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		export.Keys = append(export.Keys, key)
+	}
+	return &export, nil
+}
+
+// importUserKeys saves keys from key export that are missing in userkeys
+// table, existing keys are not changed. Every key is unwrapped first, so
+// keys of other kek and modified keys are rejected. Returns number of
+// imported keys.
+func (dbobj dbcon) importUserKeys(data []byte) (int, error) {
+	if userKEK == nil {
+		return 0, errors.New("encryption.kek is required to import user keys")
+	}
+	var export userKeysExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return 0, err
+	}
+	if export.Version != 1 {
+		return 0, errors.New("bad user keys export")
+	}
+	imported := 0
+	err := dbobj.withTx(func(dbTx dbcon) error {
+		for _, key := range export.Keys {
+			record := bson.M{"token": key.Token, "key": key.Key, "kek": key.Kek, "when": key.When}
+			if len(key.Kek) == 0 {
+				return errors.New("user key is not wrapped: " + key.Token)
+			}
+			if _, err := unwrapUserKey(key.Token, record); err != nil {
+				return errors.New("failed to unwrap user key " + key.Token + ": " + err.Error())
+			}
+			existing, err := dbTx.store.GetRecord(storage.TblName.Userkeys, "token", key.Token)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				continue
+			}
+			if _, err = dbTx.store.CreateRecord(storage.TblName.Userkeys, &record); err != nil {
+				return err
+			}
+			imported++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return imported, nil
+}
+
+func (dbobj dbcon) importUserKeysFile(filename string) (int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return dbobj.importUserKeys(data)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUserKeyShredding(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"shreduser","email":"shred@user.com","name":"shred"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	userBson, _ := e.db.lookupUserRecord(userTOKEN)
+	if userKey, _ := userBson["key"].(string); len(userKey) > 0 {
+		t.Fatalf("user key is saved in users table\n")
+	}
+	setUserKEK(strings.Repeat("ab", 32))
+	defer setUserKEK("")
+	dump, err := helpBackupRequest(rootToken)
+	if err != nil || strings.Contains(string(dump), `INSERT INTO "userkeys"`) {
+		t.Fatalf("user keys are saved in backup: %s", err)
+	}
+	raw, _ = helpDeleteUser("token", userTOKEN)
+	if raw["status"].(string) != "ok" || raw["erasure"].(map[string]interface{})["userkeys"] != float64(1) {
+		t.Fatalf("failed to destroy user key: %v", raw)
+	}
+	// user record in the backup can not be decrypted after forget-me
+	tmp, err := storage.OpenDump(dump)
+	if err != nil {
+		t.Fatalf("failed to open backup: %s", err)
+	}
+	defer tmp.CloseDB()
+	userBson, _ = tmp.GetRecord(storage.TblName.Users, "token", userTOKEN)
+	if userBson == nil || len(userBson["data"].(string)) == 0 {
+		t.Fatalf("user is not found in backup\n")
+	}
+	recordKey, err := e.db.userRecordKey(userBson)
+	if err != nil || recordKey != nil {
+		t.Fatalf("user key is not destroyed\n")
+	}
+}
+
+func TestUserKeyMigration(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"legacykeyuser","name":"legacy"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	// key saved in users table by the previous version
+	userBson, _ := e.db.lookupUserRecord(userTOKEN)
+	recordKey, _ := e.db.userRecordKey(userBson)
+	e.db.store.DeleteRecord(storage.TblName.Userkeys, "token", userTOKEN)
+	bdoc := bson.M{"key": base64.StdEncoding.EncodeToString(recordKey)}
+	e.db.store.UpdateRecord(storage.TblName.Users, "token", userTOKEN, &bdoc)
+	raw, err = helpGetUser("login", "legacykeyuser")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to get user with legacy key: %v", raw)
+	}
+	err = e.db.migrateUserKeys(nil)
+	if err != nil {
+		t.Fatalf("failed to migrate user keys: %s", err)
+	}
+	userBson, _ = e.db.lookupUserRecord(userTOKEN)
+	migratedKey, err := e.db.userRecordKey(userBson)
+	if userKey, _ := userBson["key"].(string); len(userKey) > 0 || err != nil ||
+		bytes.Equal(migratedKey, recordKey) == false {
+		t.Fatalf("user key is not moved to key table: %s", err)
+	}
+	helpDeleteUser("token", userTOKEN)
+}
+
+func TestUserKeyWrapping(t *testing.T) {
+	err := setUserKEK(strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatalf("failed to set kek: %s", err)
+	}
+	defer setUserKEK("")
+	raw, err := helpCreateUser(`{"login":"kekuser","email":"kek@user.com","name":"kek"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	record, _ := e.db.store.GetRecord(storage.TblName.Userkeys, "token", userTOKEN)
+	if record == nil || record["kek"].(string) != kekID(userKEK) {
+		t.Fatalf("user key is not wrapped\n")
+	}
+	raw, err = helpGetUser("login", "kekuser")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to get user with wrapped key: %v", raw)
+	}
+	setUserKEK(strings.Repeat("cd", 32))
+	raw, _ = helpGetUser("login", "kekuser")
+	if raw["status"].(string) == "ok" {
+		t.Fatalf("wrapped key should not be used with other kek\n")
+	}
+	setUserKEK(strings.Repeat("ab", 32))
+	helpDeleteUser("token", userTOKEN)
+}
+
+func TestUserKeyExport(t *testing.T) {
+	request := httptest.NewRequest("GET", "http://localhost:3000/v1/sys/backup/keys", nil)
+	request.Header.Set("X-Bunker-Token", rootToken)
+	if _, err := helpServe0(request); err == nil {
+		t.Fatalf("user keys should not be exported without kek\n")
+	}
+	setUserKEK(strings.Repeat("ab", 32))
+	defer setUserKEK("")
+	raw, err := helpCreateUser(`{"login":"exportkeyuser","email":"exportkey@user.com","name":"export"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	defer helpDeleteUser("token", userTOKEN)
+	dump, err := helpBackupRequest(rootToken)
+	if err != nil {
+		t.Fatalf("failed to backup db: %s", err)
+	}
+	request = httptest.NewRequest("GET", "http://localhost:3000/v1/sys/backup/keys", nil)
+	request.Header.Set("X-Bunker-Token", rootToken)
+	export, err := helpServe0(request)
+	if err != nil || strings.Contains(string(export), userTOKEN) == false {
+		t.Fatalf("failed to export user keys: %s", export)
+	}
+	total, _ := e.db.store.CountRecords0(storage.TblName.Userkeys)
+	// imported keys are wrapped, keys of other tests are restored as they were
+	saved, _ := e.db.store.GetList0(storage.TblName.Userkeys, 0, 0, "")
+	defer func() {
+		e.db.store.DeleteOlder(storage.TblName.Userkeys, -1000, "", "")
+		for _, record := range saved {
+			e.db.store.CreateRecord(storage.TblName.Userkeys, &record)
+		}
+	}()
+
+	// new instance has no user keys
+	e.db.store.DeleteOlder(storage.TblName.Userkeys, -1000, "", "")
+	if err = e.db.validateBackup(dump); err == nil || strings.Contains(err.Error(), "user keys") == false {
+		t.Fatalf("backup without user keys should fail validation: %v", err)
+	}
+	forged := strings.Replace(string(export), userTOKEN, "00000000-0000-0000-0000-000000000000", 1)
+	if _, err = e.db.importUserKeys([]byte(forged)); err == nil {
+		t.Fatalf("key moved to other user should be rejected\n")
+	}
+	request = httptest.NewRequest("POST", "http://localhost:3000/v1/sys/restore/keys", bytes.NewReader(export))
+	request.Header.Set("X-Bunker-Token", rootToken)
+	raw, err = helpServe(request)
+	if err != nil || int64(raw["imported"].(float64)) != total {
+		t.Fatalf("failed to import user keys: %v", raw)
+	}
+	if err = e.db.validateBackup(dump); err != nil {
+		t.Fatalf("failed to validate backup after key import: %s", err)
+	}
+	raw, err = helpGetUser("login", "exportkeyuser")
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to get user with imported key: %v", raw)
+	}
+}
+
+func TestRestoreOnNewInstance(t *testing.T) {
+	setUserKEK(strings.Repeat("ab", 32))
+	defer setUserKEK("")
+	raw, err := helpCreateUser(`{"login":"newinstanceuser","email":"newinstance@user.com","name":"new instance"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	defer helpDeleteUser("token", userTOKEN)
+	dump, err := helpBackupRequest(rootToken)
+	if err != nil {
+		t.Fatalf("failed to backup db: %s", err)
+	}
+	export, err := e.db.exportUserKeys()
+	if err != nil {
+		t.Fatalf("failed to export user keys: %s", err)
+	}
+	data, _ := json.Marshal(export)
+
+	dir, err := ioutil.TempDir("", "databunker-restore")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "new.db")
+	store, err := storage.InitDB(&dbFile)
+	if err != nil {
+		t.Fatalf("failed to init new database: %s", err)
+	}
+	defer store.CloseDB()
+	db := newRotationDB(store, e.db.masterKey, nil)
+	if err = db.restoreBackup(dump, nil, false); err == nil || strings.Contains(err.Error(), "user keys") == false {
+		t.Fatalf("restore without user keys should fail: %v", err)
+	}
+	if _, err = db.importUserKeys(data); err != nil {
+		t.Fatalf("failed to import user keys: %s", err)
+	}
+	if err = db.restoreBackup(dump, nil, false); err != nil {
+		t.Fatalf("failed to restore backup: %s", err)
+	}
+	profile, err := db.getUser(userTOKEN)
+	if err != nil || strings.Contains(string(profile), "newinstance@user.com") == false {
+		t.Fatalf("failed to decrypt restored user: %s", err)
+	}
+}
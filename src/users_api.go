@@ -1,12 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func (e mainEnv) userNew(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -29,72 +33,26 @@ func (e mainEnv) userNew(w http.ResponseWriter, r *http.Request, ps httprouter.P
 		returnError(w, r, "empty request body", 405, nil, event)
 		return
 	}
+	if requestScope(r).allowsProfile(parsedData.jsonData) == false {
+		returnError(w, r, "field is not allowed by token scope", 403, nil, event)
+		return
+	}
 	err = validateUserRecord(parsedData.jsonData)
 	if err != nil {
 		returnError(w, r, "user schema error: "+err.Error(), 405, err, event)
 		return
 	}
-	// make sure that login, email and phone are unique
-	if len(parsedData.loginIdx) > 0 {
-		otherUserBson, err := e.db.lookupUserRecordByIndex("login", parsedData.loginIdx, e.conf)
-		if err != nil {
-			returnError(w, r, "internal error", 405, err, event)
-			return
-		}
-		if otherUserBson != nil {
-			returnError(w, r, "duplicate index: login", 405, nil, event)
-			return
-		}
-	}
-	if len(parsedData.emailIdx) > 0 {
-		otherUserBson, err := e.db.lookupUserRecordByIndex("email", parsedData.emailIdx, e.conf)
-		if err != nil {
-			returnError(w, r, "internal error", 405, err, event)
-			return
-		}
-		if otherUserBson != nil {
-			returnError(w, r, "duplicate index: email", 405, nil, event)
-			return
-		}
-	}
-	if len(parsedData.phoneIdx) > 0 {
-		otherUserBson, err := e.db.lookupUserRecordByIndex("phone", parsedData.phoneIdx, e.conf)
-		if err != nil {
-			returnError(w, r, "internal error", 405, err, event)
-			return
-		}
-		if otherUserBson != nil {
-			returnError(w, r, "duplicate index: phone", 405, nil, event)
-			return
-		}
-	}
+	// login, email and phone uniqueness is checked inside the transaction
 	userTOKEN, err := e.db.createUserRecord(parsedData, event)
 	if err != nil {
+		if strings.HasPrefix(err.Error(), "duplicate index") {
+			returnError(w, r, err.Error(), 405, nil, event)
+			return
+		}
 		returnError(w, r, "internal error", 405, err, event)
 		return
 	}
-	if len(parsedData.emailIdx) > 0 {
-		e.db.linkAgreementRecords(userTOKEN, "email", parsedData.emailIdx)
-	}
-	if len(parsedData.phoneIdx) > 0 {
-		e.db.linkAgreementRecords(userTOKEN, "phone", parsedData.phoneIdx)
-	}
-	if len(parsedData.emailIdx) > 0 && len(parsedData.phoneIdx) > 0 {
-		// delete duplicate consent records for user
-		records, _ := e.db.store.GetList(storage.TblName.Agreements, "who", parsedData.emailIdx, 0, 0, "")
-		var briefCodes []string
-		for _, val := range records {
-			//fmt.Printf("adding brief code: %s\n", val["brief"].(string))
-			briefCodes = append(briefCodes, val["brief"].(string))
-		}
-		records, _ = e.db.store.GetList(storage.TblName.Agreements, "who", parsedData.phoneIdx, 0, 0, "")
-		for _, val := range records {
-			//fmt.Printf("XXX checking brief code for duplicates: %s\n", val["brief"].(string))
-			if contains(briefCodes, val["brief"].(string)) == true {
-				e.db.store.DeleteRecord2(storage.TblName.Agreements, "token", userTOKEN, "who", parsedData.phoneIdx)
-			}
-		}
-	}
+	e.db.linkNewUserAgreements(userTOKEN, parsedData)
 	event.Record = userTOKEN
 	returnUUID(w, userTOKEN)
 	notifyURL := e.conf.Notification.NotificationURL
@@ -137,6 +95,11 @@ func (e mainEnv) userGet(w http.ResponseWriter, r *http.Request, ps httprouter.P
 		returnError(w, r, "record not found", 405, nil, event)
 		return
 	}
+	resultJSON, err = requestScope(r).filterFields(resultJSON)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
 	finalJSON := fmt.Sprintf(`{"status":"ok","token":"%s","data":%s}`, userTOKEN, resultJSON)
 	//fmt.Printf("record: %s\n", finalJSON)
 	//fmt.Fprintf(w, "<html><head><title>title</title></head>")
@@ -190,6 +153,10 @@ func (e mainEnv) userChange(w http.ResponseWriter, r *http.Request, ps httproute
 	if authResult == "" {
 		return
 	}
+	if requestScope(r).allowsProfile(parsedData.jsonData) == false {
+		returnError(w, r, "field is not allowed by token scope", 403, nil, event)
+		return
+	}
 	adminRecordChanged := false
 	if UserSchemaEnabled() {
 	  adminRecordChanged, err = e.db.validateUserRecordChange(userJSON, parsedData.jsonData, userTOKEN, authResult)
@@ -278,16 +245,17 @@ func (e mainEnv) userDelete(w http.ResponseWriter, r *http.Request, ps httproute
 	}
 	e.globalUserDelete(userTOKEN)
 	//fmt.Printf("deleting user %s\n", userTOKEN)
-	_, err = e.db.deleteUserRecord(resultJSON, userTOKEN)
+	_, erasure, err := e.db.deleteUserRecord(resultJSON, userTOKEN, e.conf)
 	if err != nil {
 		returnError(w, r, "internal error", 405, err, event)
 		return
 	}
+	erasureJSON, _ := json.Marshal(erasure)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(200)
-	fmt.Fprintf(w, `{"status":"ok","result":"done"}`)
+	fmt.Fprintf(w, `{"status":"ok","result":"done","erasure":%s}`, erasureJSON)
 	notifyURL := e.conf.Notification.NotificationURL
-	notifyForgetMe(notifyURL, resultJSON, "token", userTOKEN)
+	notifyForgetMe(notifyURL, resultJSON, erasure, "token", userTOKEN)
 }
 
 func (e mainEnv) userPrelogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -300,6 +268,17 @@ func (e mainEnv) userPrelogin(w http.ResponseWriter, r *http.Request, ps httprou
 		returnError(w, r, "bad mode", 405, nil, event)
 		return
 	}
+	ip := clientIP(r)
+	if seconds := loginIPs.lockedFor(ip); seconds > 0 {
+		returnError(w, r, "too many login attempts", 429, fmt.Errorf("ip %s is locked for %d seconds", ip, seconds), event)
+		return
+	}
+	// login type does not depend on user existence, so it can not be used
+	// to find registered addresses
+	loginType := "code"
+	if mode == "email" && e.conf.SelfService.MagicLink {
+		loginType = "link"
+	}
 	userBson, err := e.db.lookupUserRecordByIndex(mode, address, e.conf)
 	if err != nil {
 		returnError(w, r, "internal error", 405, err, event)
@@ -308,11 +287,23 @@ func (e mainEnv) userPrelogin(w http.ResponseWriter, r *http.Request, ps httprou
 	if userBson != nil {
 		userTOKEN := userBson["token"].(string)
 		event.Record = userTOKEN
-		if address == "4444" || address == "test@paranoidguy.com" {
+		if seconds := userLoginLockedFor(userBson); seconds > 0 {
+			// response is the same as for other users, so the lock can not
+			// be used to find registered addresses
+			event.Msg = fmt.Sprintf("user is locked for %d seconds, login code is not sent", seconds)
+		} else if address == "4444" || address == "test@paranoidguy.com" {
 			// check if it is demo account.
 			// the address is always 4444
 			// no need to send any notifications
 			e.db.generateDemoLoginCode(userTOKEN)
+		} else if mode == "email" && e.conf.SelfService.MagicLink {
+			link, err := e.db.createMagicLink(userTOKEN)
+			if err != nil {
+				returnError(w, r, "internal error", 405, err, event)
+				return
+			}
+			event.Msg = "magic link sent"
+			go sendLinkByEmail(e.conf.SelfService.MagicLinkURL+"/v1/magiclink/"+link, address, e.conf)
 		} else {
 			rnd := e.db.generateTempLoginCode(userTOKEN)
 			if mode == "email" {
@@ -333,7 +324,7 @@ func (e mainEnv) userPrelogin(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(200)
-	fmt.Fprintf(w, `{"status":"ok","result":"done"}`)
+	fmt.Fprintf(w, `{"status":"ok","result":"done","type":%q}`, loginType)
 }
 
 func (e mainEnv) userLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -348,32 +339,267 @@ func (e mainEnv) userLogin(w http.ResponseWriter, r *http.Request, ps httprouter
 		return
 	}
 
+	ip := clientIP(r)
+	if seconds := loginIPs.lockedFor(ip); seconds > 0 {
+		returnError(w, r, "too many login attempts", 429, fmt.Errorf("ip %s is locked for %d seconds", ip, seconds), event)
+		return
+	}
+	// unknown address, locked user and wrong code get the same response,
+	// so login can not be used to find registered addresses
+	loginFailed := func(msg string) {
+		if _, ipLockout := loginIPs.failed(ip); ipLockout > 0 {
+			msg = msg + fmt.Sprintf(", ip %s is locked for %d seconds", ip, ipLockout)
+		}
+		returnError(w, r, "internal error", 405, nil, event)
+		event.Msg = msg
+	}
 	userBson, err := e.db.lookupUserRecordByIndex(mode, address, e.conf)
-	if userBson == nil || err != nil {
+	if err != nil {
 		returnError(w, r, "internal error", 405, err, event)
 		return
 	}
+	if userBson == nil {
+		loginFailed("user not found")
+		return
+	}
 
 	userTOKEN := userBson["token"].(string)
 	event.Record = userTOKEN
-	tmpCode := int32(0)
-	if _, ok := userBson["tempcode"]; ok {
-		tmpCode = userBson["tempcode"].(int32)
-	}
-	if tmp == tmpCode {
-		// user ented correct key
-		// generate temp user access code
-		xtoken, hashedToken, err := e.db.generateUserLoginXtoken(userTOKEN)
-		//fmt.Printf("generate user access token: %s\n", xtoken)
+	if seconds := userLoginLockedFor(userBson); seconds > 0 {
+		loginFailed(fmt.Sprintf("user is locked for %d seconds", seconds))
+		return
+	}
+	valid, fails, lockout, err := e.db.checkLoginCode(userTOKEN, tmp)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	if valid == false {
+		notifyBadLogin(e.conf.Notification.NotificationURL, mode, address)
+		if fails >= maxLoginAttempts {
+			loginFailed(fmt.Sprintf("bad login code, %d failed attempts, code is removed and user is locked for %d seconds", fails, lockout))
+		} else {
+			loginFailed(fmt.Sprintf("bad login code, %d failed attempts, next attempt in %d seconds", fails, lockout))
+		}
+		return
+	}
+	// user ented correct key
+	// generate temp user access code
+	xtoken, refresh, hashedToken, err := e.db.loginUserXtokens(userTOKEN)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	event.Msg = "generated: " + hashedToken
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","xtoken":"%s","token":"%s","refresh":"%s","ttl":%d}`,
+		xtoken, userTOKEN, refresh, loginTokenTTL)
+}
+
+// userList returns tokens of all users for admin, optionally with selected
+// fields of user profile. Supported arguments: offset or cursor, limit,
+// created_after, created_before (unix time), forgotten (yes or no) and fields.
+func (e mainEnv) userList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	event := audit("list users", "", "", "")
+	defer func() { event.submit(e.db) }()
+	// event record is empty, so user login tokens are rejected here
+	if e.enforceAuth(w, r, event) == "" {
+		return
+	}
+	var offset int32
+	var limit int32 = 10
+	var filter userListFilter
+	cursor := ""
+	useCursor := false
+	args := r.URL.Query()
+	if value, ok := args["offset"]; ok {
+		offset = atoi(value[0])
+	}
+	if value, ok := args["cursor"]; ok {
+		cursor = value[0]
+		useCursor = true
+		if len(cursor) > 0 && enforceUUID(w, cursor, event) == false {
+			return
+		}
+	}
+	if value, ok := args["limit"]; ok {
+		limit = atoi(value[0])
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+	if value, ok := args["created_after"]; ok {
+		filter.createdAfter = atoi(value[0])
+	}
+	if value, ok := args["created_before"]; ok {
+		filter.createdBefore = atoi(value[0])
+	}
+	if value, ok := args["forgotten"]; ok {
+		filter.forgotten = value[0]
+		if filter.forgotten != "yes" && filter.forgotten != "no" {
+			returnError(w, r, "bad forgotten value", 405, nil, event)
+			return
+		}
+	}
+	if value, ok := args["fields"]; ok && len(value[0]) > 0 {
+		filter.fields = parseFields(value[0])
+	}
+	if scope := requestScope(r); scope != nil && len(scope.Fields) > 0 {
+		var allowed []string
+		for _, field := range filter.fields {
+			if scope.allowsField(field) {
+				allowed = append(allowed, field)
+			}
+		}
+		filter.fields = allowed
+	}
+	total, err := e.db.store.CountRecords0(storage.TblName.Users)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	records, nextOffset, nextCursor, err := e.db.listUsers(filter, useCursor, offset, cursor, limit)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	if records == nil {
+		records = []bson.M{}
+	}
+	resultJSON, err := json.Marshal(records)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	event.Msg = fmt.Sprintf("returned %d users", len(records))
+	next := ""
+	if len(nextCursor) > 0 {
+		if useCursor {
+			next = fmt.Sprintf(`,"cursor":%q`, nextCursor)
+		} else {
+			next = fmt.Sprintf(`,"offset":%d`, nextOffset)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","total":%d,"rows":%s%s}`, total, resultJSON, next)
+}
+
+// userImport creates users from jsonl or csv request body. Format is set by
+// Content-Type: text/csv or format=csv argument. With dryrun=true argument
+// users are validated and checked for duplicates only.
+func (e mainEnv) userImport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	event := audit("import users", "", "", "")
+	defer func() { event.submit(e.db) }()
+	// event record is empty, so user login tokens are rejected here
+	if e.enforceAuth(w, r, event) == "" {
+		return
+	}
+	dryRun := false
+	if value, ok := r.URL.Query()["dryrun"]; ok {
+		dryRun = value[0] == "true" || value[0] == "1"
+	}
+	format := "jsonl"
+	if cType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); cType == "text/csv" {
+		format = "csv"
+	}
+	if value, ok := r.URL.Query()["format"]; ok {
+		format = value[0]
+	}
+	results, err := e.db.importUsers(r.Body, format, e.conf.Sms.DefaultCountry, dryRun)
+	if err != nil {
+		returnError(w, r, "failed to import users", 405, err, event)
+		return
+	}
+	created := 0
+	for _, result := range results {
+		if result.Status == "ok" {
+			created++
+		}
+	}
+	event.Msg = fmt.Sprintf("created %d users, failed %d", created, len(results)-created)
+	if dryRun {
+		event.Msg = "dry run, " + event.Msg
+	}
+	if results == nil {
+		results = []importResult{}
+	}
+	resultJSON, err := json.Marshal(results)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","dryrun":%t,"created":%d,"failed":%d,"rows":%s}`,
+		dryRun, created, len(results)-created, resultJSON)
+}
+
+// userExport returns everything stored about the user as one JSON document
+// or as ZIP archive with format=zip argument. User can export own data.
+func (e mainEnv) userExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	address := ps.ByName("address")
+	mode := ps.ByName("mode")
+	event := audit("export user data by "+mode, address, mode, address)
+	defer func() { event.submit(e.db) }()
+	if validateMode(mode) == false {
+		returnError(w, r, "bad mode", 405, nil, event)
+		return
+	}
+	userTOKEN := address
+	if mode == "token" {
+		if enforceUUID(w, address, event) == false {
+			return
+		}
+	} else {
+		userBson, err := e.db.lookupUserRecordByIndex(mode, address, e.conf)
 		if err != nil {
 			returnError(w, r, "internal error", 405, err, event)
 			return
 		}
-		event.Msg = "generated: " + hashedToken
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(200)
-		fmt.Fprintf(w, `{"status":"ok","xtoken":"%s","token":"%s"}`, xtoken, userTOKEN)
+		userTOKEN = ""
+		if userBson != nil {
+			userTOKEN = userBson["token"].(string)
+			event.Record = userTOKEN
+		}
+	}
+	if e.enforceAuth(w, r, event) == "" {
+		return
+	}
+	userBson, err := e.db.lookupUserRecord(userTOKEN)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	if userBson == nil {
+		returnError(w, r, "record not found", 405, nil, event)
+		return
+	}
+	manifest, err := e.db.exportUserData(userTOKEN)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	format := "json"
+	if value, ok := r.URL.Query()["format"]; ok {
+		format = value[0]
+	}
+	var result []byte
+	contentType := "application/json; charset=utf-8"
+	if format == "zip" {
+		result, err = manifest.exportZip()
+		contentType = "application/zip"
+	} else {
+		result, err = manifest.exportJSON()
+		format = "json"
+	}
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
 		return
 	}
-	returnError(w, r, "internal error", 405, nil, event)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%s.%s"`, userTOKEN, format))
+	w.WriteHeader(200)
+	w.Write(result)
 }
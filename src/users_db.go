@@ -33,30 +33,58 @@ func (dbobj dbcon) createUserRecord(parsedData userJSON, event *auditEvent) (str
 	}
 	encodedStr := base64.StdEncoding.EncodeToString(encoded)
 	fmt.Printf("data %s %s\n", parsedData.jsonData, encodedStr)
-	bdoc["key"] = base64.StdEncoding.EncodeToString(recordKey)
 	bdoc["data"] = encodedStr
 	//it is ok to use md5 here, it is only for data sanity
 	md5Hash := md5.Sum([]byte(encodedStr))
 	bdoc["md5"] = base64.StdEncoding.EncodeToString(md5Hash[:])
 	bdoc["token"] = userTOKEN
 	// the index search field is hashed here, to be not-reversible
-	// I use original md5(master_key) as a kind of salt here,
+	// blind index key is derived from master key,
 	// so no additional configuration field is needed here.
 	if len(parsedData.loginIdx) > 0 {
-		bdoc["loginidx"] = hashString(dbobj.hash, parsedData.loginIdx)
+		bdoc["loginidx"] = dbobj.hashUserIndex("login", parsedData.loginIdx)
 	}
 	if len(parsedData.emailIdx) > 0 {
-		bdoc["emailidx"] = hashString(dbobj.hash, parsedData.emailIdx)
+		bdoc["emailidx"] = dbobj.hashUserIndex("email", parsedData.emailIdx)
 	}
 	if len(parsedData.phoneIdx) > 0 {
-		bdoc["phoneidx"] = hashString(dbobj.hash, parsedData.phoneIdx)
+		bdoc["phoneidx"] = dbobj.hashUserIndex("phone", parsedData.phoneIdx)
 	}
+	bdoc["idxver"] = int32(indexVersion)
+	bdoc["created"] = int32(time.Now().Unix())
 	if event != nil {
 		event.After = encodedStr
 		event.Record = userTOKEN
 	}
-	//fmt.Println("creating new user")
-	_, err = dbobj.store.CreateRecord(storage.TblName.Users, bdoc)
+	// check that login, email and phone are unique and insert in one transaction
+	err = dbobj.withTx(func(dbTx dbcon) error {
+		indexes := map[string]string{"login": parsedData.loginIdx, "email": parsedData.emailIdx, "phone": parsedData.phoneIdx}
+		for _, idx := range []string{"login", "email", "phone"} {
+			if len(indexes[idx]) == 0 {
+				continue
+			}
+			otherUserBson, err := dbTx.lookupUserRecordByHash(idx, indexes[idx])
+			if err != nil {
+				return err
+			}
+			if otherUserBson != nil {
+				return errors.New("duplicate index: " + idx)
+			}
+		}
+		err := dbTx.checkSearchIndexes(userTOKEN, parsedData.searchIdx)
+		if err != nil {
+			return err
+		}
+		_, err = dbTx.store.CreateRecord(storage.TblName.Users, bdoc)
+		if err != nil {
+			return err
+		}
+		err = dbTx.saveUserKey(userTOKEN, recordKey)
+		if err != nil {
+			return err
+		}
+		return dbTx.saveSearchIndexes(userTOKEN, parsedData.searchIdx)
+	})
 	if err != nil {
 		fmt.Printf("error in create!\n")
 		return "", err
@@ -124,17 +152,19 @@ func (dbobj dbcon) updateUserRecordDo(jsonDataPatch []byte, userTOKEN string, ev
 	}
 
 	// get user key
-	userKey := oldUserBson["key"].(string)
-	recordKey, err := base64.StdEncoding.DecodeString(userKey)
+	recordKey, err := dbobj.userRecordKey(oldUserBson)
 	if err != nil {
 		return nil, nil, false, err
 	}
+	if recordKey == nil {
+		return nil, nil, true, errors.New("not found")
+	}
 	encData0 := oldUserBson["data"].(string)
 	encData, err := base64.StdEncoding.DecodeString(encData0)
 	if err != nil {
 		return nil, nil, false, err
 	}
-	decrypted, err := decrypt(dbobj.masterKey, recordKey, encData)
+	decrypted, err := dbobj.decryptRecord(recordKey, encData)
 	if err != nil {
 		return nil, nil, false, err
 	}
@@ -186,7 +216,7 @@ func (dbobj dbcon) updateUserRecordDo(jsonDataPatch []byte, userTOKEN string, ev
 		}
 		if idxOldValue, ok := oldUserBson[idx+"idx"]; ok {
 			if len(newIdxFinalValue) > 0 && len(idxOldValue.(string)) >= 0 {
-				idxStringHashHex := hashString(dbobj.hash, newIdxFinalValue)
+				idxStringHashHex := dbobj.hashUserIndex(idx, newIdxFinalValue)
 				if idxStringHashHex == idxOldValue.(string) {
 					fmt.Println("index value NOT changed!")
 					actionCode = 0
@@ -201,20 +231,25 @@ func (dbobj dbcon) updateUserRecordDo(jsonDataPatch []byte, userTOKEN string, ev
 			// check if new value is created
 			//fmt.Printf("adding index? %s\n", raw[idx])
 			otherUserBson, _ := dbobj.lookupUserRecordByIndex(idx, newIdxFinalValue, conf)
-			if otherUserBson != nil {
+			if otherUserBson != nil && otherUserBson["token"].(string) != userTOKEN {
 				// already exist user with same index value
 				return nil, nil, true, fmt.Errorf("duplicate %s index", idx)
 			}
 			//fmt.Printf("adding index3? %s\n", raw[idx])
-			bdoc[idx+"idx"] = hashString(dbobj.hash, newIdxFinalValue)
+			bdoc[idx+"idx"] = dbobj.hashUserIndex(idx, newIdxFinalValue)
 		} else if len(newIdxFinalValue) == 0 {
 			bdel[idx+"idx"] = ""
 		}
 	}
+	bdoc["idxver"] = int32(indexVersion)
+	searchIdx := searchIndexValues(raw)
+	err = dbobj.checkSearchIndexes(userTOKEN, searchIdx)
+	if err != nil {
+		return nil, nil, true, err
+	}
 
 	encoded, _ := encrypt(dbobj.masterKey, recordKey, newJSON)
 	encodedStr := base64.StdEncoding.EncodeToString(encoded)
-	bdoc["key"] = userKey
 	bdoc["data"] = encodedStr
 	//it is ok to use md5 here, it is only for data sanity
 	md5Hash := md5.Sum([]byte(encodedStr))
@@ -226,7 +261,15 @@ func (dbobj dbcon) updateUserRecordDo(jsonDataPatch []byte, userTOKEN string, ev
 	//filter2 := bson.D{{"token", userTOKEN}, {"md5", sig}}
 
 	//fmt.Printf("op json: %s\n", update)
-	result, err := dbobj.store.UpdateRecord2(storage.TblName.Users, "token", userTOKEN, "md5", sig, &bdoc, &bdel)
+	var result int64
+	err = dbobj.withTx(func(dbTx dbcon) error {
+		var err error
+		result, err = dbTx.store.UpdateRecord2(storage.TblName.Users, "token", userTOKEN, "md5", sig, &bdoc, &bdel)
+		if err != nil || result == 0 {
+			return err
+		}
+		return dbTx.saveSearchIndexes(userTOKEN, searchIdx)
+	})
 	if err != nil {
 		return nil, nil, false, err
 	}
@@ -259,9 +302,23 @@ func (dbobj dbcon) lookupUserRecordByIndex(indexName string, indexValue string,
 	if len(indexValue) == 0 {
 		return nil, nil
 	}
-	idxStringHashHex := hashString(dbobj.hash, indexValue)
 	fmt.Printf("loading by %s, value: %s\n", indexName, indexValue)
-	return dbobj.store.GetRecord(storage.TblName.Users, indexName+"idx", idxStringHashHex)
+	return dbobj.lookupUserRecordByHash(indexName, indexValue)
+}
+
+// lookupUserRecordByHash finds user by normalized index value
+func (dbobj dbcon) lookupUserRecordByHash(indexName string, indexValue string) (bson.M, error) {
+	if isSearchField(indexName) {
+		return dbobj.lookupUserRecordBySearchField(indexName, indexValue)
+	}
+	// index can be hashed with the old master key or previous index version
+	for _, idxStringHashHex := range dbobj.userIndexHashes(indexName, indexValue) {
+		record, err := dbobj.store.GetRecord(storage.TblName.Users, indexName+"idx", idxStringHashHex)
+		if record != nil || err != nil {
+			return record, err
+		}
+	}
+	return nil, nil
 }
 
 func (dbobj dbcon) getUser(userTOKEN string) ([]byte, error) {
@@ -270,14 +327,13 @@ func (dbobj dbcon) getUser(userTOKEN string) ([]byte, error) {
 		// not found
 		return nil, err
 	}
-	if _, ok := userBson["key"]; !ok {
-		return []byte("{}"), nil
-	}
-	userKey := userBson["key"].(string)
-	recordKey, err := base64.StdEncoding.DecodeString(userKey)
+	recordKey, err := dbobj.userRecordKey(userBson)
 	if err != nil {
 		return nil, err
 	}
+	if recordKey == nil {
+		return []byte("{}"), nil
+	}
 	var decrypted []byte
 	if _, ok := userBson["data"]; ok {
 		encData0 := userBson["data"].(string)
@@ -286,7 +342,7 @@ func (dbobj dbcon) getUser(userTOKEN string) ([]byte, error) {
 			if err != nil {
 				return nil, err
 			}
-			decrypted, err = decrypt(dbobj.masterKey, recordKey, encData)
+			decrypted, err = dbobj.decryptRecord(recordKey, encData)
 			if err != nil {
 				return nil, err
 			}
@@ -301,11 +357,13 @@ func (dbobj dbcon) getUserIndex(indexValue string, indexName string, conf Config
 		return nil, "", err
 	}
 	// decrypt record
-	userKey := userBson["key"].(string)
-	recordKey, err := base64.StdEncoding.DecodeString(userKey)
+	recordKey, err := dbobj.userRecordKey(userBson)
 	if err != nil {
 		return nil, "", err
 	}
+	if recordKey == nil {
+		return []byte("{}"), userBson["token"].(string), nil
+	}
 	var decrypted []byte
 	if _, ok := userBson["data"]; ok {
 		encData0 := userBson["data"].(string)
@@ -314,7 +372,7 @@ func (dbobj dbcon) getUserIndex(indexValue string, indexName string, conf Config
 			if err != nil {
 				return nil, "", err
 			}
-			decrypted, err = decrypt(dbobj.masterKey, recordKey, encData)
+			decrypted, err = dbobj.decryptRecord(recordKey, encData)
 			if err != nil {
 				return nil, "", err
 			}
@@ -323,34 +381,116 @@ func (dbobj dbcon) getUserIndex(indexValue string, indexName string, conf Config
 	return decrypted, userBson["token"].(string), err
 }
 
-func (dbobj dbcon) deleteUserRecord(userJSON []byte, userTOKEN string) (bool, error) {
+// erasureReport is a number of records removed from each table on forget-me
+type erasureReport map[string]int64
+
+func (report erasureReport) add(table string, num int64, err error) error {
+	if err != nil {
+		return err
+	}
+	report[table] += num
+	return nil
+}
+
+func (dbobj dbcon) deleteUserRecord(userJSON []byte, userTOKEN string, conf Config) (bool, erasureReport, error) {
 	userApps, err := dbobj.listAllAppsOnly()
 	if err != nil {
-		return false, err
+		return false, nil, err
+	}
+	result := false
+	var report erasureReport
+	// all tables are cleaned in one transaction, so user is never half-forgotten
+	err = dbobj.withTx(func(dbTx dbcon) error {
+		var err error
+		result, report, err = dbTx.deleteUserRecordDo(userJSON, userTOKEN, userApps, conf)
+		return err
+	})
+	if err != nil {
+		return false, nil, err
 	}
+	return result, report, nil
+}
+
+func (dbobj dbcon) deleteUserRecordDo(userJSON []byte, userTOKEN string, userApps []string, conf Config) (bool, erasureReport, error) {
+	report := erasureReport{}
 	// delete all user app records
 	for _, appName := range userApps {
 		appNameFull := "app_" + appName
-		dbobj.store.DeleteRecordInTable(appNameFull, "token", userTOKEN)
+		num, err := dbobj.store.DeleteRecordInTable(appNameFull, "token", userTOKEN)
+		if err != nil {
+			return false, nil, err
+		}
+		if num > 0 {
+			report[appNameFull] = num
+		}
 	}
 	//delete in audit
-	dbobj.store.DeleteRecord(storage.TblName.Audit, "record", userTOKEN)
-	dbobj.store.DeleteRecord(storage.TblName.Sessions, "token", userTOKEN)
-	
+	num, err := dbobj.store.DeleteRecord(storage.TblName.Audit, "record", userTOKEN)
+	if err = report.add("audit", num, err); err != nil {
+		return false, nil, err
+	}
+	num, err = dbobj.store.DeleteRecord(storage.TblName.Sessions, "token", userTOKEN)
+	if err = report.add("sessions", num, err); err != nil {
+		return false, nil, err
+	}
+	num, err = dbobj.store.DeleteRecord(storage.TblName.Sharedrecords, "token", userTOKEN)
+	if err = report.add("sharedrecords", num, err); err != nil {
+		return false, nil, err
+	}
+	num, err = dbobj.store.DeleteRecord(storage.TblName.Xtokens, "token", userTOKEN)
+	if err = report.add("xtokens", num, err); err != nil {
+		return false, nil, err
+	}
+	// closed requests are kept as a log of admin decisions
+	num, err = dbobj.store.DeleteRecord2(storage.TblName.Requests, "token", userTOKEN, "status", "open")
+	if err = report.add("requests", num, err); err != nil {
+		return false, nil, err
+	}
+	num, err = dbobj.store.DeleteRecord(storage.TblName.Agreements, "token", userTOKEN)
+	if err = report.add("agreements", num, err); err != nil {
+		return false, nil, err
+	}
+	// agreements saved by user address and not linked to the user record
+	var profile map[string]interface{}
+	if err = json.Unmarshal(userJSON, &profile); err != nil {
+		return false, nil, err
+	}
+	parsedData, err := parseUserJSON(profile, conf.Sms.DefaultCountry)
+	if err != nil {
+		return false, nil, err
+	}
+	addresses := []string{parsedData.loginIdx, parsedData.emailIdx, parsedData.phoneIdx}
+	for _, value := range parsedData.searchIdx {
+		addresses = append(addresses, value)
+	}
+	for _, address := range addresses {
+		if len(address) == 0 {
+			continue
+		}
+		for _, key := range dbobj.agreementWhoKeys(address) {
+			num, err = dbobj.store.DeleteRecord2(storage.TblName.Agreements, "token", "", key[0], key[1])
+			if err = report.add("agreements", num, err); err != nil {
+				return false, nil, err
+			}
+		}
+	}
+
 	dataJSON, record := cleanupRecord(userJSON)
 	bdel := bson.M{}
 	if dataJSON != nil {
 		oldUserBson, err := dbobj.lookupUserRecord(userTOKEN)
 		if err != nil {
-			return false, err
+			return false, nil, err
 		}
-		userKey := oldUserBson["key"].(string)
-		recordKey, err := base64.StdEncoding.DecodeString(userKey)
+		// preserved fields are encrypted with a new key, so the old key
+		// can be destroyed together with all records encrypted by it
+		recordKey, err := generateRecordKey()
 		if err != nil {
-			return false, err
+			return false, nil, err
 		}
 		sig := oldUserBson["md5"].(string)
 		bdoc := bson.M{}
+		bdoc["deleted"] = int32(time.Now().Unix())
 		
 		if _, ok := record["email"]; ok {
 			fmt.Printf("Preservice email idx\n")
@@ -370,21 +510,40 @@ func (dbobj dbcon) deleteUserRecord(userJSON []byte, userTOKEN string) (bool, er
 		} else {
 			bdel["loginidx"] = ""
 		}
+		bdel["key"] = ""
 		encoded, _ := encrypt(dbobj.masterKey, recordKey, dataJSON)
 		encodedStr := base64.StdEncoding.EncodeToString(encoded)
-		bdoc["key"] = userKey
 		bdoc["data"] = encodedStr
 		md5Hash := md5.Sum([]byte(encodedStr))
 		bdoc["md5"] = base64.StdEncoding.EncodeToString(md5Hash[:])
 		bdoc["token"] = userTOKEN
 		result, err := dbobj.store.UpdateRecord2(storage.TblName.Users, "token", userTOKEN, "md5", sig, &bdoc, &bdel)
 		if err != nil {
-			return false, err
+			return false, nil, err
 		}
 		if result > 0 {
-			return true, nil
+			report["users"] = result
+			num, err = dbobj.replaceUserKey(userTOKEN, recordKey)
+			if err = report.add("userkeys", num, err); err != nil {
+				return false, nil, err
+			}
+			// keep indexes of the preserved search fields only
+			before, err := dbobj.store.CountRecords(storage.TblName.Userindexes, "token", userTOKEN)
+			if err != nil {
+				return false, nil, err
+			}
+			err = dbobj.saveSearchIndexes(userTOKEN, searchIndexValues(record))
+			if err != nil {
+				return false, nil, err
+			}
+			after, err := dbobj.store.CountRecords(storage.TblName.Userindexes, "token", userTOKEN)
+			if err != nil {
+				return false, nil, err
+			}
+			report["userindexes"] = before - after
+			return true, report, nil
 		}
-		return false, nil
+		return false, report, nil
 	} else {
 		// cleanup user record
 		bdel["data"] = ""
@@ -392,15 +551,25 @@ func (dbobj dbcon) deleteUserRecord(userJSON []byte, userTOKEN string) (bool, er
 		bdel["loginidx"] = ""
 		bdel["emailidx"] = ""
 		bdel["phoneidx"] = ""
+		bdoc := bson.M{"deleted": int32(time.Now().Unix())}
+		_, err = dbobj.store.UpdateRecord(storage.TblName.Users, "token", userTOKEN, &bdoc)
+		if err != nil {
+			return false, nil, err
+		}
 	}
-	result, err := dbobj.store.CleanupRecord(storage.TblName.Users, "token", userTOKEN, bdel)
-	if err != nil {
-		return false, err
+	num, err = dbobj.store.DeleteRecord(storage.TblName.Userindexes, "token", userTOKEN)
+	if err = report.add("userindexes", num, err); err != nil {
+		return false, nil, err
 	}
-	if result > 0 {
-		return true, nil
+	num, err = dbobj.destroyUserKey(userTOKEN)
+	if err = report.add("userkeys", num, err); err != nil {
+		return false, nil, err
 	}
-	return true, nil
+	result, err := dbobj.store.CleanupRecord(storage.TblName.Users, "token", userTOKEN, bdel)
+	if err = report.add("users", result, err); err != nil {
+		return false, nil, err
+	}
+	return true, report, nil
 }
 
 /*
@@ -431,15 +600,14 @@ func (dbobj dbcon) userEncrypt(userTOKEN string, data []byte) (string, error) {
 	if userBson == nil || err != nil {
 		return "", errors.New("not found")
 	}
-	if _, ok := userBson["key"]; !ok {
-		// user might be deleted already
-		return "", errors.New("not found")
-	}
-	userKey := userBson["key"].(string)
-	recordKey, err := base64.StdEncoding.DecodeString(userKey)
+	recordKey, err := dbobj.userRecordKey(userBson)
 	if err != nil {
 		return "", err
 	}
+	if recordKey == nil {
+		// user might be deleted already
+		return "", errors.New("not found")
+	}
 	// encrypt data
 	encoded, err := encrypt(dbobj.masterKey, recordKey, data)
 	if err != nil {
@@ -454,20 +622,19 @@ func (dbobj dbcon) userDecrypt(userTOKEN, src string) ([]byte, error) {
 	if userBson == nil || err != nil {
 		return nil, errors.New("not found")
 	}
-	if _, ok := userBson["key"]; !ok {
-		// user might be deleted already
-		return nil, errors.New("not found")
-	}
-	userKey := userBson["key"].(string)
-	recordKey, err := base64.StdEncoding.DecodeString(userKey)
+	recordKey, err := dbobj.userRecordKey(userBson)
 	if err != nil {
 		return nil, err
 	}
+	if recordKey == nil {
+		// user might be deleted already
+		return nil, errors.New("not found")
+	}
 	encData, err := base64.StdEncoding.DecodeString(src)
 	if err != nil {
 		return nil, err
 	}
-	decrypted, err := decrypt(dbobj.masterKey, recordKey, encData)
+	decrypted, err := dbobj.decryptRecord(recordKey, encData)
 	return decrypted, err
 }
 
@@ -476,20 +643,19 @@ func (dbobj dbcon) userDecrypt2(userTOKEN, src string, src2 string) ([]byte, []b
 	if userBson == nil || err != nil {
 		return nil, nil, errors.New("not found")
 	}
-	if _, ok := userBson["key"]; !ok {
-		// user might be deleted already
-		return nil, nil, errors.New("not found")
-	}
-	userKey := userBson["key"].(string)
-	recordKey, err := base64.StdEncoding.DecodeString(userKey)
+	recordKey, err := dbobj.userRecordKey(userBson)
 	if err != nil {
 		return nil, nil, err
 	}
+	if recordKey == nil {
+		// user might be deleted already
+		return nil, nil, errors.New("not found")
+	}
 	encData, err := base64.StdEncoding.DecodeString(src)
 	if err != nil {
 		return nil, nil, err
 	}
-	decrypted, err := decrypt(dbobj.masterKey, recordKey, encData)
+	decrypted, err := dbobj.decryptRecord(recordKey, encData)
 	if len(src2) == 0 {
 		return decrypted, nil, err
 	}
@@ -497,6 +663,93 @@ func (dbobj dbcon) userDecrypt2(userTOKEN, src string, src2 string) ([]byte, []b
 	if err != nil {
 		return decrypted, nil, err
 	}
-	decrypted2, err := decrypt(dbobj.masterKey, recordKey, encData2)
+	decrypted2, err := dbobj.decryptRecord(recordKey, encData2)
 	return decrypted, decrypted2, err
 }
+
+// userListFilter keeps optional filters of admin user listing
+type userListFilter struct {
+	createdAfter  int32
+	createdBefore int32
+	// forgotten is "yes", "no" or empty for all users
+	forgotten string
+	// fields of user profile returned for every user
+	fields []string
+}
+
+func (filter userListFilter) match(userBson bson.M) bool {
+	created := int32(getInt64Value(userBson, "created"))
+	if filter.createdAfter > 0 && created < filter.createdAfter {
+		return false
+	}
+	if filter.createdBefore > 0 && (created == 0 || created > filter.createdBefore) {
+		return false
+	}
+	if filter.forgotten == "yes" && isForgottenUser(userBson) == false {
+		return false
+	}
+	if filter.forgotten == "no" && isForgottenUser(userBson) {
+		return false
+	}
+	return true
+}
+
+// isForgottenUser checks if user record was deleted by forget-me request,
+// users deleted before the deleted column was added have no data
+func isForgottenUser(userBson bson.M) bool {
+	encData, _ := userBson["data"].(string)
+	return getInt64Value(userBson, "deleted") > 0 || len(encData) == 0
+}
+
+// listUsers returns up to limit users matching the filter. In offset mode
+// users are scanned by creation time starting from offset, in cursor mode
+// they are scanned by token after the cursor. It returns the position to
+// continue from: next offset and next cursor, cursor is empty when all users
+// are scanned.
+func (dbobj dbcon) listUsers(filter userListFilter, useCursor bool, offset int32, cursor string, limit int32) ([]bson.M, int32, string, error) {
+	var results []bson.M
+	for int32(len(results)) < limit {
+		var records []bson.M
+		var err error
+		if useCursor {
+			records, err = dbobj.store.GetListAfter(storage.TblName.Users, "token", cursor, rotationBatch)
+		} else {
+			records, err = dbobj.store.GetList0(storage.TblName.Users, offset, rotationBatch, "created")
+		}
+		if err != nil {
+			return nil, 0, "", err
+		}
+		for _, userBson := range records {
+			if int32(len(results)) == limit {
+				return results, offset, cursor, nil
+			}
+			offset++
+			cursor = userBson["token"].(string)
+			if filter.match(userBson) == false {
+				continue
+			}
+			element := bson.M{"token": cursor, "forgotten": isForgottenUser(userBson)}
+			if created := getInt64Value(userBson, "created"); created > 0 {
+				element["created"] = created
+			}
+			if len(filter.fields) > 0 {
+				raw, err := dbobj.decryptUserProfile(userBson)
+				if err != nil {
+					return nil, 0, "", err
+				}
+				data := bson.M{}
+				for _, field := range filter.fields {
+					if value, ok := raw[field]; ok {
+						data[field] = value
+					}
+				}
+				element["data"] = data
+			}
+			results = append(results, element)
+		}
+		if len(records) < rotationBatch {
+			return results, offset, "", nil
+		}
+	}
+	return results, offset, cursor, nil
+}
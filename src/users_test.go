@@ -1,12 +1,17 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"fmt"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	uuid "github.com/hashicorp/go-uuid"
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func helpCreateUser(userJSON string) (map[string]interface{}, error) {
@@ -45,6 +50,20 @@ func helpDeleteUser(index string, indexValue string) (map[string]interface{}, er
 	return helpServe(request)
 }
 
+func helpListUsers(args string) (map[string]interface{}, error) {
+	url := "http://localhost:3000/v1/users" + args
+	request := httptest.NewRequest("GET", url, nil)
+	request.Header.Set("X-Bunker-Token", rootToken)
+	return helpServe(request)
+}
+
+func helpImportUsers(data string, args string) (map[string]interface{}, error) {
+	url := "http://localhost:3000/v1/users/import" + args
+	request := httptest.NewRequest("POST", url, strings.NewReader(data))
+	request.Header.Set("X-Bunker-Token", rootToken)
+	return helpServe(request)
+}
+
 func helpGetUserAuditEvents(userTOKEN string, args string) (map[string]interface{}, error) {
 	url := "http://localhost:3000/v1/audit/list/" + userTOKEN + args
 	request := httptest.NewRequest("GET", url, nil)
@@ -350,3 +369,263 @@ func TestCreateUserEmptyXToken2(t *testing.T) {
 		t.Fatalf("Should fail to create user")
 	}
 }
+
+func TestSearchFields(t *testing.T) {
+	if err := setSearchFields([]string{"email"}); err == nil {
+		t.Fatalf("reserved search field is accepted\n")
+	}
+	raw, _ := helpCreateUser(`{"name":"crm","crmid":"X-2001"}`)
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user")
+	}
+	setSearchFields([]string{"custno", "crmid"})
+	defer setSearchFields(nil)
+	// user created before the field was declared is indexed in background
+	err := e.db.indexSearchFields(nil)
+	if err != nil {
+		t.Fatalf("failed to index search fields: %s", err)
+	}
+	raw, _ = helpGetUser("crmid", "X-2001")
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to get user by crmid")
+	}
+	raw, _ = helpCreateUser(`{"login":"searchuser","custno":"C-1001"}`)
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user")
+	}
+	userTOKEN := raw["token"].(string)
+	raw, _ = helpGetUser("custno", "C-1001")
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" || raw["token"].(string) != userTOKEN {
+		t.Fatalf("failed to get user by custno")
+	}
+	raw, _ = helpCreateUser(`{"login":"searchuser2","custno":"C-1001"}`)
+	if _, ok := raw["status"]; ok && raw["status"].(string) == "ok" {
+		t.Fatalf("Should fail to create user with duplicate custno")
+	}
+	raw, _ = helpChangeUser("custno", "C-1001", `{"custno":"C-1002"}`)
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to change user by custno")
+	}
+	raw, _ = helpGetUser("custno", "C-1001")
+	if _, ok := raw["status"]; ok && raw["status"].(string) == "ok" {
+		t.Fatalf("old custno index is not removed")
+	}
+	raw, _ = helpCreateSession("custno", "C-1002", `{"expiration":"1m","cookie":"custno"}`)
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create session by custno")
+	}
+	raw, _ = helpDeleteUser("custno", "C-1002")
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to delete user by custno")
+	}
+	raw, _ = helpGetUser("custno", "C-1002")
+	if _, ok := raw["status"]; ok && raw["status"].(string) == "ok" {
+		t.Fatalf("custno index is not removed after delete")
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	raw, _ := helpCreateUser(`{"login":"listuser1","name":"list1"}`)
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user")
+	}
+	userTOKEN := raw["token"].(string)
+	raw, _ = helpCreateUser(`{"login":"listuser2","name":"list2"}`)
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user")
+	}
+	// move users to the future to skip users created by other tests
+	future := time.Now().Unix() + 1000
+	for _, token := range []string{userTOKEN, raw["token"].(string)} {
+		bdoc := bson.M{"created": int32(future)}
+		e.db.store.UpdateRecord(storage.TblName.Users, "token", token, &bdoc)
+	}
+	now := fmt.Sprintf("%d", future)
+	raw, _ = helpListUsers("?created_after=" + now + "&fields=login,name&limit=1&cursor=")
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to list users")
+	}
+	rows := raw["rows"].([]interface{})
+	if len(rows) != 1 || raw["cursor"] == nil {
+		t.Fatalf("wrong number of users: %v", raw)
+	}
+	data := rows[0].(map[string]interface{})["data"].(map[string]interface{})
+	if strings.HasPrefix(data["login"].(string), "listuser") == false {
+		t.Fatalf("user fields are not returned: %v", rows[0])
+	}
+	raw, _ = helpListUsers("?created_after=" + now + "&limit=5&cursor=" + raw["cursor"].(string))
+	if len(raw["rows"].([]interface{})) != 1 || raw["cursor"] != nil {
+		t.Fatalf("wrong second page: %v", raw)
+	}
+	helpDeleteUser("token", userTOKEN)
+	raw, _ = helpListUsers("?created_after=" + now + "&forgotten=yes")
+	rows = raw["rows"].([]interface{})
+	if len(rows) != 1 || rows[0].(map[string]interface{})["token"].(string) != userTOKEN {
+		t.Fatalf("forgotten user is not found: %v", raw)
+	}
+	raw, _ = helpListUsers("?forgotten=maybe")
+	if _, ok := raw["status"]; ok && raw["status"].(string) == "ok" {
+		t.Fatalf("Should fail with bad forgotten value")
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	data := `{"login":"import1","email":"import1@user.com"}
+{"login":"import2","email":"IMPORT1@user.com"}
+
+not json
+{"login":"import3","phone":"4444"}
+`
+	raw, _ := helpImportUsers(data, "?dryrun=true")
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to check import: %v", raw)
+	}
+	if raw["created"].(float64) != 2 || raw["failed"].(float64) != 2 {
+		t.Fatalf("wrong dry run result: %v", raw)
+	}
+	raw, _ = helpGetUser("login", "import1")
+	if _, ok := raw["status"]; ok && raw["status"].(string) == "ok" {
+		t.Fatalf("user is created in dry run mode")
+	}
+	raw, _ = helpImportUsers(data, "")
+	rows := raw["rows"].([]interface{})
+	if raw["created"].(float64) != 2 || len(rows) != 4 {
+		t.Fatalf("wrong import result: %v", raw)
+	}
+	row := rows[1].(map[string]interface{})
+	if row["line"].(float64) != 2 || row["message"].(string) != "duplicate index: email" {
+		t.Fatalf("duplicate email is not reported: %v", row)
+	}
+	if rows[2].(map[string]interface{})["line"].(float64) != 4 {
+		t.Fatalf("wrong line number: %v", rows[2])
+	}
+	raw, _ = helpGetUser("email", "import1@user.com")
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("imported user is not found")
+	}
+	csvData := "login,name,phone\nimport4,Import Four,\nimport1,Duplicate,\n"
+	raw, _ = helpImportUsers(csvData, "?format=csv")
+	if raw["created"].(float64) != 1 || raw["failed"].(float64) != 1 {
+		t.Fatalf("wrong csv import result: %v", raw)
+	}
+	raw, _ = helpGetUser("login", "import4")
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("user imported from csv is not found")
+	}
+}
+
+func TestImportUsersDryRunBatches(t *testing.T) {
+	var data strings.Builder
+	for i := 0; i < 101; i++ {
+		fmt.Fprintf(&data, "{\"login\":\"dryrun%d\",\"email\":\"dryrun%d@user.com\"}\n", i, i)
+	}
+	data.WriteString(`{"login":"dryrunlast","email":"dryrun0@user.com"}` + "\n")
+	raw, _ := helpImportUsers(data.String(), "?dryrun=true")
+	if raw["status"].(string) != "ok" || raw["created"].(float64) != 101 || raw["failed"].(float64) != 1 {
+		t.Fatalf("duplicate in second batch is not detected: %v", raw)
+	}
+	rows := raw["rows"].([]interface{})
+	last := rows[len(rows)-1].(map[string]interface{})
+	if last["line"].(float64) != 102 || last["message"].(string) != "duplicate index: email" {
+		t.Fatalf("wrong duplicate row: %v", last)
+	}
+	raw, _ = helpGetUser("login", "dryrun0")
+	if raw["status"].(string) == "ok" {
+		t.Fatalf("user is created in dry-run mode")
+	}
+}
+
+func TestExportUser(t *testing.T) {
+	raw, _ := helpCreateUser(`{"login":"exportuser","email":"export@user.com"}`)
+	if _, ok := raw["status"]; !ok || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user")
+	}
+	userTOKEN := raw["token"].(string)
+	helpCreateUserApp(userTOKEN, "exportapp", `{"shoe-size":40}`)
+	helpCreateSession("token", userTOKEN, `{"expiration":"1m","cookie":"export"}`)
+	xtoken, _, _ := e.db.generateUserLoginXtoken(userTOKEN)
+	request := httptest.NewRequest("GET", "http://localhost:3000/v1/user/login/exportuser/export", nil)
+	request.Header.Set("X-Bunker-Token", xtoken)
+	raw, err := helpServe(request)
+	if err != nil || raw["manifest"] == nil {
+		t.Fatalf("failed to export user data: %s", err)
+	}
+	parts := raw["manifest"].(map[string]interface{})["parts"].([]interface{})
+	if len(parts) != 6 {
+		t.Fatalf("wrong number of export parts: %v", parts)
+	}
+	if raw["profile"].(map[string]interface{})["email"].(string) != "export@user.com" {
+		t.Fatalf("profile is not exported")
+	}
+	if raw["apps"].(map[string]interface{})["exportapp"] == nil || len(raw["sessions"].([]interface{})) != 1 {
+		t.Fatalf("app records or sessions are not exported")
+	}
+	raw, _ = helpCreateUser(`{"login":"exportuser2"}`)
+	otherXtoken, _, _ := e.db.generateUserLoginXtoken(raw["token"].(string))
+	request = httptest.NewRequest("GET", "http://localhost:3000/v1/user/token/"+userTOKEN+"/export", nil)
+	request.Header.Set("X-Bunker-Token", otherXtoken)
+	if _, err = helpServe(request); err == nil {
+		t.Fatalf("other user can export user data")
+	}
+	request = httptest.NewRequest("GET", "http://localhost:3000/v1/user/token/"+userTOKEN+"/export?format=zip", nil)
+	request.Header.Set("X-Bunker-Token", rootToken)
+	data, err := helpServe0(request)
+	if err != nil {
+		t.Fatalf("failed to export user data as zip: %s", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil || len(archive.File) != 7 || archive.File[0].Name != "manifest.json" {
+		t.Fatalf("bad export archive: %s", err)
+	}
+}
+
+func TestForgetMeErasure(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"eraseme","email":"erase@me.com","name":"erase"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	bdoc := bson.M{"who": "erase@me.com", "token": userTOKEN, "brief": "test0", "mode": "email", "status": "yes"}
+	e.db.store.CreateRecord(storage.TblName.Agreements, &bdoc)
+	// agreement saved by address and not linked to the user record
+	bdoc = bson.M{"who": "erase@me.com", "token": "", "brief": "test1", "mode": "email", "status": "yes"}
+	e.db.store.CreateRecord(storage.TblName.Agreements, &bdoc)
+	raw, _ = helpCreateSession("token", userTOKEN, `{"expiration":"1m","cookie":"abcdefg"}`)
+	if raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create session: %v", raw)
+	}
+	raw, _ = helpCreateSharedRecord("token", userTOKEN, `{"expiration":"1d","fields":"name"}`)
+	if raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create shared record: %v", raw)
+	}
+	_, _, err = e.db.saveUserRequest("change-profile", userTOKEN, "", "", []byte(`{"name":"new"}`))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	_, _, err = e.db.generateUserLoginXtoken(userTOKEN)
+	if err != nil {
+		t.Fatalf("failed to create xtoken: %s", err)
+	}
+	raw, _ = helpDeleteUser("token", userTOKEN)
+	if raw["status"].(string) != "ok" {
+		t.Fatalf("failed to delete user: %v", raw)
+	}
+	erasure := raw["erasure"].(map[string]interface{})
+	for table, num := range map[string]float64{"users": 1, "agreements": 2, "sessions": 1,
+		"sharedrecords": 1, "requests": 1, "xtokens": 1} {
+		if erasure[table] != num {
+			t.Fatalf("wrong number of records erased from %s: %v", table, erasure)
+		}
+	}
+	for _, tbl := range []storage.Tbl{storage.TblName.Agreements, storage.TblName.Sessions,
+		storage.TblName.Sharedrecords, storage.TblName.Requests, storage.TblName.Xtokens} {
+		count, _ := e.db.store.CountRecords(tbl, "token", userTOKEN)
+		if count != 0 {
+			t.Fatalf("user records are left after forget-me")
+		}
+	}
+	count, _ := e.db.store.CountRecords(storage.TblName.Agreements, "who", "erase@me.com")
+	if count != 0 {
+		t.Fatalf("unlinked agreement is left after forget-me")
+	}
+}
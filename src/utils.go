@@ -19,6 +19,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/paranoidguy/databunker/src/autocontext"
 	"github.com/ttacon/libphonenumber"
 	"golang.org/x/sys/unix"
 )
@@ -153,7 +154,7 @@ func validateMode(index string) bool {
 	if index == "login" {
 		return true
 	}
-	return false
+	return isSearchField(index)
 }
 
 func parseFields(fields string) []string {
@@ -352,9 +353,12 @@ func (e mainEnv) enforceAuth(w http.ResponseWriter, r *http.Request, event *audi
 	if token, ok := r.Header["X-Bunker-Token"]; ok {
 		authResult, err := e.db.checkUserAuthXToken(token[0])
 		//fmt.Printf("error in auth? error %s - %s\n", err, token[0])
-		if err == nil {
+		if err == nil && event != nil {
+			event.Identity = authResult.name
+		}
+		if err == nil && e.authorize(authResult, r) {
+			autocontext.Set(r, "scope", authResult.scope)
 			if event != nil {
-				event.Identity = authResult.name
 				if authResult.ttype == "login" && authResult.token == event.Record {
 					return authResult.ttype
 				}
@@ -386,7 +390,8 @@ func (e mainEnv) enforceAdmin(w http.ResponseWriter, r *http.Request) string {
 	if token, ok := r.Header["X-Bunker-Token"]; ok {
 		authResult, err := e.db.checkUserAuthXToken(token[0])
 		//fmt.Printf("error in auth? error %s - %s\n", err, token[0])
-		if err == nil {
+		if err == nil && e.authorize(authResult, r) {
+			autocontext.Set(r, "scope", authResult.scope)
 			if len(authResult.ttype) > 0 && authResult.ttype != "login" {
 				return authResult.ttype
 			}
@@ -513,7 +518,13 @@ func getJSONPost(r *http.Request, defaultCountry string) (userJSON, error) {
 	if records == nil {
 		return result, nil
 	}
+	return parseUserJSON(records, defaultCountry)
+}
 
+// parseUserJSON extracts normalized index values from user record
+func parseUserJSON(records map[string]interface{}, defaultCountry string) (userJSON, error) {
+	var result userJSON
+	var err error
 	if value, ok := records["login"]; ok {
 		result.loginIdx = getIndexString(value)
 	}
@@ -523,6 +534,7 @@ func getJSONPost(r *http.Request, defaultCountry string) (userJSON, error) {
 	if value, ok := records["phone"]; ok {
 		result.phoneIdx = normalizePhone(getIndexString(value), defaultCountry)
 	}
+	result.searchIdx = searchIndexValues(records)
 
 	result.jsonData, err = json.Marshal(records)
 
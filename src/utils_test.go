@@ -107,9 +107,8 @@ func TestSMS(t *testing.T) {
 	client := server.Client()
 	domain := server.URL
 	var cfg Config
-	cfg.Sms.TwilioToken = "ttoken"
-	cfg.Sms.TwilioAccount = "taccount"
-	cfg.Sms.TwilioFrom = "from1234"
+	cfg.Sms.Token = "ttoken"
+	cfg.Sms.From = "from1234"
 	sendCodeByPhoneDo(domain, client, 1234, "4444", cfg)
 }
 
@@ -168,7 +167,7 @@ func TestNotifyForgetMe(t *testing.T) {
 		defer req.Body.Close()
 		bodyBytes, _ := ioutil.ReadAll(req.Body)
 		fmt.Printf("body: %s\n", string(bodyBytes))
-		if string(bodyBytes) != `{"action":"forgetme","address":"user3@user3.com","mode":"email","profile":{"name":"alex"}}` {
+		if string(bodyBytes) != `{"action":"forgetme","address":"user3@user3.com","erasure":{"sessions":1},"mode":"email","profile":{"name":"alex"}}` {
 			q <- fmt.Sprintf("bad request in notifyConsentChange: %s", string(bodyBytes))
 		} else {
 			q <- "ok"
@@ -177,7 +176,7 @@ func TestNotifyForgetMe(t *testing.T) {
 	// Close the server when test finishes
 	defer server.Close()
 	profile := []byte(`{"name":"alex"}`)
-	notifyForgetMe(server.URL, profile, "email", "user3@user3.com")
+	notifyForgetMe(server.URL, profile, erasureReport{"sessions": 1}, "email", "user3@user3.com")
 	response := <-q
 	if response != "ok" {
 		t.Fatal(response)
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// xtokenRefresh exchanges refresh token for a new login token
+func (e mainEnv) xtokenRefresh(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	event := audit("refresh login token", "", "", "")
+	defer func() { event.submit(e.db) }()
+	records, err := getJSONPostData(r)
+	if err != nil || records == nil {
+		returnError(w, r, "failed to decode request body", 405, err, event)
+		return
+	}
+	userTOKEN, xtoken, refresh, err := e.db.refreshUserXtoken(getStringValue(records, "refresh"))
+	if err != nil {
+		returnError(w, r, "access denied", 403, err, event)
+		return
+	}
+	event.Record = userTOKEN
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","xtoken":"%s","token":"%s","refresh":"%s","ttl":%d}`,
+		xtoken, userTOKEN, refresh, loginTokenTTL)
+}
+
+// xtokenRevoke deletes login token together with its refresh tokens. Token
+// is set by value for logout or by id from token list. User can revoke own
+// tokens only.
+func (e mainEnv) xtokenRevoke(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	event := audit("revoke login token", "", "", "")
+	defer func() { event.submit(e.db) }()
+	record, err := e.db.lookupUserXtoken(ps.ByName("xtoken"))
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	if record != nil {
+		event.Record = record["token"].(string)
+	}
+	if e.enforceAuth(w, r, event) == "" {
+		return
+	}
+	if record == nil {
+		returnError(w, r, "token not found", 405, nil, event)
+		return
+	}
+	num, err := e.db.revokeUserXtoken(record)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	event.Msg = fmt.Sprintf("revoked %d tokens", num)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// xtokenList returns active login and refresh tokens of the user
+func (e mainEnv) xtokenList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	address := ps.ByName("address")
+	mode := ps.ByName("mode")
+	event := audit("get user login tokens", address, mode, address)
+	defer func() { event.submit(e.db) }()
+
+	if validateMode(mode) == false {
+		returnError(w, r, "bad mode", 405, nil, event)
+		return
+	}
+	userTOKEN := address
+	var userBson bson.M
+	if mode == "token" {
+		if enforceUUID(w, address, event) == false {
+			return
+		}
+		userBson, _ = e.db.lookupUserRecord(address)
+	} else {
+		userBson, _ = e.db.lookupUserRecordByIndex(mode, address, e.conf)
+		if userBson != nil {
+			userTOKEN = userBson["token"].(string)
+			event.Record = userTOKEN
+		}
+	}
+	if e.enforceAuth(w, r, event) == "" {
+		return
+	}
+	if userBson == nil {
+		returnError(w, r, "record not found", 405, nil, event)
+		return
+	}
+	resultJSON, count, err := e.db.listUserXtokens(userTOKEN)
+	if err != nil {
+		returnError(w, r, "internal error", 405, err, event)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, `{"status":"ok","total":%d,"rows":%s}`, count, resultJSON)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	uuid "github.com/hashicorp/go-uuid"
@@ -12,6 +14,36 @@ import (
 
 var rootXTOKEN string
 
+// lifetime of user login and refresh tokens in seconds
+var (
+	loginTokenTTL   int32 = 10 * 60
+	refreshTokenTTL int32 = 30 * 24 * 3600
+)
+
+// setLoginTokenTTL sets lifetime of login and refresh tokens from policy,
+// default values are used for empty strings. Refresh tokens are disabled
+// with "0s".
+func setLoginTokenTTL(loginTTL string, refreshTTL string) error {
+	if len(loginTTL) > 0 {
+		ttl, err := parseExpiration0(loginTTL)
+		if err != nil {
+			return err
+		}
+		if ttl == 0 {
+			return errors.New("login token ttl can not be 0")
+		}
+		loginTokenTTL = ttl
+	}
+	if len(refreshTTL) > 0 {
+		ttl, err := parseExpiration0(refreshTTL)
+		if err != nil {
+			return err
+		}
+		refreshTokenTTL = ttl
+	}
+	return nil
+}
+
 func (dbobj dbcon) getRootXtoken() (string, error) {
 	record, err := dbobj.store.GetRecord2(storage.TblName.Xtokens, "token", "", "type", "root")
 	if record == nil || err != nil {
@@ -39,7 +71,8 @@ func (dbobj dbcon) createRootXtoken(customRootXtoken string) (string, error) {
 		rootToken = customRootXtoken
 	}
 	bdoc := bson.M{}
-	bdoc["xtoken"] = hashString(dbobj.hash, rootToken)
+	bdoc["xtoken"] = dbobj.hashXtoken(rootToken)
+	bdoc["idxver"] = int32(indexVersion)
 	bdoc["type"] = "root"
 	bdoc["token"] = ""
 	_, err = dbobj.store.CreateRecord(storage.TblName.Xtokens, bdoc)
@@ -56,35 +89,177 @@ func (dbobj dbcon) generateUserLoginXtoken(userTOKEN string) (string, string, er
 		// not found
 		return "", "", errors.New("not found")
 	}
+	return dbobj.createUserXtoken(userTOKEN, "login", "", loginTokenTTL)
+}
+
+// loginUserXtokens creates login token and refresh token of the user,
+// refresh token is empty when refresh tokens are disabled
+func (dbobj dbcon) loginUserXtokens(userTOKEN string) (string, string, string, error) {
+	xtoken, hashedToken, err := dbobj.generateUserLoginXtoken(userTOKEN)
+	if err != nil {
+		return "", "", "", err
+	}
+	refresh := ""
+	if refreshTokenTTL > 0 {
+		refresh, _, err = dbobj.createUserXtoken(userTOKEN, "refresh", hashedToken, refreshTokenTTL)
+	}
+	return xtoken, refresh, hashedToken, err
+}
+
+// createUserXtoken saves login or refresh token of the user. Tokens issued
+// by one login and all refreshes after it have the same family, it is hash
+// of the first login token. Logout revokes the whole family.
+func (dbobj dbcon) createUserXtoken(userTOKEN string, tokenType string, family string, ttl int32) (string, string, error) {
 	tokenUUID, err := uuid.GenerateUUID()
 	if err != nil {
 		return "", "", err
 	}
-	hashedToken := hashString(dbobj.hash, tokenUUID)
-	// by default login token for 30 minutes only
-	expired := int32(time.Now().Unix()) + 10*60
+	hashedToken := dbobj.hashXtoken(tokenUUID)
+	if len(family) == 0 {
+		family = hashedToken
+	}
+	now := int32(time.Now().Unix())
 	bdoc := bson.M{}
 	bdoc["token"] = userTOKEN
 	bdoc["xtoken"] = hashedToken
-	bdoc["type"] = "login"
-	bdoc["endtime"] = expired
+	bdoc["idxver"] = int32(indexVersion)
+	bdoc["type"] = tokenType
+	bdoc["family"] = family
+	bdoc["endtime"] = now + ttl
+	bdoc["when"] = now
 	_, err = dbobj.store.CreateRecord(storage.TblName.Xtokens, bdoc)
 	return tokenUUID, hashedToken, err
 }
 
+// xtokenID returns token hash that can be used in URL
+func xtokenID(hashed string) string {
+	return strings.NewReplacer("+", "-", "/", "_").Replace(hashed)
+}
+
+func xtokenHashFromID(id string) string {
+	return strings.NewReplacer("-", "+", "_", "/").Replace(id)
+}
+
+// lookupUserXtoken returns login or refresh token record by token value
+// or by id returned in token list
+func (dbobj dbcon) lookupUserXtoken(xtoken string) (bson.M, error) {
+	hashes := []string{xtokenHashFromID(xtoken)}
+	if isValidUUID(xtoken) {
+		hashes = dbobj.xtokenHashes(xtoken)
+	}
+	for _, hashed := range hashes {
+		record, err := dbobj.store.GetRecord(storage.TblName.Xtokens, "xtoken", hashed)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			continue
+		}
+		if tokenType, _ := record["type"].(string); tokenType == "login" || tokenType == "refresh" {
+			return record, nil
+		}
+		return nil, nil
+	}
+	return nil, nil
+}
+
+// revokeUserXtoken deletes login token with all tokens of the same family
+func (dbobj dbcon) revokeUserXtoken(record bson.M) (int64, error) {
+	family, _ := record["family"].(string)
+	if len(family) == 0 {
+		// token issued before families were added
+		return dbobj.store.DeleteRecord(storage.TblName.Xtokens, "xtoken", record["xtoken"].(string))
+	}
+	return dbobj.store.DeleteRecord2(storage.TblName.Xtokens, "token", record["token"].(string), "family", family)
+}
+
+// refreshUserXtoken exchanges refresh token for a new login token and a new
+// refresh token. Refresh token can be used only once.
+func (dbobj dbcon) refreshUserXtoken(refreshUUID string) (string, string, string, error) {
+	if isValidUUID(refreshUUID) == false {
+		// token hash from token list can not be used here
+		return "", "", "", errors.New("failed to authenticate")
+	}
+	var userTOKEN, xtoken, refresh string
+	err := dbobj.withTx(func(dbTx dbcon) error {
+		record, err := dbTx.lookupUserXtoken(refreshUUID)
+		if err != nil {
+			return err
+		}
+		if record == nil || record["type"].(string) != "refresh" {
+			return errors.New("failed to authenticate")
+		}
+		if int32(time.Now().Unix()) > record["endtime"].(int32) {
+			return errors.New("xtoken expired")
+		}
+		_, err = dbTx.store.DeleteRecord(storage.TblName.Xtokens, "xtoken", record["xtoken"].(string))
+		if err != nil {
+			return err
+		}
+		userTOKEN = record["token"].(string)
+		family, _ := record["family"].(string)
+		xtoken, _, err = dbTx.createUserXtoken(userTOKEN, "login", family, loginTokenTTL)
+		if err != nil {
+			return err
+		}
+		refresh, _, err = dbTx.createUserXtoken(userTOKEN, "refresh", family, refreshTokenTTL)
+		return err
+	})
+	return userTOKEN, xtoken, refresh, err
+}
+
+// listUserXtokens returns active login and refresh tokens of the user.
+// Token values are not saved, tokens are listed by hash.
+func (dbobj dbcon) listUserXtokens(userTOKEN string) ([]byte, int, error) {
+	records, err := dbobj.store.GetList(storage.TblName.Xtokens, "token", userTOKEN, 0, 0, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	now := int32(time.Now().Unix())
+	results := []bson.M{}
+	for _, record := range records {
+		tokenType, _ := record["type"].(string)
+		endtime, _ := record["endtime"].(int32)
+		if (tokenType != "login" && tokenType != "refresh") || endtime < now {
+			continue
+		}
+		element := bson.M{"id": xtokenID(record["xtoken"].(string)), "type": tokenType, "endtime": endtime}
+		if when, ok := record["when"].(int32); ok {
+			element["when"] = when
+		}
+		results = append(results, element)
+	}
+	resultJSON, err := json.Marshal(results)
+	return resultJSON, len(results), err
+}
+
 func (dbobj dbcon) checkUserAuthXToken(xtokenUUID string) (tokenAuthResult, error) {
 	result := tokenAuthResult{}
 	if xtokenUUID != "DEMO" && isValidUUID(xtokenUUID) == false {
 		return result, errors.New("failed to authenticate")
 	}
-	xtokenHashed := hashString(dbobj.hash, xtokenUUID)
+	hashes := dbobj.xtokenHashes(xtokenUUID)
+	xtokenHashed := hashes[0]
 	if len(rootXTOKEN) > 0 && rootXTOKEN == xtokenHashed {
 		//fmt.Println("It is a root token")
 		result.ttype = "root"
 		result.name = "root"
 		return result, nil
 	}
-	record, err := dbobj.store.GetRecord(storage.TblName.Xtokens, "xtoken", xtokenHashed)
+	var record bson.M
+	var err error
+	for i, hashed := range hashes {
+		record, err = dbobj.store.GetRecord(storage.TblName.Xtokens, "xtoken", hashed)
+		if record != nil && err == nil && i > 0 {
+			// token was hashed with the old master key or previous index version,
+			// re-hash it on first use
+			bdoc := bson.M{"xtoken": xtokenHashed, "idxver": int32(indexVersion)}
+			dbobj.store.UpdateRecord(storage.TblName.Xtokens, "xtoken", hashed, &bdoc)
+		}
+		if record != nil || err != nil {
+			break
+		}
+	}
 	if record == nil || err != nil {
 		return result, errors.New("failed to authenticate")
 	}
@@ -97,9 +272,23 @@ func (dbobj dbcon) checkUserAuthXToken(xtokenUUID string) (tokenAuthResult, erro
 		result.name = "root"
 		return result, nil
 	}
+	now := int32(time.Now().Unix())
+	if tokenType == "service" {
+		scope := scopeFromRecord(record)
+		if scope.Endtime > 0 && now > scope.Endtime {
+			return result, errors.New("xtoken expired")
+		}
+		result.ttype = tokenType
+		result.name = scope.Name
+		result.scope = scope
+		return result, nil
+	}
+	if tokenType != "login" {
+		// refresh token can only be exchanged for a new login token
+		return result, errors.New("failed to authenticate")
+	}
 	result.name = xtokenHashed
 	// tokenType = temp
-	now := int32(time.Now().Unix())
 	if now > record["endtime"].(int32) {
 		return result, errors.New("xtoken expired")
 	}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	uuid "github.com/hashicorp/go-uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/paranoidguy/databunker/src/storage"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func helpUserLogin(mode string, address string) (map[string]interface{}, error) {
@@ -263,3 +269,206 @@ func TestGetFakeRequestToken(t *testing.T) {
 		t.Fatalf("Shoud fail to cancel request")
 	}
 }
+
+func TestLoginXtokenRefreshRevoke(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"xtokenuser","email":"xtoken@user.com"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	e.db.generateDemoLoginCode(userTOKEN)
+	request := httptest.NewRequest("GET", "http://localhost:3000/v1/login/email/xtoken@user.com/4444", nil)
+	raw, err = helpServe(request)
+	if err != nil || raw["status"].(string) != "ok" || len(raw["refresh"].(string)) == 0 {
+		t.Fatalf("failed to login: %v", raw)
+	}
+	xtoken := raw["xtoken"].(string)
+	refresh := raw["refresh"].(string)
+	// refresh token is not accepted as access token
+	request = httptest.NewRequest("GET", "http://localhost:3000/v1/user/token/"+userTOKEN, nil)
+	request.Header.Set("X-Bunker-Token", refresh)
+	if _, err = helpServe(request); err == nil {
+		t.Fatalf("refresh token should not be used for access")
+	}
+	request = httptest.NewRequest("POST", "http://localhost:3000/v1/xtoken/refresh", strings.NewReader(`{"refresh":"`+refresh+`"}`))
+	raw, err = helpServe(request)
+	if err != nil || raw["status"].(string) != "ok" || raw["token"].(string) != userTOKEN {
+		t.Fatalf("failed to refresh login token: %v", raw)
+	}
+	newXtoken := raw["xtoken"].(string)
+	request = httptest.NewRequest("POST", "http://localhost:3000/v1/xtoken/refresh", strings.NewReader(`{"refresh":"`+refresh+`"}`))
+	if _, err = helpServe(request); err == nil {
+		t.Fatalf("refresh token should be used only once")
+	}
+	request = httptest.NewRequest("GET", "http://localhost:3000/v1/xtokens/token/"+userTOKEN, nil)
+	request.Header.Set("X-Bunker-Token", newXtoken)
+	raw, err = helpServe(request)
+	if err != nil || raw["total"].(float64) != 3 {
+		t.Fatalf("failed to list login tokens: %v", raw)
+	}
+	// caller without access can not tell registered and unknown emails apart
+	request = httptest.NewRequest("GET", "http://localhost:3000/v1/xtokens/email/xtoken@user.com", nil)
+	known, _ := helpServe0(request)
+	request = httptest.NewRequest("GET", "http://localhost:3000/v1/xtokens/email/unknown@user.com", nil)
+	unknown, _ := helpServe0(request)
+	if bytes.Equal(known, unknown) == false {
+		t.Fatalf("xtokens list reveals registered email: %s", known)
+	}
+	// logout revokes all tokens issued by the login
+	request = httptest.NewRequest("DELETE", "http://localhost:3000/v1/xtoken/"+newXtoken, nil)
+	request.Header.Set("X-Bunker-Token", newXtoken)
+	if _, err = helpServe(request); err != nil {
+		t.Fatalf("failed to revoke login token: %s", err)
+	}
+	for _, token := range []string{xtoken, newXtoken} {
+		request = httptest.NewRequest("GET", "http://localhost:3000/v1/user/token/"+userTOKEN, nil)
+		request.Header.Set("X-Bunker-Token", token)
+		if _, err = helpServe(request); err == nil {
+			t.Fatalf("revoked token should be denied")
+		}
+	}
+	count, _ := e.db.store.CountRecords(storage.TblName.Xtokens, "token", userTOKEN)
+	if count != 0 {
+		t.Fatalf("refresh token is left after logout")
+	}
+	helpDeleteUser("token", userTOKEN)
+}
+
+func helpLoginCode(address string, code string, ip string) (map[string]interface{}, error) {
+	request := httptest.NewRequest("GET", "http://localhost:3000/v1/login/email/"+address+"/"+code, nil)
+	request.RemoteAddr = ip + ":1234"
+	return helpServe(request)
+}
+
+func TestLoginBruteForce(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"bruteuser","email":"brute@user.com"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	unlock := func() {
+		bdoc := bson.M{"loginlock": int32(time.Now().Unix())}
+		e.db.store.UpdateRecord(storage.TblName.Users, "token", userTOKEN, &bdoc)
+	}
+	e.db.generateDemoLoginCode(userTOKEN)
+	// wrong code, locked user and unknown address get the same response
+	unknown, _ := helpLoginCode("unknown@user.com", "1111", "10.0.0.1")
+	if raw, _ = helpLoginCode("brute@user.com", "1111", "10.0.0.1"); raw["message"] != unknown["message"] {
+		t.Fatalf("wrong code should be rejected as unknown user: %v", raw)
+	}
+	if raw, _ = helpLoginCode("brute@user.com", "4444", "10.0.0.1"); raw["message"] != unknown["message"] {
+		t.Fatalf("next attempt should wait: %v", raw)
+	}
+	unlock()
+	if _, err = helpLoginCode("brute@user.com", "4444", "10.0.0.1"); err != nil {
+		t.Fatalf("failed to login: %s", err)
+	}
+	if _, err = helpLoginCode("brute@user.com", "4444", "10.0.0.1"); err == nil {
+		t.Fatalf("login code should be used only once")
+	}
+	unlock()
+	e.db.generateDemoLoginCode(userTOKEN)
+	for i := int32(0); i < maxLoginAttempts; i++ {
+		unlock()
+		helpLoginCode("brute@user.com", "1111", "10.0.0.2")
+	}
+	record, _ := e.db.store.GetRecord(storage.TblName.Users, "token", userTOKEN)
+	if record["tempcode"].(int32) != 0 || userLoginLockedFor(record) <= loginLockoutPeriod-10 {
+		t.Fatalf("user should be locked: %v", record)
+	}
+	request := httptest.NewRequest("GET", "http://localhost:3000/v1/prelogin/email/brute@user.com", nil)
+	if raw, _ = helpServe(request); raw["status"] != "ok" {
+		t.Fatalf("locked user should get the same prelogin response: %v", raw)
+	}
+	record, _ = e.db.store.GetRecord(storage.TblName.Users, "token", userTOKEN)
+	if record["tempcode"].(int32) != 0 {
+		t.Fatalf("locked user should not get login code\n")
+	}
+
+	// client ip is locked after failures for different users
+	defer func(max int32) { maxLoginAttemptsPerIP = max }(maxLoginAttemptsPerIP)
+	maxLoginAttemptsPerIP = 3
+	for i := 0; i < 3; i++ {
+		helpLoginCode(fmt.Sprintf("fake%d@user.com", i), "1111", "10.0.0.3")
+	}
+	if raw, _ = helpLoginCode("fake4@user.com", "1111", "10.0.0.3"); raw["message"] != "too many login attempts" {
+		t.Fatalf("client ip should be locked: %v", raw)
+	}
+	if raw, _ = helpLoginCode("fake4@user.com", "1111", "10.0.0.4"); raw["message"] == "too many login attempts" {
+		t.Fatalf("other client ip should not be locked: %v", raw)
+	}
+}
+
+func helpMagicLogin(link string) (map[string]interface{}, error) {
+	request := httptest.NewRequest("POST", "http://localhost:3000/v1/magiclink", strings.NewReader(`{"link":"`+link+`"}`))
+	return helpServe(request)
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	raw, err := helpCreateUser(`{"login":"magicuser","email":"magic@user.com"}`)
+	if err != nil || raw["status"].(string) != "ok" {
+		t.Fatalf("failed to create user: %v", raw)
+	}
+	userTOKEN := raw["token"].(string)
+	link, err := e.db.createMagicLink(userTOKEN)
+	if err != nil {
+		t.Fatalf("failed to create magic link: %s", err)
+	}
+	parts := strings.Split(link, ".")
+	forged := parts[0] + ".2000000000." + parts[2]
+	if raw, _ = helpMagicLogin(forged); raw["message"] != "bad login link" {
+		t.Fatalf("forged link should be rejected: %v", raw)
+	}
+
+	// opening the link only redirects to the frontend
+	env := e
+	env.conf.SelfService.MagicLink = true
+	env.conf.SelfService.MagicLinkURL = "https://databunker.example.com"
+	env.conf.SelfService.MagicLinkRedirect = "https://portal.example.com/login"
+	request := httptest.NewRequest("GET", "http://localhost:3000/v1/magiclink/"+link, nil)
+	rr := httptest.NewRecorder()
+	env.userMagicLink(rr, request, httprouter.Params{{Key: "link", Value: link}})
+	location := rr.Header().Get("Location")
+	if rr.Code != 302 || location != "https://portal.example.com/login#link="+url.QueryEscape(link) {
+		t.Fatalf("user should be redirected with the link: %d %s", rr.Code, location)
+	}
+
+	raw, err = helpMagicLogin(link)
+	if err != nil || raw["token"].(string) != userTOKEN || len(raw["xtoken"].(string)) == 0 {
+		t.Fatalf("failed to login with magic link: %v", raw)
+	}
+	if _, err = helpMagicLogin(link); err == nil {
+		t.Fatalf("magic link should be used only once")
+	}
+
+	request = httptest.NewRequest("GET", "http://localhost:3000/v1/prelogin/email/magic@user.com", nil)
+	rr = httptest.NewRecorder()
+	env.userPrelogin(rr, request, httprouter.Params{{Key: "mode", Value: "email"}, {Key: "address", Value: "magic@user.com"}})
+	if rr.Code != 200 || strings.Contains(rr.Body.String(), `"type":"link"`) == false {
+		t.Fatalf("magic link should be sent: %s", rr.Body.String())
+	}
+	record, _ := e.db.store.GetRecord2(storage.TblName.Xtokens, "token", userTOKEN, "type", "magiclink")
+	if record == nil {
+		t.Fatalf("magic link is not saved")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer setTrustedProxies(nil)
+	if err := setTrustedProxies([]string{"10.0.0.1", "172.16.0.0/12"}); err != nil {
+		t.Fatalf("failed to set trusted proxies: %s", err)
+	}
+	request := httptest.NewRequest("GET", "http://localhost:3000/v1/prelogin/email/ip@user.com", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-Forwarded-For", "1.1.1.1, 2.2.2.2, 172.16.5.5")
+	if ip := clientIP(request); ip != "2.2.2.2" {
+		t.Fatalf("wrong client ip behind proxy: %s", ip)
+	}
+	request.RemoteAddr = "3.3.3.3:1234"
+	if ip := clientIP(request); ip != "3.3.3.3" {
+		t.Fatalf("forwarded header of untrusted client should be ignored: %s", ip)
+	}
+	if err := setTrustedProxies([]string{"bad"}); err == nil {
+		t.Fatalf("bad proxy should be rejected")
+	}
+}